@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/roboogg133/packets/cmd/packets/database"
+	"github.com/roboogg133/packets/pkg/packet.lua.d"
+	"github.com/spf13/cobra"
+)
+
+var buildDepsCmd = &cobra.Command{
+	Use:   "build-deps",
+	Short: "Manage build dependencies",
+	Long:  "Manage packages installed in the isolated build dependencies prefix",
+}
+
+var buildDepsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List installed build dependencies",
+	Long:  "List packages installed in the isolated build dependencies prefix",
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		pkgs, err := database.ListBuildPackages(db)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		for _, pkg := range pkgs {
+			fmt.Printf("\033[1m==> %s\033[0m\n", pkg.Name)
+			fmt.Printf("  \033[1mPackage ID:\033[0m %s\n", pkg.Id)
+			fmt.Printf("  \033[1mRepository:\033[0m %s\n", pkg.Location)
+			fmt.Printf("  \033[1mPrefix:\033[0m %s\n", pkg.Filepath)
+			fmt.Printf("  \033[1mInstalled timestamp:\033[0m %s\n", time.Unix(pkg.InstalledTimeUnix, 0).Local().Format("01-02-2006 15:04 Monday"))
+			fmt.Print("\n")
+		}
+	},
+}
+
+var buildDepsGcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove unneeded build dependencies",
+	Long:  "Remove build dependencies no installed package needs to be built anymore",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		GrantPrivilegies()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		db, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		pkgs, err := database.ListUnneededBuildPackages(db)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		if len(pkgs) == 0 {
+			fmt.Println("0 unneeded build dependencies")
+			return
+		}
+
+		for _, pkg := range pkgs {
+			if dryRun {
+				fmt.Printf("=> would remove %s (%s)\n", pkg.Id, pkg.Filepath)
+				continue
+			}
+
+			// never follow a corrupted row outside the build dependencies dir
+			prefix := filepath.Clean(pkg.Filepath)
+			if !strings.HasPrefix(prefix, PackageBuildDepsFS+string(os.PathSeparator)) {
+				fmt.Printf("error: refusing to remove %s, it is outside %s\n", prefix, PackageBuildDepsFS)
+				continue
+			}
+
+			if err := os.RemoveAll(prefix); err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				continue
+			}
+			if err := database.MarkAsBuildPackageRemoved(packet.PackageID(pkg.Id), db); err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				continue
+			}
+			fmt.Printf("=> removed %s\n", pkg.Id)
+		}
+	},
+}
+
+func init() {
+	buildDepsGcCmd.Flags().Bool("dry-run", false, "only show what would be removed")
+}
@@ -0,0 +1,138 @@
+package buildlog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DirName        = "logs"
+	FileTimeLayout = "20060102-150405"
+	LineTimeLayout = "2006-01-02 15:04:05"
+)
+
+const (
+	StartedMarker  = "==> started"
+	FinishedMarker = "==> finished"
+	FailedMarker   = "==> failed"
+)
+
+// Log is the timestamped output of a single build or install phase stored inside the package root dir
+type Log struct {
+	Path  string
+	Phase string
+
+	mu        sync.Mutex
+	file      *os.File
+	echo      io.Writer
+	lineStart bool
+}
+
+// New creates {rootdir}/logs/{phase}-{timestamp}.log, echo can be nil or a writer that also receives every line
+func New(rootdir, phase string, echo io.Writer) (*Log, error) {
+	dir := filepath.Join(rootdir, DirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	logPath := filepath.Join(dir, phase+"-"+time.Now().Format(FileTimeLayout)+".log")
+	f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		Path:      logPath,
+		Phase:     phase,
+		file:      f,
+		echo:      echo,
+		lineStart: true,
+	}
+	fmt.Fprintf(l, "%s %s\n", StartedMarker, phase)
+	return l, nil
+}
+
+// Write prefixes every line with the current time, so it is safe to hand directly to exec.Cmd
+func (l *Log) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var builder strings.Builder
+	for _, b := range p {
+		if l.lineStart {
+			builder.WriteString("[" + time.Now().Format(LineTimeLayout) + "] ")
+			l.lineStart = false
+		}
+		builder.WriteByte(b)
+		if b == '\n' {
+			l.lineStart = true
+		}
+	}
+
+	if _, err := l.file.WriteString(builder.String()); err != nil {
+		return 0, err
+	}
+	if l.echo != nil {
+		l.echo.Write(p)
+	}
+	return len(p), nil
+}
+
+// Close writes the phase result to the log and closes it
+func (l *Log) Close(phaseErr error) error {
+	if !l.lineStart {
+		l.Write([]byte("\n"))
+	}
+	if phaseErr != nil {
+		fmt.Fprintf(l, "%s %s: %s\n", FailedMarker, l.Phase, phaseErr.Error())
+	} else {
+		fmt.Fprintf(l, "%s %s\n", FinishedMarker, l.Phase)
+	}
+	return l.file.Close()
+}
+
+// Phase returns the phase a log file belongs to based on its name
+func Phase(logPath string) string {
+	phase, _, _ := strings.Cut(filepath.Base(logPath), "-")
+	return phase
+}
+
+// IsDone reports if the log content already has the line written by Close
+func IsDone(content string) bool {
+	return strings.Contains(content, "] "+FinishedMarker+" ") || strings.Contains(content, "] "+FailedMarker+" ")
+}
+
+// PrefixWriter prefixes every line written to W, used to tell concurrent builds apart on the terminal
+type PrefixWriter struct {
+	Prefix string
+	W      io.Writer
+
+	mu      sync.Mutex
+	midLine bool
+}
+
+func (p *PrefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var builder strings.Builder
+	for _, c := range b {
+		if !p.midLine {
+			builder.WriteString(p.Prefix)
+			p.midLine = true
+		}
+		builder.WriteByte(c)
+		if c == '\n' {
+			p.midLine = false
+		}
+	}
+	if _, err := io.WriteString(p.W, builder.String()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
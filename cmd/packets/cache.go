@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roboogg133/packets/cmd/packets/cache"
+	"github.com/roboogg133/packets/cmd/packets/digest"
+	"github.com/roboogg133/packets/cmd/packets/download"
+	"github.com/roboogg133/packets/cmd/packets/httpclient"
+	"github.com/roboogg133/packets/cmd/packets/lockfile"
+	"github.com/roboogg133/packets/pkg/packet.lua.d"
+	"github.com/spf13/cobra"
+)
+
+// downloadCache keeps every .pkt and source archive by sha256, it is written by the packets user
+var downloadCache = cache.New(CacheDir)
+
+// CacheMaxSize is the configured size cap of the download cache in bytes
+func CacheMaxSize() int64 {
+	mb := DefaultCacheMaxSizeMB
+	if Config != nil && Config.Cache.MaxSizeMB > 0 {
+		mb = Config.Cache.MaxSizeMB
+	}
+	return int64(mb) << 20
+}
+
+// httpClient is built from the [HTTP] table of config.toml by GetConfiguration
+var httpClient *http.Client
+
+// HTTPClient is the client of every sync and download, commands run without a config.toml get the defaults
+func HTTPClient() (*http.Client, error) {
+	if httpClient == nil {
+		client, err := httpclient.New(httpclient.Config{})
+		if err != nil {
+			return nil, err
+		}
+		httpClient = client
+	}
+	return httpClient, nil
+}
+
+// SignatureDownload is the kind of detached signatures, they are downloaded again every time and never cached
+const SignatureDownload = "signature"
+
+// DownloadRequest is a file fetched through the download cache
+type DownloadRequest struct {
+	// Urls are tried in order, the first one is the url the file is known by
+	Urls []string
+	Kind string
+	// Accepted are the sums the file may have, none accepts any
+	Accepted []string
+	// ByUrl finds a copy by the first url when no sum is known
+	ByUrl      bool
+	NewRequest func(url string) (*http.Request, error)
+}
+
+// CachedDownload returns the cached copy of a download and its sha256. Without a copy the file is streamed into
+// the cache, continuing an earlier interrupted transfer, and the least recently used files are evicted past
+// the size cap
+func CachedDownload(request DownloadRequest) (string, string, error) {
+	for _, sum := range request.Accepted {
+		if p, ok := downloadCache.Lookup(sum); ok {
+			return p, strings.ToLower(sum), nil
+		}
+	}
+
+	var url string
+	if request.ByUrl {
+		url = request.Urls[0]
+	}
+	if len(request.Accepted) == 0 && url != "" {
+		if p, sum, ok := downloadCache.LookupUrl(url); ok {
+			return p, sum, nil
+		}
+	}
+
+	dest, err := downloadCache.Partial(request.Kind + " " + request.Urls[0])
+	if err != nil {
+		return "", "", err
+	}
+
+	client, err := HTTPClient()
+	if err != nil {
+		return "", "", err
+	}
+	sum, _, err := download.File(client, request.Urls, request.NewRequest, dest, NumberOfTryAttempts)
+	if err != nil {
+		return "", "", err
+	}
+	if len(request.Accepted) > 0 && !slices.ContainsFunc(request.Accepted, func(s string) bool { return strings.EqualFold(s, sum) }) {
+		os.Remove(dest)
+		return "", "", fmt.Errorf("%w: %s has sha256 %s, expected %s", packet.ErrSha256Sum, request.Urls[0], sum, strings.Join(request.Accepted, " or "))
+	}
+
+	entry, err := downloadCache.Adopt(dest, sum, url, request.Kind)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := downloadCache.Evict(CacheMaxSize(), entry.SHA256); err != nil {
+		fmt.Printf("error: evicting cached files: %s\n", err.Error())
+	}
+
+	p, _ := downloadCache.Lookup(entry.SHA256)
+	return p, entry.SHA256, nil
+}
+
+// FreshDownload downloads a file that may be replaced upstream without going through the cache, it is neither
+// looked up nor kept there. The caller removes the returned file
+func FreshDownload(request DownloadRequest) (string, error) {
+	dest, err := downloadCache.Partial(request.Kind + " " + request.Urls[0])
+	if err != nil {
+		return "", err
+	}
+	// what is left of an earlier transfer may be part of a file replaced since
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	client, err := HTTPClient()
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := download.File(client, request.Urls, request.NewRequest, dest, NumberOfTryAttempts); err != nil {
+		os.Remove(dest)
+		return "", err
+	}
+	return dest, nil
+}
+
+// CachedSource returns the cached copy of a GET or POST source. POST sources are only found by their sum,
+// the same url can answer differently to other bodies
+func CachedSource(source *packet.HTTPSource) (string, string, error) {
+	p, sum, err := CachedDownload(DownloadRequest{
+		Urls:       source.Urls(),
+		Kind:       lockfile.SourceDownload,
+		Accepted:   source.SHA256,
+		ByUrl:      source.Method == "GET",
+		NewRequest: source.NewRequest,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	// the cache only knows sha256, a copy failing the other digests is dropped so it is not found again
+	if err := digest.Verify(p, source.Digests); err != nil {
+		_ = downloadCache.Remove(cache.Entry{SHA256: sum, Url: source.Url})
+		return "", "", fmt.Errorf("%s: %w", source.Url, err)
+	}
+	return p, sum, nil
+}
+
+// RequireDigest reports if config.toml rejects sources without any digest
+func RequireDigest() bool {
+	return Config != nil && Config.Verification.RequireDigest
+}
+
+// parseAge reads durations like 12h, 30m or 7d
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %s", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
+
+func printRemoved(removed []cache.Entry) {
+	var total int64
+	for _, entry := range removed {
+		total += entry.Size
+	}
+	fmt.Printf("=> %d cached files removed, %s freed\n", len(removed), formatSize(total))
+}
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the download cache",
+	Long:  "Manage the cache of downloaded .pkt files and sources",
+}
+
+var cacheListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List cached downloads",
+	Long:  "List the cached downloads, the least recently used first",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		entries, err := downloadCache.List()
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		if len(entries) == 0 {
+			fmt.Println("the cache is empty")
+			return
+		}
+
+		var total int64
+		for _, entry := range entries {
+			total += entry.Size
+			fmt.Printf("\033[1m==> %s\033[0m\n", entry.SHA256)
+			if entry.Url != "" {
+				fmt.Printf("  \033[1mUrl:\033[0m %s\n", entry.Url)
+			}
+			if entry.Kind != "" {
+				fmt.Printf("  \033[1mKind:\033[0m %s\n", entry.Kind)
+			}
+			fmt.Printf("  \033[1mSize:\033[0m %s\n", formatSize(entry.Size))
+			fmt.Printf("  \033[1mLast used:\033[0m %s\n", entry.LastUsed.Local().Format("01-02-2006 15:04 Monday"))
+			fmt.Print("\n")
+		}
+		fmt.Printf("%d files, %s\n", len(entries), formatSize(total))
+	},
+}
+
+var cacheCleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Remove every cached download",
+	Long:  "Remove every cached download",
+	Args:  cobra.NoArgs,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		GrantPrivilegies()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		removed, err := downloadCache.Clean()
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		printRemoved(removed)
+	},
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove cached downloads not used recently",
+	Long:  "Remove the cached downloads not used for longer than --older-than, then the least recently used ones past the size cap",
+	Args:  cobra.NoArgs,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		GrantPrivilegies()
+		// the size cap is optional here, the defaults apply without a config.toml
+		_ = GetConfiguration()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		var removed []cache.Entry
+
+		if olderThan, _ := cmd.Flags().GetString("older-than"); olderThan != "" {
+			age, err := parseAge(olderThan)
+			if err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				os.Exit(1)
+			}
+			pruned, err := downloadCache.Prune(age)
+			removed = append(removed, pruned...)
+			if err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				os.Exit(1)
+			}
+		}
+
+		evicted, err := downloadCache.Evict(CacheMaxSize())
+		removed = append(removed, evicted...)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		printRemoved(removed)
+	},
+}
@@ -0,0 +1,259 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Cache is a content-addressed store of downloaded files:
+//
+//	{dir}/objects/{sha256}     the file itself, its mtime is the last time it was used
+//	{dir}/meta/{sha256}.json   the Entry it was stored with
+//	{dir}/urls/{sha256 of url} the sha256 of the last file downloaded from that url
+//	{dir}/partial/             downloads that did not complete yet
+type Cache struct {
+	dir string
+}
+
+// Entry describes a cached file
+type Entry struct {
+	SHA256   string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	Url      string    `json:"url"`
+	Kind     string    `json:"kind"`
+	Added    time.Time `json:"added"`
+	LastUsed time.Time `json:"-"`
+}
+
+func New(dir string) *Cache { return &Cache{dir: dir} }
+
+func (c *Cache) Dir() string { return c.dir }
+
+func (c *Cache) objectPath(sum string) string { return filepath.Join(c.dir, "objects", sum) }
+func (c *Cache) metaPath(sum string) string   { return filepath.Join(c.dir, "meta", sum+".json") }
+func (c *Cache) urlPath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, "urls", hex.EncodeToString(sum[:]))
+}
+
+func validSum(sum string) bool {
+	if len(sum) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil
+}
+
+// Lookup returns the path of the cached file with sum and marks it as used
+func (c *Cache) Lookup(sum string) (string, bool) {
+	sum = strings.ToLower(sum)
+	if !validSum(sum) {
+		return "", false
+	}
+	p := c.objectPath(sum)
+	if _, err := os.Stat(p); err != nil {
+		return "", false
+	}
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+	return p, true
+}
+
+// LookupUrl returns the path and sum of the last file stored for url
+func (c *Cache) LookupUrl(url string) (string, string, bool) {
+	data, err := os.ReadFile(c.urlPath(url))
+	if err != nil {
+		return "", "", false
+	}
+	sum := strings.TrimSpace(string(data))
+	p, ok := c.Lookup(sum)
+	return p, sum, ok
+}
+
+// Partial returns where a download identified by key is written until it is complete, so an interrupted
+// download is found again by the next one
+func (c *Cache) Partial(key string) (string, error) {
+	if err := os.MkdirAll(filepath.Join(c.dir, "partial"), 0755); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, "partial", hex.EncodeToString(sum[:])), nil
+}
+
+// Adopt moves the complete file at path with sum into the cache
+func (c *Cache) Adopt(path, sum, url, kind string) (Entry, error) {
+	for _, sub := range []string{"objects", "meta", "urls"} {
+		if err := os.MkdirAll(filepath.Join(c.dir, sub), 0755); err != nil {
+			return Entry{}, err
+		}
+	}
+
+	sum = strings.ToLower(sum)
+	if !validSum(sum) {
+		return Entry{}, fmt.Errorf("invalid sha256 %q", sum)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	entry := Entry{
+		SHA256:   sum,
+		Size:     info.Size(),
+		Url:      url,
+		Kind:     kind,
+		Added:    time.Now().UTC().Truncate(time.Second),
+		LastUsed: time.Now(),
+	}
+	if err := os.Chmod(path, 0644); err != nil {
+		return Entry{}, err
+	}
+	if err := os.Rename(path, c.objectPath(sum)); err != nil {
+		return Entry{}, err
+	}
+	now := time.Now()
+	_ = os.Chtimes(c.objectPath(sum), now, now)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return Entry{}, err
+	}
+	if err := os.WriteFile(c.metaPath(sum), data, 0644); err != nil {
+		return Entry{}, err
+	}
+	if url != "" {
+		if err := os.WriteFile(c.urlPath(url), []byte(sum+"\n"), 0644); err != nil {
+			return Entry{}, err
+		}
+	}
+	return entry, nil
+}
+
+// List returns every cached file, the least recently used first
+func (c *Cache) List() ([]Entry, error) {
+	files, err := os.ReadDir(filepath.Join(c.dir, "objects"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, file := range files {
+		sum := file.Name()
+		if !validSum(sum) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+
+		entry := Entry{SHA256: sum}
+		if data, err := os.ReadFile(c.metaPath(sum)); err == nil {
+			_ = json.Unmarshal(data, &entry)
+		}
+		entry.Size = info.Size()
+		entry.LastUsed = info.ModTime()
+		entries = append(entries, entry)
+	}
+
+	slices.SortFunc(entries, func(a, b Entry) int { return a.LastUsed.Compare(b.LastUsed) })
+	return entries, nil
+}
+
+// Remove deletes a cached file and its metadata, the url index is dropped when it still points to it
+func (c *Cache) Remove(entry Entry) error {
+	if !validSum(entry.SHA256) {
+		return fmt.Errorf("invalid cache entry %q", entry.SHA256)
+	}
+	if err := os.Remove(c.objectPath(entry.SHA256)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	_ = os.Remove(c.metaPath(entry.SHA256))
+
+	if entry.Url != "" {
+		if data, err := os.ReadFile(c.urlPath(entry.Url)); err == nil && strings.TrimSpace(string(data)) == entry.SHA256 {
+			_ = os.Remove(c.urlPath(entry.Url))
+		}
+	}
+	return nil
+}
+
+// Prune removes the files not used for longer than olderThan
+func (c *Cache) Prune(olderThan time.Duration) ([]Entry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []Entry
+	for _, entry := range entries {
+		if time.Since(entry.LastUsed) <= olderThan {
+			continue
+		}
+		if err := c.Remove(entry); err != nil {
+			return removed, err
+		}
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
+
+// Evict removes the least recently used files until the cache is at most maxSize bytes, the files in keep
+// are never removed
+func (c *Cache) Evict(maxSize int64, keep ...string) ([]Entry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	var removed []Entry
+	for _, entry := range entries {
+		if total <= maxSize {
+			break
+		}
+		if slices.Contains(keep, entry.SHA256) {
+			continue
+		}
+		if err := c.Remove(entry); err != nil {
+			return removed, err
+		}
+		total -= entry.Size
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
+
+// Clean removes every cached file and what interrupted downloads left behind
+func (c *Cache) Clean() ([]Entry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, entry := range entries {
+		if err := c.Remove(entry); err != nil {
+			return entries[:i], err
+		}
+	}
+
+	if err := os.RemoveAll(filepath.Join(c.dir, "partial")); err != nil {
+		return entries, err
+	}
+	return entries, nil
+}
@@ -1,20 +1,85 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 
 	"github.com/pelletier/go-toml/v2"
+	"github.com/roboogg133/packets/cmd/packets/httpclient"
 )
 
 type PacketsConfiguration struct {
 	BinDir string `toml:"BinDir"`
+
+	Generations GenerationsConfiguration `toml:"Generations"`
+	Cache       CacheConfiguration       `toml:"Cache"`
+	HTTP        httpclient.Config        `toml:"HTTP"`
+
+	Verification VerificationConfiguration `toml:"Verification"`
+
+	// Repositories are the credentials of private repositories, keyed by location. They are better kept in
+	// CredentialsFile, which wins over config.toml
+	Repositories map[string]RepositoryCredentials `toml:"Repositories"`
+}
+
+// VerificationConfiguration is the policy sources are checked with
+type VerificationConfiguration struct {
+	// RequireDigest rejects GET and POST sources without any digest and git sources without a commit
+	RequireDigest bool `toml:"RequireDigest"`
+}
+
+// RepositoryCredentials authenticate the index and .pkt downloads of a repository, they are sent to its host only
+type RepositoryCredentials struct {
+	Token      string `toml:"Token"`
+	Username   string `toml:"Username"`
+	Password   string `toml:"Password"`
+	ClientCert string `toml:"ClientCert"`
+	ClientKey  string `toml:"ClientKey"`
+}
+
+// credentialsFile holds the Repositories table of CredentialsFile
+type credentialsFile struct {
+	Repositories map[string]RepositoryCredentials `toml:"Repositories"`
+}
+
+// GenerationsConfiguration is the retention policy of generations, older ones are pruned after every transaction
+type GenerationsConfiguration struct {
+	// Keep is how many generations are kept at most, 0 means DefaultGenerationsKept
+	Keep int `toml:"Keep"`
+	// MaxAgeDays prunes generations older than it even below Keep, 0 disables it
+	MaxAgeDays int `toml:"MaxAgeDays"`
+}
+
+// CacheConfiguration limits the download cache, the least recently used files are evicted past MaxSizeMB
+type CacheConfiguration struct {
+	// MaxSizeMB is the size cap in megabytes, 0 means DefaultCacheMaxSizeMB
+	MaxSizeMB int `toml:"MaxSizeMB"`
 }
 
 func GetConfiguration() error {
+	return loadConfiguration(true)
+}
+
+// GetUnprivilegedConfiguration is GetConfiguration for commands run as the invoking user, without a config.toml
+// the defaults apply and a credentials file only root can read is skipped
+func GetUnprivilegedConfiguration() error {
+	return loadConfiguration(false)
+}
+
+func loadConfiguration(privileged bool) error {
 	configFile := filepath.Join(ConfigurationDir, "config.toml")
 	data, err := os.ReadFile(configFile)
-	if err != nil {
+	if errors.Is(err, fs.ErrNotExist) && !privileged {
+		return nil
+	} else if err != nil {
 		return err
 	}
 	var config PacketsConfiguration
@@ -23,6 +88,109 @@ func GetConfiguration() error {
 		return err
 	}
 
+	credentials, err := readCredentialsFile(CredentialsFile)
+	if errors.Is(err, fs.ErrPermission) && !privileged {
+		fmt.Printf("==> %s is only readable by root, private repositories are accessed without their credentials\n", CredentialsFile)
+	} else if err != nil {
+		return err
+	}
+	if config.Repositories == nil {
+		config.Repositories = make(map[string]RepositoryCredentials)
+	}
+	for location, v := range credentials {
+		config.Repositories[location] = v
+	}
+
+	httpConfig, err := httpConfiguration(&config)
+	if err != nil {
+		return err
+	}
+	// the client is built while still privileged, CA files, client keys and the .netrc may not be readable by the packets user
+	client, err := httpclient.New(httpConfig)
+	if err != nil {
+		return fmt.Errorf("%s: HTTP: %w", configFile, err)
+	}
+
 	Config = &config
+	httpClient = client
 	return nil
 }
+
+// readCredentialsFile reads the repository credentials of path, it must be only readable by root
+func readCredentialsFile(path string) (map[string]RepositoryCredentials, error) {
+	stat, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if stat.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s is accessible by other users than root, run chmod 600 %s", path, path)
+	}
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok && sys.Uid != 0 {
+		return nil, fmt.Errorf("%s is not owned by root", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file credentialsFile
+	if err := toml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return file.Repositories, nil
+}
+
+// RepositoryHost is the host every url of a repository location is on
+func RepositoryHost(location string) string {
+	location = strings.TrimPrefix(location, "https://")
+	location = strings.TrimPrefix(location, "http://")
+	host := strings.Split(location, "/")[0]
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// httpConfiguration is the HTTP table with the repository credentials added to the hosts of their repositories.
+// Every .pkt of a repository is downloaded from its host, so two repositories on one host must share their
+// credentials and a host of [HTTP.Hosts] can't have credentials of its own as well
+func httpConfiguration(config *PacketsConfiguration) (httpclient.Config, error) {
+	cfg := config.HTTP
+	if len(config.Repositories) == 0 {
+		return cfg, nil
+	}
+
+	hosts := make(map[string]httpclient.HostConfig, len(cfg.Hosts)+len(config.Repositories))
+	for host, v := range cfg.Hosts {
+		hosts[host] = v
+	}
+	from := make(map[string]string)
+	for _, location := range slices.Sorted(maps.Keys(config.Repositories)) {
+		credentials := config.Repositories[location]
+		if strings.HasPrefix(location, "http://") {
+			return cfg, fmt.Errorf("credentials of %s: credentials are only sent over https", location)
+		}
+
+		host := RepositoryHost(location)
+		hostCfg := hosts[host]
+		if other, ok := from[host]; ok {
+			if config.Repositories[other] != credentials {
+				return cfg, fmt.Errorf("%s and %s are on the same host %s but have different credentials", other, location, host)
+			}
+			continue
+		}
+		if hostCfg.Token != "" || hostCfg.Username != "" || hostCfg.Password != "" || hostCfg.ClientCert != "" || hostCfg.ClientKey != "" {
+			return cfg, fmt.Errorf("credentials of %s: [HTTP.Hosts.%q] already has credentials for %s", location, host, host)
+		}
+
+		hostCfg.Token, hostCfg.Username, hostCfg.Password = credentials.Token, credentials.Username, credentials.Password
+		hostCfg.ClientCert, hostCfg.ClientKey = credentials.ClientCert, credentials.ClientKey
+		hosts[host] = hostCfg
+		from[host] = location
+	}
+	cfg.Hosts = hosts
+	return cfg, nil
+}
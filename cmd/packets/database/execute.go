@@ -2,100 +2,33 @@ package database
 
 import (
 	"database/sql"
-	"fmt"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/roboogg133/packets/pkg/install"
 	"github.com/roboogg133/packets/pkg/packet.lua.d"
 )
 
+// install_reason values, dependency packages are removed by autoremove once nothing needs them
 const (
-	CreateInstructions = `CREATE TABLE IF NOT EXISTS installed_packages(
-    name TEXT NOT NULL UNIQUE,
-    id TEXT PRIMARY KEY,
-    version TEXT NOT NULL,
-    serial INTEGER NOT NULL,
-    maintainer TEXT NOT NULL,
-    verified INTEGER NOT NULL DEFAULT 0,
-    description TEXT NOT NULL,
-    upload_time INTEGER NOT NULL,
-    installed_time INTEGER NOT NULL,
-
-    location TEXT NOT NULL,
-
-    image BLOB,
-
-    UNIQUE(name, version),
-    UNIQUE(name, serial)
-);
-
-CREATE TABLE IF NOT EXISTS package_files(
-    package_id TEXT PRIMARY KEY,
-    filepath TEXT NOT NULL,
-    is_dir INTEGER NOT NULL DEFAULT 0,
-
-    UNIQUE(package_id, filepath)
-);
-
-CREATE TABLE IF NOT EXISTS dependencies(
-    package_id TEXT NOT NULL,
-    dependency_name TEXT NOT NULL,
-    version_constraint TEXT NOT NULL,
-
-    PRIMARY KEY (package_id, dependency_name)
-);
-
-
-CREATE TABLE IF NOT EXISTS build_dependencies(
-    package_id TEXT NOT NULL,
-    dependency_name TEXT NOT NULL,
-    version_constraint TEXT NOT NULL,
-
-    PRIMARY KEY (package_id, dependency_name)
-);
-
-
-CREATE TABLE IF NOT EXISTS conflicts(
-    package_id TEXT NOT NULL,
-    dependency_name TEXT NOT NULL,
-    version_constraint TEXT NOT NULL,
-
-    PRIMARY KEY (package_id, dependency_name)
-);
-
-CREATE TABLE IF NOT EXISTS package_flags(
-    package_id TEXT NOT NULL,
-    flag TEXT NOT NULL,
-    name TEXT NOT NULL,
-    path TEXT NOT NULL
-);
-
-CREATE TABLE IF NOT EXISTS build_packages(
-    name TEXT NOT NULL,
-    id TEXT PRIMARY KEY,
-    version TEXT NOT NULL,
-    serial INTEGER NOT NULL,
-    maintainer TEXT NOT NULL,
-    verified INTEGER NOT NULL DEFAULT 0,
-    description TEXT NOT NULL,
-    upload_time INTEGER NOT NULL,
-    installed_time INTEGER NOT NULL,
-
-    location TEXT NOT NULL,
-
-    filepath TEXT NOT NULL,
-
-    UNIQUE(name, version),
-    UNIQUE(name, serial)
-);
-`
+	ReasonExplicit   = "explicit"
+	ReasonDependency = "dependency"
 )
 
 type DatabaseOptions struct {
 	// Add any additional options here
 }
 
-func MarkAsInstalled(pkg packet.PacketLua, files []packet.InstallInstruction, flags []packet.Flag, db *sql.DB, image []byte, upload_time int64) error {
+const (
+	insertInstalledPackageQuery = "INSERT INTO installed_packages (name, id, version, installed_time, image, serial, maintainer, description, upload_time, location, install_reason) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	insertDependencyQuery       = "INSERT OR REPLACE INTO dependencies (package_id, dependency_name, version_constraint) VALUES (?, ?, ?)"
+	insertBuildDependencyQuery  = "INSERT OR REPLACE INTO build_dependencies (package_id, dependency_name, version_constraint) VALUES (?, ?, ?)"
+	insertPackageFileQuery      = "INSERT OR IGNORE INTO package_files (package_id, filepath, is_dir, sha256, mode, uid, gid, size, link_target) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	insertPackageFlagQuery      = "INSERT INTO package_flags (package_id, flag, name, path) VALUES (?, ?, ?, ?)"
+)
+
+// MarkAsInstalled records a package with its dependencies, files and flags, nothing is written if any insert fails
+func MarkAsInstalled(pkg packet.PacketLua, files []install.BasicFileStatus, flags []packet.Flag, db *sql.DB, image []byte, upload_time int64, location, reason string) error {
 
 	switch {
 	case upload_time == 0:
@@ -104,53 +37,104 @@ func MarkAsInstalled(pkg packet.PacketLua, files []packet.InstallInstruction, fl
 		image = []byte{1}
 	}
 
-	_, err := db.Exec("INSERT INTO installed_packages (name, id, version, installed_time, image, serial, maintainer, description, upload_time) VALUES (?, ?, ?, ?, ?, ?,?,?,?)", pkg.Name, pkg.Name+"@"+pkg.Version, pkg.Version, time.Now().Unix(), image, pkg.Serial, pkg.Maintainer, pkg.Description, time.Now().Unix())
-	if err != nil {
-		db.Exec("DELETE FROM installed_packages WHERE id = ?", pkg.Name+"@"+pkg.Version)
-		return err
-	}
+	id := pkg.Name + "@" + pkg.Version
 
-	for _, v := range files {
-		_, err = db.Exec("INSERT INTO package_files (package_id, path, is_dir) VALUES (?, ?, ?)", pkg.Name+"@"+pkg.Version, v.Destination, v.IsDir)
-		if err != nil {
-			db.Exec("DELETE FROM installed_packages WHERE id = ?", pkg.Name+"@"+pkg.Version)
-			db.Exec("DELETE FROM package_files WHERE package_id = ?", pkg.Name+"@"+pkg.Version)
+	return Transaction(db, func(tx *sql.Tx) error {
+		if _, err := TxExec(tx, db, insertInstalledPackageQuery, pkg.Name, id, pkg.Version, time.Now().Unix(), image, pkg.Serial, pkg.Maintainer, pkg.Description, time.Now().Unix(), location, reason); err != nil {
 			return err
 		}
-	}
 
-	for _, v := range flags {
-		_, err = db.Exec("INSERT INTO package_flags (package_id, flag, name, path) VALUES (?, ?, ?, ?)", pkg.Name+"@"+pkg.Version, v.FlagType, v.Name, v.Path)
-		if err != nil {
-			db.Exec("DELETE FROM installed_packages WHERE id = ?", pkg.Name+"@"+pkg.Version)
-			db.Exec("DELETE FROM package_files WHERE package_id = ?", pkg.Name+"@"+pkg.Version)
-			db.Exec("DELETE FROM package_flags WHERE package_id = ?", pkg.Name+"@"+pkg.Version)
+		for name, constraint := range pkg.RuntimeDependencies() {
+			if _, err := TxExec(tx, db, insertDependencyQuery, id, name, string(constraint)); err != nil {
+				return err
+			}
+		}
 
-			return err
+		for name, constraint := range pkg.BuildDependencies() {
+			if _, err := TxExec(tx, db, insertBuildDependencyQuery, id, name, string(constraint)); err != nil {
+				return err
+			}
+		}
+
+		for _, v := range files {
+			if _, err := TxExec(tx, db, insertPackageFileQuery, id, v.Filepath, v.IsDir, v.SHA256, uint32(v.PermMode), v.UID, v.GID, v.Size, v.LinkTarget); err != nil {
+				return err
+			}
+		}
+
+		for _, v := range flags {
+			if _, err := TxExec(tx, db, insertPackageFlagQuery, id, v.FlagType, v.Name, v.Path); err != nil {
+				return err
+			}
 		}
-	}
 
-	return nil
+		return nil
+	})
 }
 
+// MarkAsUninstalled forgets everything recorded about a package in a single transaction
 func MarkAsUninstalled(id packet.PackageID, db *sql.DB) error {
-	if _, err := db.Exec("DELETE FROM installed_packages WHERE id = ?", string(id)); err != nil {
-		return err
-	}
+	return Transaction(db, func(tx *sql.Tx) error {
+		for _, query := range []string{
+			"DELETE FROM installed_packages WHERE id = ?",
+			"DELETE FROM package_files WHERE package_id = ?",
+			"DELETE FROM package_flags WHERE package_id = ?",
+			"DELETE FROM build_dependencies WHERE package_id = ?",
+			"DELETE FROM dependencies WHERE package_id = ?",
+		} {
+			if _, err := TxExec(tx, db, query, string(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	if _, err := db.Exec("DELETE FROM package_files WHERE package_id = ?", string(id)); err != nil {
-		return err
-	}
+// SetInstallReason changes why a package is installed, e.g. when a dependency is later installed explicitly
+func SetInstallReason(name, reason string, db *sql.DB) error {
+	_, err := db.Exec("UPDATE installed_packages SET install_reason = ? WHERE name = ? OR id = ?", reason, name, name)
+	return err
+}
 
-	if _, err := db.Exec("DELETE FROM package_flags WHERE package_id = ?", string(id)); err != nil {
+// MarkAsBuildPackage records a package installed into its own prefix, replacing any other version of it
+func MarkAsBuildPackage(pkg packet.PacketLua, location, prefix string, db *sql.DB) error {
+	return Transaction(db, func(tx *sql.Tx) error {
+		if _, err := TxExec(tx, db, "DELETE FROM build_packages WHERE name = ?", pkg.Name); err != nil {
+			return err
+		}
+
+		_, err := TxExec(tx, db, "INSERT INTO build_packages (name, id, version, serial, maintainer, description, upload_time, installed_time, location, filepath) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", pkg.Name, pkg.Name+"@"+pkg.Version, pkg.Version, pkg.Serial, pkg.Maintainer, pkg.Description, time.Now().Unix(), time.Now().Unix(), location, prefix)
 		return err
-	}
-	return nil
+	})
 }
 
-func PrepareDataBase(db *sql.DB) {
-	_, err := db.Exec(CreateInstructions)
+func MarkAsBuildPackageRemoved(id packet.PackageID, db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM build_packages WHERE id = ?", string(id))
+	return err
+}
+
+// OpenInternal returns the shared handle of internal.db, migrated to the latest schema version
+func OpenInternal(path string) (*sql.DB, error) {
+	return Open(path, InternalMigrations)
+}
+
+// OpenSource returns the shared handle of source.db, its tables are created on the first sync
+func OpenSource(path string) (*sql.DB, error) {
+	return Open(path, SourceMigrations)
+}
+
+// OpenEmptyInternal returns a private in-memory internal.db with nothing installed, the caller closes it
+func OpenEmptyInternal() (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file::memory:")
 	if err != nil {
-		fmt.Println("Error preparing database:", err)
+		return nil, err
+	}
+	// every connection to :memory: is a different database
+	db.SetMaxOpenConns(1)
+
+	if err := Migrate(db, InternalMigrations); err != nil {
+		db.Close()
+		return nil, err
 	}
+	return db, nil
 }
@@ -0,0 +1,237 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/roboogg133/packets/pkg/install"
+	"github.com/roboogg133/packets/pkg/packet.lua.d"
+)
+
+// Generation is the set of installed packages right after a history entry
+type Generation struct {
+	Id        int64
+	TimeUnix  int64
+	HistoryId int64
+	Packages  []GenerationPackage
+}
+
+type GenerationPackage struct {
+	Id       packet.PackageID
+	Location string
+	Reason   string
+}
+
+// PackageSnapshot is everything recorded about an installed package, enough to register it again
+type PackageSnapshot struct {
+	Package           DBPkg
+	Files             []install.BasicFileStatus
+	Dependencies      map[string]string
+	BuildDependencies map[string]string
+	Flags             []packet.Flag
+}
+
+// SnapshotGeneration stores the current installed packages as the generation of a history entry,
+// replacing the one stored earlier for the same entry
+func SnapshotGeneration(historyId int64, db *sql.DB) (int64, error) {
+	var generationId int64
+	err := Transaction(db, func(tx *sql.Tx) error {
+		err := tx.QueryRow("SELECT id FROM generations WHERE history_id = ?", historyId).Scan(&generationId)
+		if err == sql.ErrNoRows {
+			result, err := tx.Exec("INSERT INTO generations (time, history_id) VALUES (?, ?)", time.Now().Unix(), historyId)
+			if err != nil {
+				return err
+			}
+			generationId, err = result.LastInsertId()
+			if err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else if _, err := tx.Exec("UPDATE generations SET time = ? WHERE id = ?", time.Now().Unix(), generationId); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM generation_packages WHERE generation_id = ?", generationId); err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO generation_packages (generation_id, package_id, location, install_reason) SELECT ?, id, location, install_reason FROM installed_packages", generationId)
+		return err
+	})
+	return generationId, err
+}
+
+// ListGenerations returns every generation without its packages, the newest first
+func ListGenerations(db *sql.DB) ([]Generation, error) {
+	rows, err := db.Query("SELECT id, time, COALESCE(history_id, 0) FROM generations ORDER BY id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var generations []Generation
+	for rows.Next() {
+		var generation Generation
+		if err := rows.Scan(&generation.Id, &generation.TimeUnix, &generation.HistoryId); err != nil {
+			return nil, err
+		}
+		generations = append(generations, generation)
+	}
+	return generations, rows.Err()
+}
+
+func GetGeneration(id int64, db *sql.DB) (Generation, error) {
+	generation := Generation{Id: id}
+	if err := db.QueryRow("SELECT time, COALESCE(history_id, 0) FROM generations WHERE id = ?", id).Scan(&generation.TimeUnix, &generation.HistoryId); err != nil {
+		return generation, err
+	}
+
+	rows, err := db.Query("SELECT package_id, location, install_reason FROM generation_packages WHERE generation_id = ? ORDER BY package_id", id)
+	if err != nil {
+		return generation, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pkg GenerationPackage
+		var packageId string
+		if err := rows.Scan(&packageId, &pkg.Location, &pkg.Reason); err != nil {
+			return generation, err
+		}
+		pkg.Id = packet.NewId(packageId)
+		generation.Packages = append(generation.Packages, pkg)
+	}
+	return generation, rows.Err()
+}
+
+// DeleteGenerations forgets the given generations
+func DeleteGenerations(ids []int64, db *sql.DB) error {
+	return Transaction(db, func(tx *sql.Tx) error {
+		for _, id := range ids {
+			if _, err := TxExec(tx, db, "DELETE FROM generation_packages WHERE generation_id = ?", id); err != nil {
+				return err
+			}
+			if _, err := TxExec(tx, db, "DELETE FROM generations WHERE id = ?", id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListGenerationPackageIds returns every package id that is part of at least one generation
+func ListGenerationPackageIds(db *sql.DB) ([]packet.PackageID, error) {
+	rows, err := db.Query("SELECT DISTINCT package_id FROM generation_packages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []packet.PackageID
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, packet.NewId(id))
+	}
+	return ids, rows.Err()
+}
+
+// SnapshotPackage reads every row recorded for an installed package
+func SnapshotPackage(id packet.PackageID, db *sql.DB) (PackageSnapshot, error) {
+	var snapshot PackageSnapshot
+	var err error
+
+	if snapshot.Package, err = GetInstalledPackage(string(id), db); err != nil {
+		return snapshot, err
+	}
+	if snapshot.Files, err = GetPackageFiles(id, db); err != nil {
+		return snapshot, err
+	}
+	if snapshot.Dependencies, err = queryConstraints("SELECT dependency_name, version_constraint FROM dependencies WHERE package_id = ?", id, db); err != nil {
+		return snapshot, err
+	}
+	if snapshot.BuildDependencies, err = queryConstraints("SELECT dependency_name, version_constraint FROM build_dependencies WHERE package_id = ?", id, db); err != nil {
+		return snapshot, err
+	}
+
+	rows, err := db.Query("SELECT flag, name, path FROM package_flags WHERE package_id = ?", string(id))
+	if err != nil {
+		return snapshot, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var flag packet.Flag
+		if err := rows.Scan(&flag.FlagType, &flag.Name, &flag.Path); err != nil {
+			return snapshot, err
+		}
+		snapshot.Flags = append(snapshot.Flags, flag)
+	}
+	return snapshot, rows.Err()
+}
+
+func queryConstraints(query string, id packet.PackageID, db *sql.DB) (map[string]string, error) {
+	rows, err := db.Query(query, string(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	constraints := make(map[string]string)
+	for rows.Next() {
+		var name, constraint string
+		if err := rows.Scan(&name, &constraint); err != nil {
+			return nil, err
+		}
+		constraints[name] = constraint
+	}
+	return constraints, rows.Err()
+}
+
+// SwitchPackages unregisters remove and registers restore in a single transaction
+func SwitchPackages(remove []packet.PackageID, restore []PackageSnapshot, db *sql.DB) error {
+	return Transaction(db, func(tx *sql.Tx) error {
+		for _, id := range remove {
+			for _, query := range []string{
+				"DELETE FROM installed_packages WHERE id = ?",
+				"DELETE FROM package_files WHERE package_id = ?",
+				"DELETE FROM package_flags WHERE package_id = ?",
+				"DELETE FROM build_dependencies WHERE package_id = ?",
+				"DELETE FROM dependencies WHERE package_id = ?",
+			} {
+				if _, err := TxExec(tx, db, query, string(id)); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, snapshot := range restore {
+			pkg := snapshot.Package
+			if _, err := TxExec(tx, db, "INSERT INTO installed_packages (name, id, version, serial, maintainer, verified, description, upload_time, installed_time, location, install_reason) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", pkg.Name, pkg.Id, pkg.Version, pkg.Serial, pkg.Maintainer, pkg.Verified, pkg.Description, pkg.UploadTimeUnix, time.Now().Unix(), pkg.Location, pkg.InstallReason); err != nil {
+				return err
+			}
+			for name, constraint := range snapshot.Dependencies {
+				if _, err := TxExec(tx, db, insertDependencyQuery, pkg.Id, name, constraint); err != nil {
+					return err
+				}
+			}
+			for name, constraint := range snapshot.BuildDependencies {
+				if _, err := TxExec(tx, db, insertBuildDependencyQuery, pkg.Id, name, constraint); err != nil {
+					return err
+				}
+			}
+			for _, v := range snapshot.Files {
+				if _, err := TxExec(tx, db, insertPackageFileQuery, pkg.Id, v.Filepath, v.IsDir, v.SHA256, uint32(v.PermMode), v.UID, v.GID, v.Size, v.LinkTarget); err != nil {
+					return err
+				}
+			}
+			for _, v := range snapshot.Flags {
+				if _, err := TxExec(tx, db, insertPackageFlagQuery, pkg.Id, v.FlagType, v.Name, v.Path); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
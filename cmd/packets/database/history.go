@@ -0,0 +1,124 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// HistoryChange is a single package that changed in a history entry, Before is empty for an install and
+// After is empty for a removal
+type HistoryChange struct {
+	Name     string
+	Before   string
+	After    string
+	Location string
+	Reason   string
+}
+
+const (
+	ChangeInstall = "install"
+	ChangeRemove  = "remove"
+	ChangeUpgrade = "upgrade"
+)
+
+func (c HistoryChange) Action() string {
+	switch {
+	case c.Before == "":
+		return ChangeInstall
+	case c.After == "":
+		return ChangeRemove
+	}
+	return ChangeUpgrade
+}
+
+// HistoryEntry is everything a single packets command changed
+type HistoryEntry struct {
+	Id       int64
+	TimeUnix int64
+	User     string
+	Command  string
+	Changes  []HistoryChange
+}
+
+// StartHistoryEntry creates an empty entry that changes are recorded into
+func StartHistoryEntry(user, command string, db *sql.DB) (int64, error) {
+	result, err := db.Exec("INSERT INTO history (time, user, command) VALUES (?, ?, ?)", time.Now().Unix(), user, command)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func RecordHistoryChange(entryId int64, change HistoryChange, db *sql.DB) error {
+	stmt, err := prepare(db, "INSERT INTO history_packages (history_id, name, before_id, after_id, location, install_reason) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(entryId, change.Name, nullIfEmpty(change.Before), nullIfEmpty(change.After), change.Location, change.Reason)
+	return err
+}
+
+// ListHistory returns every entry with at least one change, the newest first
+func ListHistory(db *sql.DB) ([]HistoryEntry, error) {
+	rows, err := db.Query("SELECT id, time, user, command FROM history WHERE id IN (SELECT history_id FROM history_packages) ORDER BY id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []HistoryEntry
+	for rows.Next() {
+		var entry HistoryEntry
+		if err := rows.Scan(&entry.Id, &entry.TimeUnix, &entry.User, &entry.Command); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range entries {
+		if entries[i].Changes, err = getHistoryChanges(entries[i].Id, db); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func GetHistoryEntry(id int64, db *sql.DB) (HistoryEntry, error) {
+	entry := HistoryEntry{Id: id}
+	if err := db.QueryRow("SELECT time, user, command FROM history WHERE id = ?", id).Scan(&entry.TimeUnix, &entry.User, &entry.Command); err != nil {
+		return entry, err
+	}
+
+	changes, err := getHistoryChanges(id, db)
+	entry.Changes = changes
+	return entry, err
+}
+
+func getHistoryChanges(id int64, db *sql.DB) ([]HistoryChange, error) {
+	rows, err := db.Query("SELECT name, COALESCE(before_id, ''), COALESCE(after_id, ''), location, install_reason FROM history_packages WHERE history_id = ? ORDER BY rowid", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []HistoryChange
+	for rows.Next() {
+		var change HistoryChange
+		if err := rows.Scan(&change.Name, &change.Before, &change.After, &change.Location, &change.Reason); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,315 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Migration moves a database schema one version forward, either SQL or Func is set.
+// Applied migrations are tracked with PRAGMA user_version, so they must never be edited or reordered
+type Migration struct {
+	Version     int
+	Description string
+	SQL         string
+	Func        func(tx *sql.Tx) error
+}
+
+var InternalMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "initial schema",
+		SQL: `CREATE TABLE IF NOT EXISTS installed_packages(
+    name TEXT NOT NULL UNIQUE,
+    id TEXT PRIMARY KEY,
+    version TEXT NOT NULL,
+    serial INTEGER NOT NULL,
+    maintainer TEXT NOT NULL,
+    verified INTEGER NOT NULL DEFAULT 0,
+    description TEXT NOT NULL,
+    upload_time INTEGER NOT NULL,
+    installed_time INTEGER NOT NULL,
+
+    location TEXT NOT NULL,
+
+    image BLOB,
+
+    UNIQUE(name, version),
+    UNIQUE(name, serial)
+);
+
+CREATE TABLE IF NOT EXISTS package_files(
+    package_id TEXT PRIMARY KEY,
+    filepath TEXT NOT NULL,
+    is_dir INTEGER NOT NULL DEFAULT 0,
+
+    UNIQUE(package_id, filepath)
+);
+
+CREATE TABLE IF NOT EXISTS dependencies(
+    package_id TEXT NOT NULL,
+    dependency_name TEXT NOT NULL,
+    version_constraint TEXT NOT NULL,
+
+    PRIMARY KEY (package_id, dependency_name)
+);
+
+CREATE TABLE IF NOT EXISTS build_dependencies(
+    package_id TEXT NOT NULL,
+    dependency_name TEXT NOT NULL,
+    version_constraint TEXT NOT NULL,
+
+    PRIMARY KEY (package_id, dependency_name)
+);
+
+CREATE TABLE IF NOT EXISTS conflicts(
+    package_id TEXT NOT NULL,
+    dependency_name TEXT NOT NULL,
+    version_constraint TEXT NOT NULL,
+
+    PRIMARY KEY (package_id, dependency_name)
+);
+
+CREATE TABLE IF NOT EXISTS package_flags(
+    package_id TEXT NOT NULL,
+    flag TEXT NOT NULL,
+    name TEXT NOT NULL,
+    path TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS build_packages(
+    name TEXT NOT NULL,
+    id TEXT PRIMARY KEY,
+    version TEXT NOT NULL,
+    serial INTEGER NOT NULL,
+    maintainer TEXT NOT NULL,
+    verified INTEGER NOT NULL DEFAULT 0,
+    description TEXT NOT NULL,
+    upload_time INTEGER NOT NULL,
+    installed_time INTEGER NOT NULL,
+
+    location TEXT NOT NULL,
+
+    filepath TEXT NOT NULL,
+
+    UNIQUE(name, version),
+    UNIQUE(name, serial)
+);`,
+	},
+	{
+		Version:     2,
+		Description: "record why a package was installed",
+		Func: func(tx *sql.Tx) error {
+			return addColumnIfMissing(tx, "installed_packages", "install_reason", "TEXT NOT NULL DEFAULT 'explicit'")
+		},
+	},
+	{
+		Version:     3,
+		Description: "key package_files by package and path and record file integrity data",
+		Func: func(tx *sql.Tx) error {
+			if recorded, err := columnExists(tx, "package_files", "sha256"); err != nil {
+				return err
+			} else if recorded {
+				_, err := tx.Exec("CREATE INDEX IF NOT EXISTS package_files_filepath ON package_files(filepath)")
+				return err
+			}
+
+			// package_id used to be the whole primary key, so a package could only ever own a single file
+			statements := []string{
+				`CREATE TABLE package_files_new(
+    package_id TEXT NOT NULL,
+    filepath TEXT NOT NULL,
+    is_dir INTEGER NOT NULL DEFAULT 0,
+
+    sha256 TEXT,
+    mode INTEGER,
+    uid INTEGER,
+    gid INTEGER,
+    size INTEGER,
+    link_target TEXT,
+
+    PRIMARY KEY (package_id, filepath)
+)`,
+				"INSERT OR IGNORE INTO package_files_new (package_id, filepath, is_dir) SELECT package_id, filepath, is_dir FROM package_files",
+				"DROP TABLE package_files",
+				"ALTER TABLE package_files_new RENAME TO package_files",
+				"CREATE INDEX IF NOT EXISTS package_files_filepath ON package_files(filepath)",
+			}
+			for _, statement := range statements {
+				if _, err := tx.Exec(statement); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "record install and remove transactions",
+		SQL: `CREATE TABLE IF NOT EXISTS history(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    time INTEGER NOT NULL,
+    user TEXT NOT NULL,
+    command TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS history_packages(
+    history_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    before_id TEXT,
+    after_id TEXT,
+    location TEXT NOT NULL,
+    install_reason TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS history_packages_history_id ON history_packages(history_id);`,
+	},
+	{
+		Version:     5,
+		Description: "snapshot the installed packages as generations",
+		// the first generation is what was installed before generations existed, so there is always one to go back to
+		SQL: `CREATE TABLE IF NOT EXISTS generations(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    time INTEGER NOT NULL,
+    history_id INTEGER UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS generation_packages(
+    generation_id INTEGER NOT NULL,
+    package_id TEXT NOT NULL,
+    location TEXT NOT NULL,
+    install_reason TEXT NOT NULL,
+
+    PRIMARY KEY (generation_id, package_id)
+);
+
+INSERT INTO generations (time, history_id) VALUES (strftime('%s', 'now'), NULL);
+INSERT INTO generation_packages (generation_id, package_id, location, install_reason) SELECT (SELECT MAX(id) FROM generations), id, location, install_reason FROM installed_packages;`,
+	},
+}
+
+var SourceMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "initial schema",
+		SQL: `CREATE TABLE IF NOT EXISTS packages(
+    name TEXT NOT NULL,
+    id TEXT NOT NULL,
+    version TEXT NOT NULL,
+    serial INTEGER NOT NULL,
+    maintainer TEXT NOT NULL,
+    verified INTEGER NOT NULL DEFAULT 0,
+    description TEXT NOT NULL,
+    upload_time INTEGER NOT NULL,
+
+    location TEXT NOT NULL,
+    available_compiled INTEGER NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (location, id),
+    UNIQUE(name, version, location),
+    UNIQUE(name, serial, location)
+);
+
+CREATE TABLE IF NOT EXISTS dependencies(
+    package_id TEXT NOT NULL,
+    dependency_name TEXT NOT NULL,
+    version_constraint TEXT NOT NULL,
+    location TEXT NOT NULL,
+
+    PRIMARY KEY (package_id, dependency_name, location)
+);
+
+CREATE TABLE IF NOT EXISTS build_dependencies(
+    package_id TEXT NOT NULL,
+    dependency_name TEXT NOT NULL,
+    version_constraint TEXT NOT NULL,
+    location TEXT NOT NULL,
+
+    PRIMARY KEY (package_id, dependency_name, location)
+);
+
+CREATE TABLE IF NOT EXISTS conflicts(
+    package_id TEXT NOT NULL,
+    dependency_name TEXT NOT NULL,
+    version_constraint TEXT NOT NULL,
+    location TEXT NOT NULL,
+
+    PRIMARY KEY (package_id, dependency_name, location)
+);`,
+	},
+}
+
+// SchemaVersion returns the PRAGMA user_version of db
+func SchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// Migrate applies in order every migration newer than the database schema version, each one inside its own transaction
+func Migrate(db *sql.DB, migrations []Migration) error {
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	latest := 0
+	for _, migration := range migrations {
+		latest = max(latest, migration.Version)
+	}
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this packets supports (%d)", current, latest)
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+		if err := applyMigration(db, migration); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+		current = migration.Version
+	}
+
+	return nil
+}
+
+func applyMigration(db *sql.DB, migration Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if migration.SQL != "" {
+		if _, err := tx.Exec(migration.SQL); err != nil {
+			return err
+		}
+	}
+	if migration.Func != nil {
+		if err := migration.Func(tx); err != nil {
+			return err
+		}
+	}
+
+	// user_version is part of the database header, so it commits or rolls back with the migration
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", migration.Version)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func columnExists(tx *sql.Tx, table, column string) (bool, error) {
+	var exists bool
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", table, column).Scan(&exists)
+	return exists, err
+}
+
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	exists, err := columnExists(tx, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
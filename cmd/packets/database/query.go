@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"os"
 	"strings"
 
 	"github.com/roboogg133/packets/pkg/install"
@@ -13,7 +14,7 @@ func GetPackageId(name string, db *sql.DB) (packet.PackageID, error) {
 	var id packet.PackageID
 
 	if strings.Contains(name, "@") {
-		id = packet.PackageID(strings.SplitAfter(name, "@")[0])
+		id = packet.PackageID(name)
 		return id, nil
 	}
 
@@ -28,6 +29,13 @@ func SearchIfIsInstalled(name string, db *sql.DB) (bool, error) {
 	return exists, err
 }
 
+// SearchIfIsBuildPackage reports if id is installed into its own prefix as a build dependency
+func SearchIfIsBuildPackage(id string, db *sql.DB) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM build_packages WHERE id = ?)", id).Scan(&exists)
+	return exists, err
+}
+
 func CheckVersionInBuild(name string, db *sql.DB) (packet.PackageID, int, string, error) {
 	var id, location string
 	var serial int
@@ -73,7 +81,8 @@ func GetAllFromFlag(packageID packet.PackageID, flagType string, db *sql.DB) ([]
 
 func GetPackageFiles(packageID packet.PackageID, db *sql.DB) ([]install.BasicFileStatus, error) {
 	var files []install.BasicFileStatus
-	rows, err := db.Query("SELECT path, is_dir FROM package_files WHERE package_id = ?", string(packageID))
+	// rows written before integrity data was recorded come back with the zero values Verify skips
+	rows, err := db.Query("SELECT filepath, is_dir, COALESCE(sha256, ''), COALESCE(mode, 0), COALESCE(uid, ?), COALESCE(gid, ?), COALESCE(size, 0), COALESCE(link_target, '') FROM package_files WHERE package_id = ?", install.UnknownOwner, install.UnknownOwner, string(packageID))
 	if err != nil {
 		return nil, err
 	}
@@ -81,9 +90,11 @@ func GetPackageFiles(packageID packet.PackageID, db *sql.DB) ([]install.BasicFil
 
 	for rows.Next() {
 		var file install.BasicFileStatus
-		if err := rows.Scan(&file.Filepath, &file.IsDir); err != nil {
+		var mode uint32
+		if err := rows.Scan(&file.Filepath, &file.IsDir, &file.SHA256, &mode, &file.UID, &file.GID, &file.Size, &file.LinkTarget); err != nil {
 			return nil, err
 		}
+		file.PermMode = os.FileMode(mode)
 		files = append(files, file)
 	}
 	if err := rows.Err(); err != nil {
@@ -119,11 +130,31 @@ type DBPkg struct {
 	UploadTimeUnix    int64  `db:"upload_time"`
 	InstalledTimeUnix int64  `db:"installed_time"`
 
-	Location string `db:"location"`
+	Location      string `db:"location"`
+	InstallReason string `db:"install_reason"`
+}
+
+// GetInstalledPackage returns the installed package with the given name or id
+func GetInstalledPackage(nameOrId string, db *sql.DB) (DBPkg, error) {
+	var obj DBPkg
+	err := db.QueryRow("SELECT name, id, version, serial, maintainer, verified, description, upload_time, installed_time, location, install_reason FROM installed_packages WHERE name = ? OR id = ?", nameOrId, nameOrId).Scan(
+		&obj.Name,
+		&obj.Id,
+		&obj.Version,
+		&obj.Serial,
+		&obj.Maintainer,
+		&obj.Verified,
+		&obj.Description,
+		&obj.UploadTimeUnix,
+		&obj.InstalledTimeUnix,
+		&obj.Location,
+		&obj.InstallReason,
+	)
+	return obj, err
 }
 
 func ListAllInstalledPackages(db *sql.DB) ([]DBPkg, error) {
-	rows, err := db.Query("SELECT name, id, version, serial, maintainer, verified, description, upload_time, installed_time FROM installed_packages")
+	rows, err := db.Query("SELECT name, id, version, serial, maintainer, verified, description, upload_time, installed_time, location, install_reason FROM installed_packages")
 	if err != nil {
 		return nil, err
 	}
@@ -142,6 +173,8 @@ func ListAllInstalledPackages(db *sql.DB) ([]DBPkg, error) {
 			&obj.Description,
 			&obj.UploadTimeUnix,
 			&obj.InstalledTimeUnix,
+			&obj.Location,
+			&obj.InstallReason,
 		); err != nil {
 			return nil, err
 		}
@@ -150,3 +183,189 @@ func ListAllInstalledPackages(db *sql.DB) ([]DBPkg, error) {
 
 	return list, nil
 }
+
+type BuildPkg struct {
+	Name              string `db:"name"`
+	Id                string `db:"id"`
+	Serial            int    `db:"serial"`
+	InstalledTimeUnix int64  `db:"installed_time"`
+	Location          string `db:"location"`
+	Filepath          string `db:"filepath"`
+}
+
+// GetBuildPackagePrefix returns the directory a build package was installed into
+func GetBuildPackagePrefix(name string, db *sql.DB) (string, error) {
+	var prefix string
+	err := db.QueryRow("SELECT filepath FROM build_packages WHERE name = ?", name).Scan(&prefix)
+	return prefix, err
+}
+
+func ListBuildPackages(db *sql.DB) ([]BuildPkg, error) {
+	return queryBuildPackages("SELECT name, id, serial, installed_time, location, filepath FROM build_packages", db)
+}
+
+// ListUnneededBuildPackages returns build packages that no installed package lists as a build dependency
+func ListUnneededBuildPackages(db *sql.DB) ([]BuildPkg, error) {
+	return queryBuildPackages("SELECT name, id, serial, installed_time, location, filepath FROM build_packages WHERE name NOT IN (SELECT dependency_name FROM build_dependencies)", db)
+}
+
+func queryBuildPackages(query string, db *sql.DB) ([]BuildPkg, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []BuildPkg
+	for rows.Next() {
+		var obj BuildPkg
+		if err := rows.Scan(&obj.Name, &obj.Id, &obj.Serial, &obj.InstalledTimeUnix, &obj.Location, &obj.Filepath); err != nil {
+			return nil, err
+		}
+		list = append(list, obj)
+	}
+
+	return list, rows.Err()
+}
+
+// GetDependents returns the installed packages that have name as a runtime dependency
+func GetDependents(name string, db *sql.DB) ([]packet.PackageID, error) {
+	rows, err := db.Query("SELECT d.package_id FROM dependencies d JOIN installed_packages p ON p.id = d.package_id WHERE d.dependency_name = ?", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dependents []packet.PackageID
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		dependents = append(dependents, packet.NewId(id))
+	}
+
+	return dependents, rows.Err()
+}
+
+// ListOrphans returns packages installed as a dependency that no installed package depends on anymore
+func ListOrphans(db *sql.DB) ([]packet.PackageID, error) {
+	rows, err := db.Query("SELECT id FROM installed_packages WHERE install_reason = ? AND name NOT IN (SELECT d.dependency_name FROM dependencies d JOIN installed_packages p ON p.id = d.package_id)", ReasonDependency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orphans []packet.PackageID
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, packet.NewId(id))
+	}
+
+	return orphans, rows.Err()
+}
+
+// ListUnneeded returns every package autoremove would remove: the orphans, then the packages left orphaned once
+// those are gone, until none is left, in the order they can be removed
+func ListUnneeded(db *sql.DB) ([]packet.PackageID, error) {
+	type installed struct {
+		id, name   string
+		dependency bool
+	}
+	var packages []installed
+
+	rows, err := db.Query("SELECT id, name, install_reason FROM installed_packages")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var pkg installed
+		var reason string
+		if err := rows.Scan(&pkg.id, &pkg.name, &reason); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		pkg.dependency = reason == ReasonDependency
+		packages = append(packages, pkg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	needs := make(map[string][]string)
+	rows, err = db.Query("SELECT package_id, dependency_name FROM dependencies")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		needs[id] = append(needs[id], name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	removed := make(map[string]bool)
+	var unneeded []packet.PackageID
+	for {
+		needed := make(map[string]bool)
+		for _, pkg := range packages {
+			if !removed[pkg.id] {
+				for _, name := range needs[pkg.id] {
+					needed[name] = true
+				}
+			}
+		}
+
+		var round []string
+		for _, pkg := range packages {
+			if pkg.dependency && !removed[pkg.id] && !needed[pkg.name] {
+				round = append(round, pkg.id)
+			}
+		}
+		if len(round) == 0 {
+			return unneeded, nil
+		}
+		for _, id := range round {
+			removed[id] = true
+			unneeded = append(unneeded, packet.NewId(id))
+		}
+	}
+}
+
+// CountOtherOwners returns how many packages besides exclude have path in their files, it is the reference count of shared directories
+func CountOtherOwners(path string, exclude packet.PackageID, db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(DISTINCT package_id) FROM package_files WHERE filepath = ? AND package_id != ?", path, string(exclude)).Scan(&count)
+	return count, err
+}
+
+// ListOwnersInside returns the packages besides exclude that have files inside dir
+func ListOwnersInside(dir string, exclude packet.PackageID, db *sql.DB) ([]packet.PackageID, error) {
+	// compared as blobs, substr of a text counts characters and len counts bytes
+	prefix := dir + "/"
+	rows, err := db.Query("SELECT DISTINCT package_id FROM package_files WHERE substr(CAST(filepath AS BLOB), 1, ?) = CAST(? AS BLOB) AND package_id != ?", len(prefix), prefix, string(exclude))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var owners []packet.PackageID
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		owners = append(owners, packet.NewId(id))
+	}
+
+	return owners, rows.Err()
+}
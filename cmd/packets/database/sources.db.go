@@ -52,3 +52,33 @@ func RetrievePackageInformation(nameOrId, favoriteLocation string, db *sql.DB) (
 
 	return obj, nil
 }
+
+// FindPackageInSources returns the package with exactly id in every synced repository that has it
+func FindPackageInSources(id string, db *sql.DB) ([]SDBPkg, error) {
+	rows, err := db.Query("SELECT name, id, version, serial, maintainer, verified, description, upload_time, available_compiled, location FROM packages WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []SDBPkg
+	for rows.Next() {
+		var obj SDBPkg
+		if err := rows.Scan(
+			&obj.Name,
+			&obj.Id,
+			&obj.Version,
+			&obj.Serial,
+			&obj.Maintainer,
+			&obj.Verified,
+			&obj.Description,
+			&obj.UploadTimeUnix,
+			&obj.Compiled,
+			&obj.Location,
+		); err != nil {
+			return nil, err
+		}
+		list = append(list, obj)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// BusyTimeout is how long a connection waits on a database locked by another packets process before failing
+const BusyTimeout = 5 * time.Second
+
+// MaxIdleConnections keeps the connections opened while still privileged around for later queries,
+// opening a new one after the privileges were dropped could fail on the WAL files
+const MaxIdleConnections = 4
+
+var (
+	handlesMu sync.Mutex
+	handles   = make(map[string]*sql.DB)
+
+	statementsMu sync.Mutex
+	statements   = make(map[*sql.DB]map[string]*sql.Stmt)
+)
+
+func dataSourceName(path string) string {
+	params := url.Values{}
+	params.Set("_journal_mode", "WAL")
+	params.Set("_busy_timeout", fmt.Sprint(BusyTimeout.Milliseconds()))
+	// take the write lock when the transaction begins, so two writers wait on busy_timeout instead of deadlocking
+	params.Set("_txlock", "immediate")
+	return "file:" + path + "?" + params.Encode()
+}
+
+// Open returns the process wide handle of the database at path, the first call opens it and applies migrations
+func Open(path string, migrations []Migration) (*sql.DB, error) {
+	handlesMu.Lock()
+	defer handlesMu.Unlock()
+
+	if db, ok := handles[path]; ok {
+		return db, nil
+	}
+
+	db, err := sql.Open("sqlite3", dataSourceName(path))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxIdleConns(MaxIdleConnections)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := Migrate(db, migrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	handles[path] = db
+	return db, nil
+}
+
+// CloseAll closes every handle returned by Open and its prepared statements
+func CloseAll() error {
+	handlesMu.Lock()
+	defer handlesMu.Unlock()
+	statementsMu.Lock()
+	defer statementsMu.Unlock()
+
+	var firstErr error
+	for path, db := range handles {
+		for _, stmt := range statements[db] {
+			stmt.Close()
+		}
+		delete(statements, db)
+
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(handles, path)
+	}
+	return firstErr
+}
+
+// Transaction runs fn inside a transaction, committing when fn returns nil and rolling back otherwise
+func Transaction(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// prepare returns a prepared statement for query, each query is prepared only once per handle
+func prepare(db *sql.DB, query string) (*sql.Stmt, error) {
+	statementsMu.Lock()
+	defer statementsMu.Unlock()
+
+	cache, ok := statements[db]
+	if !ok {
+		cache = make(map[string]*sql.Stmt)
+		statements[db] = cache
+	}
+	if stmt, ok := cache[query]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	cache[query] = stmt
+	return stmt, nil
+}
+
+// TxExec runs query inside tx using the prepared statement of db
+func TxExec(tx *sql.Tx, db *sql.DB, query string, args ...any) (sql.Result, error) {
+	stmt, err := prepare(db, query)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Stmt(stmt).Exec(args...)
+}
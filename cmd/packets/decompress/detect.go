@@ -0,0 +1,160 @@
+package decompress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// format is a compression or archive format, recognized by its magic bytes or by the suffix of the file name
+type format struct {
+	name string
+	// suffixes maps a suffix to what replaces it once decompressed, .tgz becomes .tar
+	suffixes map[string]string
+	magic    func(header []byte) bool
+	// open is nil for archives, which are extracted from the whole file
+	open func(r *bufio.Reader) (io.Reader, error)
+}
+
+var zipFormat = &format{
+	name:     "zip",
+	suffixes: map[string]string{".zip": ""},
+	magic: func(header []byte) bool {
+		return bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06"))
+	},
+}
+
+// formats are sniffed in order, the ones with the weakest magic go last
+var formats = []*format{
+	{
+		name:     "gzip",
+		suffixes: map[string]string{".gz": "", ".tgz": ".tar"},
+		magic:    prefix(0x1f, 0x8b),
+		open: func(r *bufio.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		name:     "xz",
+		suffixes: map[string]string{".xz": "", ".txz": ".tar"},
+		magic:    prefix(0xfd, '7', 'z', 'X', 'Z', 0x00),
+		open: func(r *bufio.Reader) (io.Reader, error) {
+			return xz.NewReader(r)
+		},
+	},
+	{
+		name:     "zstd",
+		suffixes: map[string]string{".zst": "", ".tzst": ".tar"},
+		magic:    prefix(0x28, 0xb5, 0x2f, 0xfd),
+		open: func(r *bufio.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+	},
+	{
+		name:     "bzip2",
+		suffixes: map[string]string{".bz2": "", ".tbz2": ".tar", ".tbz": ".tar"},
+		magic: func(header []byte) bool {
+			// BZh and the block size, 1 to 9
+			return len(header) >= 4 && bytes.HasPrefix(header, []byte("BZh")) && header[3] >= '1' && header[3] <= '9'
+		},
+		open: func(r *bufio.Reader) (io.Reader, error) {
+			return bzip2.NewReader(r), nil
+		},
+	},
+	{
+		name:     "lz4",
+		suffixes: map[string]string{".lz4": ""},
+		magic:    prefix(0x04, 0x22, 0x4d, 0x18),
+		open: func(r *bufio.Reader) (io.Reader, error) {
+			return lz4.NewReader(r), nil
+		},
+	},
+	{
+		name:     "lzip",
+		suffixes: map[string]string{".lz": "", ".tlz": ".tar"},
+		magic:    prefix(lzipMagic...),
+		open: func(r *bufio.Reader) (io.Reader, error) {
+			return newLzipReader(r)
+		},
+	},
+	zipFormat,
+	{
+		name:     "lzma",
+		suffixes: map[string]string{".lzma": ""},
+		magic: func(header []byte) bool {
+			// the classic header has no magic, only the properties almost every encoder uses and the
+			// uncompressed size, unknown or plausible
+			if len(header) < lzma.HeaderLen || header[0] != 0x5d {
+				return false
+			}
+			size := binary.LittleEndian.Uint64(header[5:13])
+			return binary.LittleEndian.Uint32(header[1:5]) >= 1<<12 && (size == ^uint64(0) || size < 1<<40)
+		},
+		open: func(r *bufio.Reader) (io.Reader, error) {
+			return lzma.NewReader(r)
+		},
+	},
+	{
+		// brotli streams have no magic, they are only recognized by the name
+		name:     "brotli",
+		suffixes: map[string]string{".br": ""},
+		open: func(r *bufio.Reader) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		},
+	},
+}
+
+func prefix(magic ...byte) func([]byte) bool {
+	return func(header []byte) bool {
+		return bytes.HasPrefix(header, magic)
+	}
+}
+
+// tarBlockLen is the size of a tar header, the longest prefix detect looks at
+const tarBlockLen = 512
+
+// detect returns the format of r and the file name without its suffix, or nil when r is not compressed.
+// The content decides, the suffix only when no magic matches
+func detect(r *bufio.Reader, filename string) (*format, string) {
+	header, _ := r.Peek(tarBlockLen)
+
+	for _, f := range formats {
+		if f.magic != nil && f.magic(header) {
+			return f, trimSuffix(f, filename)
+		}
+	}
+	// a .tar.gz some server already decompressed
+	if isTar(header) {
+		return nil, filename
+	}
+	for _, f := range formats {
+		if name := trimSuffix(f, filename); name != filename {
+			return f, name
+		}
+	}
+	return nil, filename
+}
+
+func trimSuffix(f *format, filename string) string {
+	for suffix, replacement := range f.suffixes {
+		if name, ok := strings.CutSuffix(filename, suffix); ok {
+			return name + replacement
+		}
+	}
+	return filename
+}
+
+// isTar reports whether header, the first block of a file, is a tar header
+func isTar(header []byte) bool {
+	return len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar"))
+}
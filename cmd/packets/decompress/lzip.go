@@ -0,0 +1,144 @@
+package decompress
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+var lzipMagic = []byte("LZIP")
+
+const lzipTrailerLen = 20
+
+// lzipReader reads the members of an lzip file, each one is an LZMA stream with fixed properties between
+// a 6 bytes header and a trailer with the CRC32 and size of its data
+type lzipReader struct {
+	r      *bufio.Reader
+	member *lzma.Reader
+	crc    hash.Hash32
+	size   uint64
+	err    error
+}
+
+func newLzipReader(r *bufio.Reader) (*lzipReader, error) {
+	z := &lzipReader{r: r}
+	if err := z.nextMember(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// nextMember reads a member header and turns it into the classic LZMA header the decoder expects
+func (z *lzipReader) nextMember() error {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(z.r, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:4], lzipMagic) {
+		return errors.New("lzip: invalid header")
+	}
+	if header[4] != 1 {
+		return fmt.Errorf("lzip: unsupported version %d", header[4])
+	}
+
+	// the low 5 bits are the log2 of the base size, the high 3 bits how many sixteenths of it to subtract
+	exponent := uint(header[5] & 0x1f)
+	if exponent < 12 || exponent > 29 {
+		return errors.New("lzip: invalid dictionary size")
+	}
+	dictSize := uint32(1) << exponent
+	dictSize -= (dictSize >> 4) * uint32(header[5]>>5)
+
+	classic := make([]byte, lzma.HeaderLen)
+	// lc=3 lp=0 pb=2, the size is unknown and the stream ends with a marker
+	classic[0] = 0x5d
+	binary.LittleEndian.PutUint32(classic[1:5], dictSize)
+	binary.LittleEndian.PutUint64(classic[5:], ^uint64(0))
+
+	// the decoder must read byte by byte, a buffered one would swallow the trailer and the next member
+	member, err := lzma.NewReader(&headerReader{header: classic, r: z.r})
+	if err != nil {
+		return err
+	}
+	z.member, z.crc, z.size = member, crc32.NewIEEE(), 0
+	return nil
+}
+
+// headerReader serves header before r, keeping it an io.ByteReader
+type headerReader struct {
+	header []byte
+	r      *bufio.Reader
+}
+
+func (h *headerReader) Read(p []byte) (int, error) {
+	if len(h.header) > 0 {
+		n := copy(p, h.header)
+		h.header = h.header[n:]
+		return n, nil
+	}
+	return h.r.Read(p)
+}
+
+func (h *headerReader) ReadByte() (byte, error) {
+	if len(h.header) > 0 {
+		b := h.header[0]
+		h.header = h.header[1:]
+		return b, nil
+	}
+	return h.r.ReadByte()
+}
+
+// Read keeps returning the first error, io.EOF included, so a trailer is never read twice
+func (z *lzipReader) Read(p []byte) (n int, err error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	n, z.err = z.read(p)
+	return n, z.err
+}
+
+func (z *lzipReader) read(p []byte) (int, error) {
+	for {
+		n, err := z.member.Read(p)
+		z.crc.Write(p[:n])
+		z.size += uint64(n)
+		if err != io.EOF {
+			return n, err
+		}
+
+		if err := z.checkTrailer(); err != nil {
+			return n, err
+		}
+		// a file can be several members concatenated
+		if next, _ := z.r.Peek(len(lzipMagic)); !bytes.Equal(next, lzipMagic) {
+			return n, io.EOF
+		}
+		if err := z.nextMember(); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (z *lzipReader) checkTrailer() error {
+	trailer := make([]byte, lzipTrailerLen)
+	if _, err := io.ReadFull(z.r, trailer); err != nil {
+		return fmt.Errorf("lzip: reading trailer: %w", err)
+	}
+	if binary.LittleEndian.Uint32(trailer[0:4]) != z.crc.Sum32() {
+		return errors.New("lzip: CRC mismatch")
+	}
+	if binary.LittleEndian.Uint64(trailer[4:12]) != z.size {
+		return errors.New("lzip: size mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package decompress
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// lzipMember compresses data into an lzip member with a 64 KiB dictionary
+func lzipMember(t *testing.T, data []byte) []byte {
+	var compressed bytes.Buffer
+	cfg := lzma.WriterConfig{Properties: &lzma.Properties{LC: 3, LP: 0, PB: 2}, DictCap: 1 << 16, EOSMarker: true}
+	w, err := cfg.NewWriter(&compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lzip header replaces the classic one
+	member := append([]byte("LZIP\x01\x10"), compressed.Bytes()[lzma.HeaderLen:]...)
+	member = binary.LittleEndian.AppendUint32(member, crc32.ChecksumIEEE(data))
+	member = binary.LittleEndian.AppendUint64(member, uint64(len(data)))
+	return binary.LittleEndian.AppendUint64(member, uint64(len(member)+8))
+}
+
+func TestLzip(t *testing.T) {
+	text := []byte(strings.Repeat("packets reads lzip members\n", 500))
+	single := lzipMember(t, text)
+
+	badCRC := bytes.Clone(single)
+	badCRC[len(badCRC)-lzipTrailerLen] ^= 0xff
+	badSize := bytes.Clone(single)
+	badSize[len(badSize)-lzipTrailerLen+4]++
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []byte
+		err   string
+	}{
+		{name: "single member", input: single, want: text},
+		{name: "empty member", input: lzipMember(t, nil), want: []byte{}},
+		{name: "two members", input: append(bytes.Clone(single), lzipMember(t, []byte("second\n"))...), want: append(bytes.Clone(text), "second\n"...)},
+		{name: "trailing garbage", input: append(bytes.Clone(single), "\x00\x00"...), want: text},
+		{name: "CRC mismatch", input: badCRC, err: "CRC mismatch"},
+		{name: "size mismatch", input: badSize, err: "size mismatch"},
+		{name: "truncated trailer", input: single[:len(single)-4], err: "reading trailer"},
+		{name: "unsupported version", input: append([]byte("LZIP\x02"), single[5:]...), err: "unsupported version"},
+		{name: "invalid dictionary size", input: append([]byte("LZIP\x01\x05"), single[6:]...), err: "invalid dictionary size"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []byte
+			z, err := newLzipReader(bufio.NewReader(bytes.NewReader(test.input)))
+			if err == nil {
+				got, err = io.ReadAll(z)
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Fatalf("got %d bytes, want %d", len(got), len(test.want))
+			}
+
+			// the error is sticky, the trailer is not read again
+			if n, err := z.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Fatalf("read after the end gave %d, %v", n, err)
+			}
+		})
+	}
+}
+
+func TestDetectLzip(t *testing.T) {
+	f, name := detect(bufio.NewReader(bytes.NewReader(lzipMember(t, []byte("x")))), "source.tar.lz")
+	if f == nil || f.name != "lzip" || name != "source.tar" {
+		t.Fatalf("detected %v as %s", f, name)
+	}
+}
@@ -3,20 +3,24 @@ package decompress
 import (
 	"archive/tar"
 	"archive/zip"
+	"bufio"
 	"bytes"
-	"compress/bzip2"
-	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
-
-	"github.com/klauspost/compress/zstd"
-	"github.com/pierrec/lz4/v4"
-	"github.com/ulikunitz/xz"
 )
 
+// safeJoin joins name to dir, refusing names that escape it
+func safeJoin(dir, name string) (string, error) {
+	path := filepath.Join(dir, filepath.Clean(name))
+	if path != filepath.Clean(dir) && !strings.HasPrefix(path, filepath.Clean(dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path: %s", name)
+	}
+	return path, nil
+}
+
 func extractZipFile(file *zip.File, dest string) error {
 	rc, err := file.Open()
 	if err != nil {
@@ -24,7 +28,10 @@ func extractZipFile(file *zip.File, dest string) error {
 	}
 	defer rc.Close()
 
-	path := filepath.Join(dest, file.Name)
+	path, err := safeJoin(dest, file.Name)
+	if err != nil {
+		return err
+	}
 
 	if file.FileInfo().IsDir() {
 		return os.MkdirAll(path, file.Mode())
@@ -43,111 +50,173 @@ func extractZipFile(file *zip.File, dest string) error {
 	return err
 }
 
-func Decompress(data io.Reader, outputDir, filename string) error {
+// extractZip reads the zip in data into memory first, the central directory is at its end
+func extractZip(data io.Reader, outputDir string) error {
+	content, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	return extractZipAt(bytes.NewReader(content), int64(len(content)), outputDir)
+}
 
-	var reader io.Reader
-	switch {
-	case strings.HasSuffix(filename, ".gz"):
-		var err error
-		reader, err = gzip.NewReader(data)
+// extractZipAt extracts a zip read in place, like a file on disk
+func extractZipAt(data io.ReaderAt, size int64, outputDir string) error {
+	reader, err := zip.NewReader(data, size)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+
+	for _, file := range reader.File {
+		err := extractZipFile(file, outputDir)
 		if err != nil {
-			return err
+			return fmt.Errorf("error unziping %s: %w", file.Name, err)
 		}
-		filename, _ = strings.CutSuffix(filename, ".gz")
-	case strings.HasSuffix(filename, ".xz"):
-		var err error
-		reader, err = xz.NewReader(data)
-		if err != nil {
-			return err
+	}
+	return nil
+}
+
+// fileSection is what is left of file from its current offset, so a zip on disk is not read into memory
+func fileSection(file *os.File) (*io.SectionReader, bool) {
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, false
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, false
+	}
+	return io.NewSectionReader(file, start, info.Size()-start), true
+}
+
+// Decompress extracts data into outputDir. The format is detected from the content, filename is only looked
+// at when it can't be, and a payload that is not an archive is saved as filename without its compression suffix
+func Decompress(data io.Reader, outputDir, filename string) error {
+	var section *io.SectionReader
+	if file, ok := data.(*os.File); ok {
+		section, _ = fileSection(file)
+	}
+	input := bufio.NewReader(data)
+
+	format, filename := detect(input, filename)
+	if format == zipFormat {
+		if section != nil {
+			return extractZipAt(section, section.Size(), outputDir)
 		}
-		filename, _ = strings.CutSuffix(filename, ".xz")
-	case strings.HasSuffix(filename, ".zst"), strings.HasSuffix(filename, ".pkt"):
+		return extractZip(input, outputDir)
+	}
+
+	var reader io.Reader = input
+	if format != nil {
 		var err error
-		reader, err = zstd.NewReader(data)
-		if err != nil {
-			return err
+		if reader, err = format.open(input); err != nil {
+			return fmt.Errorf("%s: %w", format.name, err)
 		}
-		filename, _ = strings.CutSuffix(filename, ".zst")
-	case strings.HasSuffix(filename, ".bz2"):
-		reader = bzip2.NewReader(data)
-		filename, _ = strings.CutSuffix(filename, ".bz2")
-	case strings.HasSuffix(filename, ".lz4"):
-		reader = lz4.NewReader(data)
-		filename, _ = strings.CutSuffix(filename, ".lz4")
-	case strings.HasSuffix(filename, ".zip"):
-		content, err := io.ReadAll(data)
-		if err != nil {
-			return err
+		if closer, ok := reader.(interface{ Close() }); ok {
+			defer closer.Close()
+		}
+	}
+
+	content := bufio.NewReaderSize(reader, tarBlockLen)
+	header, err := content.Peek(tarBlockLen)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	// old tar archives have no ustar magic, for those the name decides
+	if isTar(header) || strings.HasSuffix(filename, ".tar") || strings.HasSuffix(filename, ".pkt") {
+		return extractTar(content, outputDir)
+	}
+	if format != nil && zipFormat.magic(header) {
+		return extractZip(content, outputDir)
+	}
+
+	return saveFile(content, outputDir, filename)
+}
+
+// saveFile writes a payload that is not an archive as a single file
+func saveFile(data io.Reader, outputDir, filename string) error {
+	filename = filepath.Base(filename)
+	if filename == "." || filename == "/" || filename == "" {
+		filename = "download"
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+
+	outFile, err := os.OpenFile(filepath.Join(outputDir, filename), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	_, err = io.Copy(outFile, data)
+	return err
+}
+
+func extractTar(data io.Reader, outputDir string) error {
+	tarReader := tar.NewReader(data)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
 		}
-		reader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
 		if err != nil {
 			return err
 		}
-		if err := os.MkdirAll(outputDir, 0755); err != nil {
+
+		targetPath, err := safeJoin(outputDir, header.Name)
+		if err != nil {
 			return err
 		}
 
-		for _, file := range reader.File {
-			err := extractZipFile(file, outputDir)
-			if err != nil {
-				return fmt.Errorf("error unziping %s: %w", file.Name, err)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(targetPath, os.FileMode(header.Mode)); err != nil {
+				return err
 			}
-		}
-		return nil
-	}
 
-	if strings.HasSuffix(filename, ".tar") || strings.HasSuffix(filename, ".pkt") {
-		tarReader := tar.NewReader(reader)
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+				return err
+			}
+			if err := writeFile(targetPath, tarReader, os.FileMode(header.Mode)); err != nil {
+				return err
+			}
 
-		for {
-			header, err := tarReader.Next()
-			if err == io.EOF {
-				break
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, targetPath); err != nil {
+				return err
 			}
+		case tar.TypeLink:
+			linkPath, err := safeJoin(outputDir, header.Linkname)
 			if err != nil {
 				return err
 			}
-
-			targetPath := filepath.Join(outputDir, filepath.Clean(header.Name))
-			if !strings.HasPrefix(targetPath, outputDir) {
-				return fmt.Errorf("invalid path: %s", targetPath)
+			if err := os.Link(linkPath, targetPath); err != nil {
+				return err
 			}
 
-			switch header.Typeflag {
-			case tar.TypeDir:
-				if err := os.MkdirAll(targetPath, os.FileMode(header.Mode)); err != nil {
-					return err
-				}
-
-			case tar.TypeReg, tar.TypeRegA:
-				if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-					return err
-				}
-				outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
-				if err != nil {
-					return err
-				}
-				defer outFile.Close()
-
-				if _, err := io.Copy(outFile, tarReader); err != nil {
-					return err
-				}
-
-			case tar.TypeSymlink:
-				if err := os.Symlink(header.Linkname, targetPath); err != nil {
-					return err
-				}
-			case tar.TypeLink:
-				linkPath := filepath.Join(outputDir, header.Linkname)
-				if err := os.Link(linkPath, targetPath); err != nil {
-					return err
-				}
-
-			default:
-				return fmt.Errorf("unknown file type: %c => %s", header.Typeflag, header.Name)
-			}
+		// the pax headers GitHub puts in its archives carry only the commit
+		case tar.TypeXGlobalHeader:
+
+		default:
+			return fmt.Errorf("unknown file type: %c => %s", header.Typeflag, header.Name)
 		}
 	}
 
 	return nil
 }
+
+func writeFile(path string, data io.Reader, mode os.FileMode) error {
+	outFile, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	_, err = io.Copy(outFile, data)
+	return err
+}
@@ -0,0 +1,57 @@
+package decompress
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecompressZip(t *testing.T) {
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	f, err := w.Create("src/main.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("int main() {}\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "source.zip")
+	// the zip does not start the file, it is read from where the file is
+	if err := os.WriteFile(path, append([]byte("skipped"), archive.Bytes()...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(int64(len("skipped")), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := map[string]io.Reader{
+		"file":   file,
+		"stream": bytes.NewReader(archive.Bytes()),
+	}
+	for name, input := range inputs {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := Decompress(input, dir, "source.zip"); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, "src", "main.c"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "int main() {}\n" {
+				t.Fatalf("extracted %q", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package digest
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/roboogg133/packets/pkg/packet.lua.d"
+	"github.com/zeebo/blake3"
+	"golang.org/x/crypto/blake2b"
+)
+
+// New returns the hash of algorithm, one of packet.DigestAlgorithms
+func New(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case packet.SHA256:
+		return sha256.New(), nil
+	case packet.SHA512:
+		return sha512.New(), nil
+	case packet.BLAKE2b:
+		return blake2b.New512(nil)
+	case packet.BLAKE3:
+		return blake3.New(), nil
+	}
+	return nil, fmt.Errorf("unknown digest algorithm %s", algorithm)
+}
+
+// File hashes the file at path with every algorithm in a single read
+func File(path string, algorithms ...string) (map[string]string, error) {
+	hashes := make(map[string]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		if _, ok := hashes[algorithm]; ok {
+			continue
+		}
+		h, err := New(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		hashes[algorithm] = h
+		writers = append(writers, h)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]string, len(hashes))
+	for algorithm, h := range hashes {
+		sums[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums, nil
+}
+
+// Verify checks the file at path against digests, for every algorithm listed one of its sums must match
+func Verify(path string, digests []packet.Digest) error {
+	if len(digests) == 0 {
+		return nil
+	}
+
+	expected := make(map[string][]string)
+	var algorithms []string
+	for _, d := range digests {
+		if _, ok := expected[d.Algorithm]; !ok {
+			algorithms = append(algorithms, d.Algorithm)
+		}
+		expected[d.Algorithm] = append(expected[d.Algorithm], strings.ToLower(d.Sum))
+	}
+
+	sums, err := File(path, algorithms...)
+	if err != nil {
+		return err
+	}
+	for _, algorithm := range algorithms {
+		if !slices.Contains(expected[algorithm], sums[algorithm]) {
+			return fmt.Errorf("%w: %s is %s, expected %s", packet.ErrDigestMismatch, algorithm, sums[algorithm], strings.Join(expected[algorithm], " or "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package download
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PartialSuffix is appended to the destination while it is being written, a partial file left by an
+// interrupted transfer is continued by the next download of the same destination
+const PartialSuffix = ".part"
+
+// validatorSuffix keeps the ETag or Last-Modified the partial file was downloaded with, so a resource that
+// changed in the meantime is downloaded again from the start
+const validatorSuffix = ".validator"
+
+// StatusError is a response that is not a success
+type StatusError struct {
+	Url        string
+	StatusCode int
+	Status     string
+	// RetryAfter is the wait the server asked for, 0 when it did not
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string { return "unexpected status " + e.Status }
+
+// Temporary reports if the same request can succeed later
+func (e *StatusError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+// File streams the response of newRequest into path, hashing it on the way, and returns its sha256 and size.
+// Every url is tried in order, each up to attempts times with Backoff between retries; only Retryable errors
+// are retried and the next url is tried right away otherwise. GET transfers that fail midway are continued
+// with a Range request, by the next attempt or by the next call with the same path; a server that ignores
+// Range sends the whole file again. When everything fails the error is an *AttemptsError
+func File(client *http.Client, urls []string, newRequest func(url string) (*http.Request, error), path string, attempts int) (string, int64, error) {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	failed := &AttemptsError{}
+	for _, url := range urls {
+		for n := range attempts {
+			sum, size, err := transfer(client, func() (*http.Request, error) { return newRequest(url) }, path)
+			if err == nil {
+				os.Remove(path + PartialSuffix + validatorSuffix)
+				return sum, size, os.Rename(path+PartialSuffix, path)
+			}
+			failed.Attempts = append(failed.Attempts, Attempt{Url: url, Err: err})
+
+			if !Retryable(err) || n == attempts-1 {
+				break
+			}
+			wait := Backoff(n)
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) && statusErr.RetryAfter > wait {
+				wait = statusErr.RetryAfter
+			}
+			time.Sleep(wait)
+		}
+	}
+	return "", 0, failed
+}
+
+func transfer(client *http.Client, newRequest func() (*http.Request, error), path string) (string, int64, error) {
+	req, err := newRequest()
+	if err != nil {
+		return "", 0, err
+	}
+
+	part, err := os.OpenFile(path+PartialSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", 0, err
+	}
+	defer part.Close()
+
+	// only GET can be asked for the rest of a resource, anything else starts again
+	h := sha256.New()
+	var offset int64
+	if req.Method == http.MethodGet {
+		if offset, err = io.Copy(h, part); err != nil {
+			return "", 0, err
+		}
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if validator, err := os.ReadFile(path + PartialSuffix + validatorSuffix); err == nil {
+			req.Header.Set("If-Range", strings.TrimSpace(string(validator)))
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 && contentRangeStart(resp) == offset:
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 && contentRangeTotal(resp) == offset:
+		// the partial file was already complete
+		return hex.EncodeToString(h.Sum(nil)), offset, nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300 && resp.StatusCode != http.StatusPartialContent:
+		if offset, err = restart(part, h); err != nil {
+			return "", 0, err
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable || resp.StatusCode == http.StatusPartialContent:
+		// the partial file does not belong to the resource anymore
+		if _, err := restart(part, h); err != nil {
+			return "", 0, err
+		}
+		return "", 0, fmt.Errorf("downloading %s: unexpected range, starting again", req.URL)
+	default:
+		return "", 0, &StatusError{Url: req.URL.String(), StatusCode: resp.StatusCode, Status: resp.Status, RetryAfter: retryAfter(resp)}
+	}
+
+	if validator := resp.Header.Get("ETag"); validator != "" && !strings.HasPrefix(validator, "W/") {
+		os.WriteFile(path+PartialSuffix+validatorSuffix, []byte(validator), 0644)
+	} else if validator := resp.Header.Get("Last-Modified"); validator != "" {
+		os.WriteFile(path+PartialSuffix+validatorSuffix, []byte(validator), 0644)
+	}
+
+	if _, err := part.Seek(offset, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	written, err := io.Copy(io.MultiWriter(part, h), resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return "", 0, fmt.Errorf("downloading %s: %w", req.URL, io.ErrUnexpectedEOF)
+	}
+	return hex.EncodeToString(h.Sum(nil)), offset + written, part.Sync()
+}
+
+func restart(part *os.File, h hash.Hash) (int64, error) {
+	h.Reset()
+	if err := part.Truncate(0); err != nil {
+		return 0, err
+	}
+	_, err := part.Seek(0, io.SeekStart)
+	return 0, err
+}
+
+// contentRangeStart reads the first byte of "bytes first-last/total", -1 when it can't be read
+func contentRangeStart(resp *http.Response) int64 {
+	spec, ok := strings.CutPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	if !ok {
+		return -1
+	}
+	first, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// contentRangeTotal reads the total of "bytes */total", -1 when it can't be read
+func contentRangeTotal(resp *http.Response) int64 {
+	spec, ok := strings.CutPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	if !ok {
+		return -1
+	}
+	_, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
@@ -0,0 +1,104 @@
+package download
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// BackoffBase is the longest wait before the first retry, it doubles with every retry up to BackoffMax
+	BackoffBase = 500 * time.Millisecond
+	BackoffMax  = 30 * time.Second
+)
+
+// Backoff returns how long to wait before retry number n, counting from 0. The wait is picked at random up
+// to the exponential limit, so many clients failing at once don't retry at once
+func Backoff(n int) time.Duration {
+	limit := BackoffMax
+	if n < 16 {
+		limit = min(BackoffBase<<n, BackoffMax)
+	}
+	return rand.N(limit) + 1
+}
+
+// retryAfter reads the Retry-After header in seconds or as a date, 0 when there is none
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return min(time.Duration(seconds)*time.Second, BackoffMax)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return min(max(time.Until(date), 0), BackoffMax)
+	}
+	return 0
+}
+
+// Retryable reports if a failed download can succeed when tried again: timeouts, dropped connections and
+// temporary statuses are, missing files, unknown hosts, bad certificates and local disk errors are not
+func Retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return false
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var verification *tls.CertificateVerificationError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) || errors.As(err, &verification) {
+		return false
+	}
+
+	return !errors.Is(err, context.Canceled)
+}
+
+// Attempt is a single failed try of a download
+type Attempt struct {
+	Url string
+	Err error
+}
+
+// AttemptsError is returned when every url of a download failed, it lists every attempt in order
+type AttemptsError struct {
+	Attempts []Attempt
+}
+
+func (e *AttemptsError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "download failed after %d attempts:", len(e.Attempts))
+	for i, attempt := range e.Attempts {
+		fmt.Fprintf(&b, "\n  %d. %s: %s", i+1, attempt.Url, attempt.Err)
+	}
+	return b.String()
+}
+
+func (e *AttemptsError) Unwrap() []error {
+	errs := make([]error, len(e.Attempts))
+	for i, attempt := range e.Attempts {
+		errs[i] = attempt.Err
+	}
+	return errs
+}
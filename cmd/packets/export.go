@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/roboogg133/packets/cmd/packets/database"
+	"github.com/roboogg133/packets/cmd/packets/lockfile"
+	"github.com/roboogg133/packets/cmd/packets/manifest"
+	"github.com/roboogg133/packets/cmd/packets/repo"
+	"github.com/roboogg133/packets/pkg/packet.lua.d"
+	"github.com/spf13/cobra"
+)
+
+// ExportManifest pins every explicitly installed package, packages installed from a local .pkt can't be
+// installed again from a repository and are skipped
+func ExportManifest(db *sql.DB) (*manifest.Manifest, error) {
+	installed, err := database.ListAllInstalledPackages(db)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest.Manifest{Generated: time.Now().UTC().Truncate(time.Second)}
+	for _, pkg := range installed {
+		if pkg.InstallReason != database.ReasonExplicit {
+			continue
+		}
+		if pkg.Location == LocalLocation {
+			fmt.Fprintf(os.Stderr, "=> skipping %s, it was installed from a local file\n", pkg.Id)
+			continue
+		}
+
+		var flags []string
+		if lf, err := lockfile.Read(filepath.Join(PackageRootDir, pkg.Id, LockFileName)); err == nil && len(lf.FlagsGiven) > 0 {
+			flags = lf.FlagsGiven
+		}
+
+		m.Packages = append(m.Packages, manifest.Package{
+			Id:       pkg.Id,
+			Serial:   pkg.Serial,
+			Location: pkg.Location,
+			Flags:    flags,
+		})
+	}
+
+	slices.SortFunc(m.Packages, func(a, b manifest.Package) int { return strings.Compare(a.Id, b.Id) })
+	return m, nil
+}
+
+// ResolveManifestPackage finds the exact build pinned by pkg in the synced repositories, preferring the
+// repository it was exported from
+func ResolveManifestPackage(pkg manifest.Package, sourceDB *sql.DB) (InstallTarget, error) {
+	found, err := database.FindPackageInSources(pkg.Id, sourceDB)
+	if err != nil {
+		return InstallTarget{}, err
+	}
+	if len(found) == 0 {
+		return InstallTarget{}, fmt.Errorf("%s is not available in any synced repository", pkg.Id)
+	}
+
+	var match *database.SDBPkg
+	for i, candidate := range found {
+		if candidate.Serial != pkg.Serial {
+			continue
+		}
+		if match == nil || candidate.Location == pkg.Location {
+			match = &found[i]
+		}
+	}
+	if match == nil {
+		return InstallTarget{}, fmt.Errorf("%s is available with serial %d, the manifest pins serial %d", pkg.Id, found[0].Serial, pkg.Serial)
+	}
+
+	return InstallTarget{
+		Id:       packet.PackageID(match.Id),
+		Location: match.Location,
+		Reason:   database.ReasonExplicit,
+		Flags:    pkg.Flags,
+	}, nil
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export [manifest]",
+	Short: "Write the explicitly installed packages to a manifest",
+	Long:  "Write the id, serial, repository and build options of every explicitly installed package to a TOML manifest, to the standard output when no file is given",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		m, err := ExportManifest(db)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		data, err := m.Marshal()
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		if len(args) == 0 {
+			os.Stdout.Write(data)
+			return
+		}
+		if err := os.WriteFile(args[0], data, 0644); err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("=> %d packages written to %s\n", len(m.Packages), args[0])
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import {manifest}",
+	Short: "Install the packages of a manifest",
+	Long:  "Install exactly the packages pinned by a manifest from the synced repositories, nothing is installed when one of them is not available",
+	Args:  cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		GrantPrivilegies()
+		return GetConfiguration()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		m, err := manifest.Read(args[0])
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		sourceDB, err := database.OpenSource(SourceDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		internalDB, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		// every package is resolved before anything is installed, a machine is either provisioned entirely or not touched
+		failed := false
+		var targets []InstallTarget
+		var explicit []string
+		for _, pkg := range m.Packages {
+			if installed, err := database.GetInstalledPackage(packet.PackageID(pkg.Id).Name(), internalDB); err == nil {
+				if installed.Id != pkg.Id {
+					fmt.Printf("error: %s is pinned but %s is installed\n", pkg.Id, installed.Id)
+					failed = true
+					continue
+				}
+				if installed.Serial != pkg.Serial {
+					fmt.Printf("error: %s is pinned with serial %d but serial %d is installed\n", pkg.Id, pkg.Serial, installed.Serial)
+					failed = true
+					continue
+				}
+				fmt.Printf("=> package %s is already installed\n", pkg.Id)
+				explicit = append(explicit, pkg.Id)
+				continue
+			} else if err != sql.ErrNoRows {
+				fmt.Printf("error: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			target, err := ResolveManifestPackage(pkg, sourceDB)
+			if err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				failed = true
+				continue
+			}
+			targets = append(targets, target)
+		}
+		if failed {
+			fmt.Println("error: nothing was installed")
+			os.Exit(1)
+		}
+
+		// what the manifest lists was explicitly asked for, even if it came in as a dependency
+		for _, id := range explicit {
+			if err := database.SetInstallReason(id, database.ReasonExplicit, internalDB); err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+			}
+		}
+
+		depsMap := make(map[string]map[string]repo.DependencyStatus)
+		for _, target := range targets {
+			if err := repo.SolveDeps(target.Id, target.Location, internalDB, sourceDB, &depsMap); err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				os.Exit(1)
+			}
+		}
+
+		queue, err := DependencyQueue(targets, depsMap, sourceDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if !InstallQueue(queue, internalDB) {
+			os.Exit(1)
+		}
+	},
+}
@@ -18,13 +18,11 @@ var configCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		insertedName := args[0]
 
-		db, err := sql.Open("sqlite3", InternalDB)
+		db, err := database.OpenInternal(InternalDB)
 		if err != nil {
-			fmt.Println("Error opening database:", err)
+			fmt.Printf("error: %s\n", err.Error())
 			os.Exit(1)
 		}
-		defer db.Close()
-		database.PrepareDataBase(db)
 
 		id, err := database.GetPackageId(insertedName, db)
 		if err != nil {
@@ -74,13 +72,11 @@ var flagCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		insertedName := args[1]
 
-		db, err := sql.Open("sqlite3", InternalDB)
+		db, err := database.OpenInternal(InternalDB)
 		if err != nil {
-			fmt.Println("Error opening database:", err)
+			fmt.Printf("error: %s\n", err.Error())
 			os.Exit(1)
 		}
-		defer db.Close()
-		database.PrepareDataBase(db)
 
 		id, err := database.GetPackageId(insertedName, db)
 		if err != nil {
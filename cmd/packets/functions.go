@@ -1,61 +1,419 @@
 package main
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"strings"
 
 	"github.com/go-git/go-git/v6"
+	"github.com/go-git/go-git/v6/plumbing/transport"
+	githttp "github.com/go-git/go-git/v6/plumbing/transport/http"
+	"github.com/roboogg133/packets/cmd/packets/buildlog"
 	"github.com/roboogg133/packets/cmd/packets/decompress"
+	"github.com/roboogg133/packets/cmd/packets/digest"
+	"github.com/roboogg133/packets/cmd/packets/download"
 	"github.com/roboogg133/packets/cmd/packets/lockfile"
+	"github.com/roboogg133/packets/cmd/packets/patch"
+	"github.com/roboogg133/packets/cmd/packets/signature"
 	"github.com/roboogg133/packets/pkg/packet.lua.d"
 )
 
-func DownloadSource(sources *[]packet.Source, configs *packet.Config, lockFile *os.File) error {
+func DownloadSource(sources *[]packet.Source, configs *packet.Config, lockFile *lockfile.Lockfile) error {
 	for _, source := range *sources {
-		if lockFile != nil {
-			b, err := io.ReadAll(lockFile)
-			if err != nil {
-				return fmt.Errorf("error: %s", err.Error())
-			}
-			lf := lockfile.ParseStatus(string(b))
-			if slices.Contains(lf.Progress, lockfile.Status{Action: "download", Value: source.Url}) {
-				fmt.Printf("===> Skipping download %s\n", path.Base(source.Url))
-				continue
-			}
+		if lockFile != nil && lockFile.Downloaded(source.Url) {
+			fmt.Printf("===> Skipping download %s\n", path.Base(source.Url))
+			continue
 		}
-		downloaded, err := packet.GetSource(source.Url, source.Method, source.Specs, NumberOfTryAttempts)
+		downloaded, err := packet.GetSource(source.Url, source.Method, source.Specs, source.Mirrors...)
 		if err != nil {
 			return fmt.Errorf("error: %s", err.Error())
 		}
-		if source.Method == "GET" || source.Method == "POST" {
-			f := downloaded.([]byte)
+		if err := checkDigestPolicy(source.Url, downloaded); err != nil {
+			return fmt.Errorf("error: %s", err.Error())
+		}
+		record := lockfile.Download{Url: source.Url, Kind: lockfile.SourceDownload}
+		if httpSource, ok := downloaded.(*packet.HTTPSource); ok {
+			cached, sum, err := CachedSource(httpSource)
+			if err != nil {
+				return fmt.Errorf("error: %s", err.Error())
+			}
+			record.SHA256 = sum
+
+			if source.Signature != nil {
+				if record.Signature, err = VerifySignature(cached, source.Signature); err != nil {
+					return fmt.Errorf("error: %s: %s", path.Base(source.Url), err.Error())
+				}
+				fmt.Printf("===> Verified %s signed by %s\n", path.Base(source.Url), record.Signature.Fingerprint)
+			}
 
-			buf := bytes.NewBuffer(f)
+			archive, err := os.Open(cached)
+			if err != nil {
+				return fmt.Errorf("error: %s", err.Error())
+			}
 			_ = os.MkdirAll(configs.SourcesDir, 0755)
 
-			if err := decompress.Decompress(buf, configs.SourcesDir, path.Base(source.Url)); err != nil {
+			err = decompress.Decompress(archive, configs.SourcesDir, path.Base(source.Url))
+			archive.Close()
+			if err != nil {
 				return fmt.Errorf("error: %s", err.Error())
 			}
 		} else {
-			options := downloaded.(*git.CloneOptions)
+			gitSource := downloaded.(*packet.GitSource)
 			repoName, _ := strings.CutSuffix(filepath.Base(source.Url), ".git")
-			_ = os.MkdirAll(filepath.Join(configs.SourcesDir, repoName), 0755)
-			_, err := git.PlainClone(filepath.Join(configs.SourcesDir, repoName), options)
+			repository, err := cloneMirrors(filepath.Join(configs.SourcesDir, repoName), gitSource.Options, append([]string{source.Url}, source.Mirrors...))
 			if err != nil {
 				return fmt.Errorf("error: %s", err.Error())
 			}
-			os.RemoveAll(filepath.Join(configs.SourcesDir, repoName, ".git"))
+			// the resolved commit goes into the lockfile, so a build from a branch can be repeated
+			if record.Commit, err = gitSource.Checkout(repository); err != nil {
+				return fmt.Errorf("error: %s", err.Error())
+			}
+			removeGitDirs(filepath.Join(configs.SourcesDir, repoName))
 		}
 		fmt.Printf("===> Download: %s\n", path.Base(source.Url))
 		if lockFile != nil {
-			lockFile.WriteString("download: " + source.Url + "\n")
+			lockFile.RecordDownload(record)
+			if err := lockFile.Save(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkDigestPolicy fails for a source without a digest when config.toml requires one
+func checkDigestPolicy(url string, source any) error {
+	if !RequireDigest() {
+		return nil
+	}
+	switch s := source.(type) {
+	case *packet.HTTPSource:
+		if !s.HasDigest() {
+			return fmt.Errorf("%s has no digest, config.toml requires one for every source", url)
+		}
+	case *packet.GitSource:
+		if s.Commit == "" {
+			return fmt.Errorf("%s is not pinned to a commit, config.toml requires a digest for every source", url)
+		}
+	}
+	return nil
+}
+
+// VerifySignature downloads the detached signature of the file at path and checks it against the listed keys
+func VerifySignature(path string, sig *packet.Signature) (*lockfile.Signature, error) {
+	if sig.Url == "" {
+		return nil, errors.New("signature has no url")
+	}
+
+	// a signature is small and may be replaced upstream, it is always downloaded again
+	fresh, err := FreshDownload(DownloadRequest{
+		Urls:       []string{sig.Url},
+		Kind:       SignatureDownload,
+		NewRequest: func(url string) (*http.Request, error) { return http.NewRequest("GET", url, nil) },
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(fresh)
+	os.Remove(fresh)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := signature.VerifyFile(path, data, sig.Keys, sig.Type)
+	if err != nil {
+		return nil, err
+	}
+	return &lockfile.Signature{Url: sig.Url, Type: result.Type, Fingerprint: result.Fingerprint, Signer: result.Signer}, nil
+}
+
+// ApplyPatches applies every patch to the sources in order, a patch the lockfile records as applied is skipped.
+// A patch either applies as a whole or leaves the sources untouched, its hunks that failed are in the error
+func ApplyPatches(patches []packet.Patch, configs *packet.Config, lockFile *lockfile.Lockfile) error {
+	for _, p := range patches {
+		data, sum, err := readPatch(p, configs)
+		if err != nil {
+			return fmt.Errorf("patch %s: %w", p.Name(), err)
+		}
+		if lockFile != nil && lockFile.PatchApplied(p.Name(), sum) {
+			fmt.Printf("===> Skipping patch %s\n", path.Base(p.Name()))
+			continue
+		}
+
+		dir := configs.SourcesDir
+		if p.Dir != "" {
+			relative, err := patch.StripPath(p.Dir, 0)
+			if err != nil {
+				return fmt.Errorf("patch %s: %w", p.Name(), err)
+			}
+			dir = filepath.Join(dir, relative)
+		}
+
+		files, err := patch.Parse(data)
+		if err == nil {
+			err = patch.Apply(files, dir, p.Strip)
+		}
+
+		if lockFile != nil {
+			record := lockfile.Patch{Name: p.Name(), SHA256: sum, Status: lockfile.StatusOK}
+			if err != nil {
+				record.Status, record.Error = lockfile.StatusFailed, err.Error()
+			}
+			lockFile.RecordPatch(record)
+			if saveErr := lockFile.Save(); saveErr != nil && err == nil {
+				return saveErr
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("patch %s: %w", p.Name(), err)
+		}
+		fmt.Printf("===> Patch: %s\n", path.Base(p.Name()))
+	}
+	return nil
+}
+
+// readPatch returns a patch shipped in the .pkt or downloaded through the cache, and its sha256
+func readPatch(p packet.Patch, configs *packet.Config) ([]byte, string, error) {
+	if p.File == "" {
+		source := &packet.HTTPSource{Method: "GET", Url: p.Url, Mirrors: p.Mirrors, SHA256: p.SHA256, Digests: p.Digests}
+		if err := checkDigestPolicy(p.Url, source); err != nil {
+			return nil, "", err
+		}
+		cached, sum, err := CachedSource(source)
+		if err != nil {
+			return nil, "", err
+		}
+		data, err := os.ReadFile(cached)
+		return data, sum, err
+	}
+
+	relative, err := patch.StripPath(p.File, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	file := filepath.Join(configs.RootDir, relative)
+	if err := digest.Verify(file, p.Digests); err != nil {
+		return nil, "", fmt.Errorf("%s: %w", p.File, err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash := sha256.Sum256(data)
+	sum := hex.EncodeToString(hash[:])
+	if len(p.SHA256) > 0 && !slices.ContainsFunc(p.SHA256, func(s string) bool { return strings.EqualFold(s, sum) }) {
+		return nil, "", fmt.Errorf("%w: %s has sha256 %s, expected %s", packet.ErrSha256Sum, p.File, sum, strings.Join(p.SHA256, " or "))
+	}
+	return data, sum, nil
+}
+
+// removeGitDirs removes the repository metadata of a checkout, submodules included, their .git files point
+// into the .git of the top repository
+func removeGitDirs(dir string) {
+	var found []string
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.Name() == ".git" {
+			found = append(found, p)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	for _, p := range found {
+		os.RemoveAll(p)
+	}
+}
+
+// cloneMirrors clones the first of urls that works into dir, a failed clone is removed before the next url
+func cloneMirrors(dir string, options *git.CloneOptions, urls []string) (*git.Repository, error) {
+	if err := useHTTPClientForGit(); err != nil {
+		return nil, err
+	}
+
+	failed := &download.AttemptsError{}
+	for _, url := range urls {
+		_ = os.RemoveAll(dir)
+		_ = os.MkdirAll(dir, 0755)
+
+		options.URL = url
+		repository, err := git.PlainClone(dir, options)
+		if err == nil {
+			return repository, nil
+		}
+		failed.Attempts = append(failed.Attempts, download.Attempt{Url: url, Err: err})
+	}
+	return nil, failed
+}
+
+// useHTTPClientForGit sends the clones, fetches and submodule updates over http and https through HTTPClient, so
+// they get the proxy, CA files, host credentials and .netrc of config.toml like every other download
+func useHTTPClientForGit() error {
+	client, err := HTTPClient()
+	if err != nil {
+		return err
+	}
+	gitTransport := githttp.NewTransport(&githttp.TransportOptions{Client: client})
+	transport.Register("http", gitTransport)
+	transport.Register("https", gitTransport)
+	return nil
+}
+
+// OpenLockFile reads the package lockfile, converting a legacy one, or creates it when the package has none
+func OpenLockFile(rootdir string, flagsGiven []string) (*lockfile.Lockfile, error) {
+	lockPath := filepath.Join(rootdir, LockFileName)
+
+	lf, err := lockfile.Read(lockPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		lf = lockfile.New(lockPath, PacketsVersion, runtime.GOOS, runtime.GOARCH, PacketsSerial, flagsGiven)
+	case err != nil:
+		return nil, err
+	case lf.Format == lockfile.FormatVersion:
+		return lf, nil
+	}
+
+	return lf, lf.Save()
+}
+
+// RunPhase executes build() or install() sending its output to a new log that is referenced in the lockfile,
+// the phase result and timestamps are recorded in the lockfile
+func RunPhase(phase string, pkg *packet.PacketLua, configs *packet.Config, lockFile *lockfile.Lockfile) error {
+	var echo io.Writer
+	if verbosityLevel != "" {
+		echo = &buildlog.PrefixWriter{Prefix: "[" + pkg.Name + "@" + pkg.Version + "] ", W: os.Stdout}
+	}
+
+	phaseLog, err := buildlog.New(configs.RootDir, phase, echo)
+	if err != nil {
+		return err
+	}
+	if lockFile != nil {
+		lockFile.StartPhase(phase, phaseLog.Path)
+		if err := lockFile.Save(); err != nil {
+			phaseLog.Close(err)
+			return err
+		}
+	}
+
+	configs.Output = phaseLog
+	instructions, flags := len(pkg.InstallInstructions), len(pkg.Flags)
+	switch phase {
+	case lockfile.BuildPhase:
+		err = pkg.ExecuteBuild(configs)
+	case lockfile.InstallPhase:
+		err = pkg.ExecuteInstall(configs)
+	default:
+		err = fmt.Errorf("unknown phase %s", phase)
+	}
+	configs.Output = nil
+
+	var scriptErr *packet.ScriptError
+	if errors.As(err, &scriptErr) && scriptErr.StackTrace != "" {
+		fmt.Fprintf(phaseLog, "%s\n%s\n", scriptErr.Error(), scriptErr.StackTrace)
+	}
+	phaseLog.Close(err)
+
+	if lockFile != nil {
+		lockFile.FinishPhase(phase, err)
+		if phase == lockfile.BuildPhase && err == nil {
+			lockFile.SetOutput(phase, BuildOutput(pkg.InstallInstructions[instructions:], pkg.Flags[flags:]))
+		}
+		if saveErr := lockFile.Save(); saveErr != nil && err == nil {
+			return saveErr
 		}
 	}
+
+	if err != nil {
+		return fmt.Errorf("%w\n  see the full log at %s", err, phaseLog.Path)
+	}
 	return nil
 }
+
+// BuildOutput is what build() asked for, as recorded in the lockfile
+func BuildOutput(instructions []packet.InstallInstruction, flags []packet.Flag) lockfile.Output {
+	var output lockfile.Output
+	for _, i := range instructions {
+		output.Instructions = append(output.Instructions, lockfile.Instruction{Source: i.Source, Destination: i.Destination, IsDir: i.IsDir, Mode: uint32(i.FileMode)})
+	}
+	for _, f := range flags {
+		output.Flags = append(output.Flags, lockfile.Flag{Name: f.Name, Path: f.Path, Type: f.FlagType})
+	}
+	return output
+}
+
+// RestoreBuildOutput adds what a build() recorded in the lockfile asked for to pkg, it is false when the
+// build has no output recorded and must run again
+func RestoreBuildOutput(pkg *packet.PacketLua, lockFile *lockfile.Lockfile) bool {
+	phase := lockFile.LastPhase(lockfile.BuildPhase)
+	if phase == nil || phase.Output == nil {
+		return false
+	}
+	for _, i := range phase.Output.Instructions {
+		pkg.InstallInstructions = append(pkg.InstallInstructions, packet.InstallInstruction{Source: i.Source, Destination: i.Destination, IsDir: i.IsDir, FileMode: os.FileMode(i.Mode)})
+	}
+	for _, f := range phase.Output.Flags {
+		pkg.Flags = append(pkg.Flags, packet.Flag{Name: f.Name, Path: f.Path, FlagType: f.Type})
+	}
+	return true
+}
+
+// InstructionPaths returns where every instruction is copied to, relocated under prefix when it is not empty
+func InstructionPaths(instructions []packet.InstallInstruction, prefix string) []string {
+	paths := make([]string, 0, len(instructions))
+	for _, v := range instructions {
+		paths = append(paths, filepath.Join(prefix, v.Destination))
+	}
+	return paths
+}
+
+// RecordInstalledPaths stores the files the last install() run puts into the system in the lockfile
+func RecordInstalledPaths(lockFile *lockfile.Lockfile, paths []string) error {
+	lockFile.SetPaths(lockfile.InstallPhase, paths)
+	return lockFile.Save()
+}
+
+// FindPackageRootDir returns the directory under PackageRootDir for a package id, or the most recent one for a name
+func FindPackageRootDir(nameOrId string) (string, error) {
+	if strings.Contains(nameOrId, "@") {
+		dir := filepath.Join(PackageRootDir, nameOrId)
+		if _, err := os.Stat(dir); err != nil {
+			return "", err
+		}
+		return dir, nil
+	}
+
+	matches, err := filepath.Glob(filepath.Join(PackageRootDir, nameOrId+"@*"))
+	if err != nil {
+		return "", err
+	}
+
+	var newest string
+	var newestTime int64
+	for _, match := range matches {
+		stat, err := os.Stat(match)
+		if err != nil || !stat.IsDir() {
+			continue
+		}
+		if stat.ModTime().UnixNano() > newestTime {
+			newest = match
+			newestTime = stat.ModTime().UnixNano()
+		}
+	}
+
+	if newest == "" {
+		return "", fmt.Errorf("no package directory found for %s", nameOrId)
+	}
+	return newest, nil
+}
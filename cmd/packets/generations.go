@@ -0,0 +1,406 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roboogg133/packets/cmd/packets/database"
+	"github.com/roboogg133/packets/pkg/install"
+	"github.com/roboogg133/packets/pkg/packet.lua.d"
+	"github.com/spf13/cobra"
+)
+
+// a payload is PayloadsDir/{id}/snapshot.json with the database rows of the package and
+// PayloadsDir/{id}/root with its installed files, hardlinked when possible
+const payloadSnapshotName = "snapshot.json"
+
+func payloadDir(id packet.PackageID) string { return filepath.Join(PayloadsDir, string(id)) }
+
+func HasPayload(id packet.PackageID) bool {
+	_, err := os.Stat(filepath.Join(payloadDir(id), payloadSnapshotName))
+	return err == nil
+}
+
+// SavePayload keeps the installed files and database rows of id so a generation that has it can be restored
+func SavePayload(id packet.PackageID, db *sql.DB) error {
+	snapshot, err := database.SnapshotPackage(id, db)
+	if err != nil {
+		return err
+	}
+
+	dir := payloadDir(id)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	root := filepath.Join(dir, "root")
+
+	for _, file := range snapshot.Files {
+		destination := filepath.Join(root, file.Filepath)
+		if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+			return err
+		}
+
+		switch {
+		case file.IsDir:
+			err = os.MkdirAll(destination, 0755)
+		case file.LinkTarget != "":
+			err = os.Symlink(file.LinkTarget, destination)
+		default:
+			if err = os.Link(file.Filepath, destination); err != nil {
+				err = copyFile(file.Filepath, destination)
+			}
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, payloadSnapshotName), data, 0644)
+}
+
+func readPayload(id packet.PackageID) (database.PackageSnapshot, error) {
+	var snapshot database.PackageSnapshot
+	data, err := os.ReadFile(filepath.Join(payloadDir(id), payloadSnapshotName))
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(data, &snapshot)
+	return snapshot, err
+}
+
+// restorePayload copies the files of a payload back into the system with their recorded mode and owner
+func restorePayload(snapshot database.PackageSnapshot) error {
+	root := filepath.Join(payloadDir(packet.PackageID(snapshot.Package.Id)), "root")
+
+	files := slices.Clone(snapshot.Files)
+	slices.SortStableFunc(files, func(a, b install.BasicFileStatus) int {
+		if a.IsDir != b.IsDir {
+			if a.IsDir {
+				return -1
+			}
+			return 1
+		}
+		return strings.Count(a.Filepath, "/") - strings.Count(b.Filepath, "/")
+	})
+
+	for _, file := range files {
+		switch {
+		case file.IsDir:
+			if err := os.MkdirAll(file.Filepath, 0755); err != nil {
+				return err
+			}
+			if file.PermMode != 0 {
+				os.Chmod(file.Filepath, file.PermMode.Perm())
+			}
+		case file.LinkTarget != "":
+			if err := os.MkdirAll(filepath.Dir(file.Filepath), 0755); err != nil {
+				return err
+			}
+			if err := os.Remove(file.Filepath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(file.LinkTarget, file.Filepath); err != nil {
+				return err
+			}
+		default:
+			if err := copyFile(filepath.Join(root, file.Filepath), file.Filepath); err != nil {
+				return err
+			}
+		}
+
+		if file.UID >= 0 && file.GID >= 0 {
+			os.Lchown(file.Filepath, file.UID, file.GID)
+		}
+	}
+	return nil
+}
+
+// RecordGeneration snapshots the installed packages for the running history entry and applies the retention policy
+func RecordGeneration(db *sql.DB) error {
+	if _, err := database.SnapshotGeneration(historyEntryId, db); err != nil {
+		return err
+	}
+	return PruneGenerations(db)
+}
+
+// PruneGenerations drops generations past the retention policy and the payloads no generation needs anymore,
+// the newest generation is always kept. Without a loaded config.toml nothing is pruned, the policy is unknown
+func PruneGenerations(db *sql.DB) error {
+	if Config == nil {
+		return nil
+	}
+	keep := DefaultGenerationsKept
+	if Config.Generations.Keep > 0 {
+		keep = Config.Generations.Keep
+	}
+	maxAgeDays := Config.Generations.MaxAgeDays
+
+	generations, err := database.ListGenerations(db)
+	if err != nil {
+		return err
+	}
+
+	var prune []int64
+	for i, generation := range generations {
+		if i == 0 {
+			continue
+		}
+		tooOld := maxAgeDays > 0 && time.Since(time.Unix(generation.TimeUnix, 0)) > time.Duration(maxAgeDays)*24*time.Hour
+		if i >= keep || tooOld {
+			prune = append(prune, generation.Id)
+		}
+	}
+	if len(prune) > 0 {
+		if err := database.DeleteGenerations(prune, db); err != nil {
+			return err
+		}
+	}
+
+	needed, err := database.ListGenerationPackageIds(db)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(PayloadsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		id := packet.PackageID(entry.Name())
+		if slices.Contains(needed, id) {
+			continue
+		}
+		if installed, err := database.SearchIfIsInstalled(string(id), db); err != nil || installed {
+			continue
+		}
+		os.RemoveAll(payloadDir(id))
+	}
+	return nil
+}
+
+// Rollback makes the installed packages match generation. Payload files are restored before the database is
+// switched in a single transaction; packages without a payload are installed again from their cached directory
+func Rollback(generation database.Generation, db *sql.DB) error {
+	installed, err := database.ListAllInstalledPackages(db)
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[packet.PackageID]database.GenerationPackage)
+	for _, pkg := range generation.Packages {
+		wanted[pkg.Id] = pkg
+	}
+
+	current := make(map[packet.PackageID]database.DBPkg)
+	var remove []packet.PackageID
+	for _, pkg := range installed {
+		id := packet.PackageID(pkg.Id)
+		current[id] = pkg
+		if _, ok := wanted[id]; !ok {
+			remove = append(remove, id)
+		}
+	}
+
+	var restore []database.PackageSnapshot
+	var fromCache []database.GenerationPackage
+	for _, pkg := range generation.Packages {
+		if _, ok := current[pkg.Id]; ok {
+			continue
+		}
+		snapshot, err := readPayload(pkg.Id)
+		if err != nil {
+			if _, statErr := os.Stat(filepath.Join(PackageRootDir, string(pkg.Id), "Packet.lua")); statErr != nil {
+				return fmt.Errorf("%s has neither a payload nor a cached package", pkg.Id)
+			}
+			fromCache = append(fromCache, pkg)
+			continue
+		}
+		snapshot.Package.Location = pkg.Location
+		snapshot.Package.InstallReason = pkg.Reason
+		restore = append(restore, snapshot)
+	}
+
+	// keep what is removed, so this rollback can be rolled back too
+	for _, id := range remove {
+		if HasPayload(id) {
+			continue
+		}
+		if err := SavePayload(id, db); err != nil {
+			return fmt.Errorf("saving %s before removing it: %w", id, err)
+		}
+	}
+
+	for _, id := range remove {
+		fmt.Printf("=> removing %s\n", id)
+		files, err := database.GetPackageFiles(id, db)
+		if err != nil {
+			return err
+		}
+		if err := RemoveFiles(files, id, db); err != nil {
+			return err
+		}
+	}
+
+	for i, snapshot := range restore {
+		fmt.Printf("=> restoring %s\n", snapshot.Package.Id)
+		if err := restorePayload(snapshot); err != nil {
+			// put back what was removed, the database still describes it
+			for _, id := range remove {
+				if removed, readErr := readPayload(id); readErr == nil {
+					restorePayload(removed)
+				}
+			}
+			for _, restored := range restore[:i] {
+				RemoveFiles(restored.Files, packet.PackageID(restored.Package.Id), db)
+			}
+			return fmt.Errorf("restoring %s: %w", snapshot.Package.Id, err)
+		}
+	}
+
+	if err := database.SwitchPackages(remove, restore, db); err != nil {
+		return err
+	}
+
+	for _, id := range remove {
+		pkg := current[id]
+		change := database.HistoryChange{Name: pkg.Name, Before: pkg.Id, Location: pkg.Location, Reason: pkg.InstallReason}
+		for _, snapshot := range restore {
+			if snapshot.Package.Name == pkg.Name {
+				change.After = snapshot.Package.Id
+			}
+		}
+		if err := RecordChange(change, db); err != nil {
+			fmt.Printf("error: recording history: %s\n", err.Error())
+		}
+	}
+	for _, snapshot := range restore {
+		if slices.ContainsFunc(remove, func(id packet.PackageID) bool { return id.Name() == snapshot.Package.Name }) {
+			continue
+		}
+		change := database.HistoryChange{Name: snapshot.Package.Name, After: snapshot.Package.Id, Location: snapshot.Package.Location, Reason: snapshot.Package.InstallReason}
+		if err := RecordChange(change, db); err != nil {
+			fmt.Printf("error: recording history: %s\n", err.Error())
+		}
+	}
+
+	for _, pkg := range fromCache {
+		fmt.Printf("=> installing %s from its cached package\n", pkg.Id)
+		if err := InstallFromCache(pkg.Id, pkg.Location, pkg.Reason, db); err != nil {
+			return err
+		}
+	}
+
+	for id, pkg := range wanted {
+		if installedPkg, ok := current[id]; ok && installedPkg.InstallReason != pkg.Reason {
+			if err := database.SetInstallReason(string(id), pkg.Reason, db); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var generationsCmd = &cobra.Command{
+	Use:   "generations",
+	Short: "List installed-state generations",
+	Long:  "List the generations that packets rollback can go back to, the newest first",
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		generations, err := database.ListGenerations(db)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		for i, generation := range generations {
+			full, err := database.GetGeneration(generation.Id, db)
+			if err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			current := ""
+			if i == 0 {
+				current = " (current)"
+			}
+			fmt.Printf("\033[1m==> %d\033[0m%s %s\n", generation.Id, current, time.Unix(generation.TimeUnix, 0).Local().Format("01-02-2006 15:04 Monday"))
+			if generation.HistoryId != 0 {
+				fmt.Printf("  \033[1mTransaction:\033[0m %d\n", generation.HistoryId)
+			}
+			fmt.Printf("  \033[1mPackages:\033[0m %d\n", len(full.Packages))
+			fmt.Print("\n")
+		}
+	},
+}
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback [generation]",
+	Short: "Go back to an earlier generation",
+	Long:  "Restore the installed packages of a generation, the one before the current by default",
+	Args:  cobra.MaximumNArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		GrantPrivilegies()
+		return GetConfiguration()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		var id int64
+		if len(args) > 0 {
+			if id, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+				fmt.Printf("error: invalid generation %s\n", args[0])
+				os.Exit(1)
+			}
+		} else {
+			generations, err := database.ListGenerations(db)
+			if err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				os.Exit(1)
+			}
+			if len(generations) < 2 {
+				fmt.Println("no earlier generation to roll back to")
+				os.Exit(1)
+			}
+			id = generations[1].Id
+		}
+
+		generation, err := database.GetGeneration(id, db)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				fmt.Printf("generation %d not found\n", id)
+			} else {
+				fmt.Printf("error: %s\n", err.Error())
+			}
+			os.Exit(1)
+		}
+
+		if err := Rollback(generation, db); err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("=> rolled back to generation %d\n", id)
+	},
+}
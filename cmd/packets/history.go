@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roboogg133/packets/cmd/packets/database"
+	"github.com/roboogg133/packets/pkg/packet.lua.d"
+	"github.com/spf13/cobra"
+)
+
+// every change made by this process goes into a single history entry, created with the first change
+var historyEntryId int64
+
+// RecordChange adds a package change to the history entry of the running command, keeps the payload of
+// what was installed and updates the generation of the entry
+func RecordChange(change database.HistoryChange, db *sql.DB) error {
+	if historyEntryId == 0 {
+		id, err := database.StartHistoryEntry(invokingUser(), strings.Join(os.Args, " "), db)
+		if err != nil {
+			return err
+		}
+		historyEntryId = id
+	}
+	if err := database.RecordHistoryChange(historyEntryId, change, db); err != nil {
+		return err
+	}
+
+	if change.After != "" {
+		if err := SavePayload(packet.PackageID(change.After), db); err != nil {
+			return fmt.Errorf("saving payload of %s: %w", change.After, err)
+		}
+	}
+	return RecordGeneration(db)
+}
+
+// invokingUser is the user that ran packets, looking through sudo
+func invokingUser() string {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return strconv.Itoa(os.Getuid())
+}
+
+// InstallFromCache installs id again from its PackageRootDir entry, downloading it only when that was deleted
+func InstallFromCache(id packet.PackageID, location, reason string, db *sql.DB) error {
+	target := InstallTarget{Id: id, Location: location, Reason: reason}
+
+	if _, err := os.Stat(filepath.Join(target.RootDir(), "Packet.lua")); err != nil {
+		if location == "" || location == LocalLocation {
+			return fmt.Errorf("no cached package for %s", id)
+		}
+		err := FetchPackage(target)
+		_ = ElevatePermission()
+		if err != nil {
+			return err
+		}
+	}
+
+	return InstallPackage(target, db)
+}
+
+// UndoHistoryEntry reverts every change of entry, the newest change first
+func UndoHistoryEntry(entry database.HistoryEntry, db *sql.DB) error {
+	changes := slices.Clone(entry.Changes)
+	slices.Reverse(changes)
+
+	for _, change := range changes {
+		if change.After != "" {
+			if installed, err := database.SearchIfIsInstalled(change.After, db); err != nil {
+				return err
+			} else if installed {
+				id := packet.PackageID(change.After)
+				_, blocked, err := RemovalOrder([]packet.PackageID{id}, false, db)
+				if err != nil {
+					return err
+				}
+				if dependents, ok := blocked[id]; ok {
+					return fmt.Errorf("can't remove %s, it is needed by %s", id, joinIds(dependents))
+				}
+
+				fmt.Printf("=> removing %s\n", id)
+				if err := RemovePackage(id, db); err != nil {
+					return err
+				}
+			}
+		}
+
+		if change.Before != "" {
+			if installed, err := database.SearchIfIsInstalled(change.Name, db); err != nil {
+				return err
+			} else if installed {
+				fmt.Printf("=> %s is installed again already, skipping %s\n", change.Name, change.Before)
+				continue
+			}
+
+			fmt.Printf("=> installing %s\n", change.Before)
+			if err := InstallFromCache(packet.PackageID(change.Before), change.Location, change.Reason, db); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func describeChange(change database.HistoryChange) string {
+	switch change.Action() {
+	case database.ChangeInstall:
+		return "+ " + change.After
+	case database.ChangeRemove:
+		return "- " + change.Before
+	}
+	return "~ " + change.Before + " -> " + change.After
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "List install and remove transactions",
+	Long:  "List every transaction that installed, removed or upgraded packages, the newest first",
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		entries, err := database.ListHistory(db)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		if len(entries) == 0 {
+			fmt.Println("no transactions recorded")
+			return
+		}
+
+		for _, entry := range entries {
+			fmt.Printf("\033[1m==> %d\033[0m %s by %s\n", entry.Id, time.Unix(entry.TimeUnix, 0).Local().Format("01-02-2006 15:04 Monday"), entry.User)
+			fmt.Printf("  \033[2m%s\033[0m\n", entry.Command)
+			for _, change := range entry.Changes {
+				fmt.Printf("  %s\n", describeChange(change))
+			}
+			fmt.Print("\n")
+		}
+	},
+}
+
+var historyUndoCmd = &cobra.Command{
+	Use:   "undo {transaction}",
+	Short: "Revert a transaction",
+	Long:  "Revert a transaction, removing what it installed and installing again what it removed from the cached packages",
+	Args:  cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		GrantPrivilegies()
+		return GetConfiguration()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			fmt.Printf("error: invalid transaction %s\n", args[0])
+			os.Exit(1)
+		}
+
+		db, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		entry, err := database.GetHistoryEntry(id, db)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				fmt.Printf("transaction %d not found\n", id)
+			} else {
+				fmt.Printf("error: %s\n", err.Error())
+			}
+			os.Exit(1)
+		}
+
+		if err := UndoHistoryEntry(entry, db); err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("=> transaction %d reverted\n", id)
+	},
+}
@@ -0,0 +1,212 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	DefaultConnectTimeoutSeconds  = 30
+	DefaultResponseTimeoutSeconds = 60
+)
+
+// Config is the [HTTP] table of config.toml, shared by sync, .pkt and source downloads
+type Config struct {
+	// Proxy is used for every request, empty uses HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	Proxy string `toml:"Proxy"`
+	// NoProxy lists the hosts reached directly when Proxy is set, in the NO_PROXY format
+	NoProxy string `toml:"NoProxy"`
+
+	// CAFiles are PEM bundles trusted on top of the system certificates
+	CAFiles []string `toml:"CAFiles"`
+
+	// Netrc is the .netrc file credentials are read from, empty tries $NETRC and then ~/.netrc
+	Netrc string `toml:"Netrc"`
+
+	UserAgent string `toml:"UserAgent"`
+
+	// ConnectTimeoutSeconds limits connecting and the TLS handshake, ResponseTimeoutSeconds waiting for the
+	// response headers, 0 means the defaults. TimeoutSeconds limits whole requests and is off by default,
+	// a large source can take as long as it takes
+	ConnectTimeoutSeconds  int `toml:"ConnectTimeoutSeconds"`
+	ResponseTimeoutSeconds int `toml:"ResponseTimeoutSeconds"`
+	TimeoutSeconds         int `toml:"TimeoutSeconds"`
+
+	// Hosts adds headers or credentials to the requests sent to a host, keyed by host name
+	Hosts map[string]HostConfig `toml:"Hosts"`
+}
+
+// HostConfig is what is added to the requests sent to a host, headers and credentials are only sent over https
+// and never follow a redirect to another host
+type HostConfig struct {
+	Headers map[string]string `toml:"Headers"`
+	// Token is sent as "Authorization: Bearer {Token}", it wins over Username and Password
+	Token    string `toml:"Token"`
+	Username string `toml:"Username"`
+	Password string `toml:"Password"`
+	// ClientCert and ClientKey are the PEM files of a certificate presented to the host, the key may be in ClientCert
+	ClientCert string `toml:"ClientCert"`
+	ClientKey  string `toml:"ClientKey"`
+}
+
+func (h HostConfig) hasCredentials() bool {
+	return h.Token != "" || h.Username != ""
+}
+
+// New builds a client from cfg, the transport adds the user agent, the host headers and credentials to
+// every request, redirects included
+func New(cfg Config) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	connectTimeout := seconds(cfg.ConnectTimeoutSeconds, DefaultConnectTimeoutSeconds)
+	transport.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	transport.ResponseHeaderTimeout = seconds(cfg.ResponseTimeoutSeconds, DefaultResponseTimeoutSeconds)
+
+	if cfg.Proxy != "" {
+		if _, err := url.Parse(cfg.Proxy); err != nil {
+			return nil, fmt.Errorf("invalid proxy %s: %w", cfg.Proxy, err)
+		}
+		proxy := (&httpproxy.Config{HTTPProxy: cfg.Proxy, HTTPSProxy: cfg.Proxy, NoProxy: cfg.NoProxy}).ProxyFunc()
+		transport.Proxy = func(req *http.Request) (*url.URL, error) { return proxy(req.URL) }
+	}
+
+	if len(cfg.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range cfg.CAFiles {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s has no PEM certificates", file)
+			}
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	netrc, err := loadNetrc(cfg.Netrc)
+	if err != nil {
+		return nil, err
+	}
+
+	// a client certificate gets a transport of its own, so it is only presented to its host
+	hostTransports := make(map[string]http.RoundTripper)
+	for host, hostCfg := range cfg.Hosts {
+		if hostCfg.ClientCert == "" {
+			continue
+		}
+		key := hostCfg.ClientKey
+		if key == "" {
+			key = hostCfg.ClientCert
+		}
+		cert, err := tls.LoadX509KeyPair(hostCfg.ClientCert, key)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate of %s: %w", host, err)
+		}
+
+		hostTransport := transport.Clone()
+		if hostTransport.TLSClientConfig == nil {
+			hostTransport.TLSClientConfig = &tls.Config{}
+		}
+		hostTransport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		hostTransports[host] = hostTransport
+	}
+
+	return &http.Client{
+		Transport: &roundTripper{base: transport, hosts: hostTransports, cfg: cfg, netrc: netrc},
+		Timeout:   time.Duration(cfg.TimeoutSeconds) * time.Second,
+	}, nil
+}
+
+func seconds(value, fallback int) time.Duration {
+	if value <= 0 {
+		value = fallback
+	}
+	return time.Duration(value) * time.Second
+}
+
+// loadNetrc reads path, a missing default .netrc is not an error
+func loadNetrc(path string) ([]netrcEntry, error) {
+	explicit := path != ""
+	if !explicit {
+		path = os.Getenv("NETRC")
+		explicit = path != ""
+	}
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+
+	entries, err := readNetrc(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return nil, nil
+	}
+	return entries, err
+}
+
+type roundTripper struct {
+	base  http.RoundTripper
+	hosts map[string]http.RoundTripper
+	cfg   Config
+	netrc []netrcEntry
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not change the request it was given
+	req = req.Clone(req.Context())
+
+	if rt.cfg.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", rt.cfg.UserAgent)
+	}
+
+	host := req.URL.Hostname()
+	secure := strings.EqualFold(req.URL.Scheme, "https")
+	// host headers often carry API keys, they are credentials too
+	hostCfg, ok := rt.cfg.Hosts[host]
+	if ok && secure {
+		for k, v := range hostCfg.Headers {
+			if req.Header.Get(k) == "" {
+				req.Header.Set(k, v)
+			}
+		}
+		if req.Header.Get("Authorization") == "" {
+			switch {
+			case hostCfg.Token != "":
+				req.Header.Set("Authorization", "Bearer "+hostCfg.Token)
+			case hostCfg.Username != "":
+				req.SetBasicAuth(hostCfg.Username, hostCfg.Password)
+			}
+		}
+	}
+
+	// the .netrc is only used for hosts without credentials of their own, and its default entry only over https
+	if !hostCfg.hasCredentials() && req.Header.Get("Authorization") == "" && req.URL.User == nil {
+		if entry, ok := lookupNetrc(rt.netrc, host); ok && entry.login != "" && (entry.machine != "" || secure) {
+			req.SetBasicAuth(entry.login, entry.password)
+		}
+	}
+
+	if transport, ok := rt.hosts[host]; ok {
+		return transport.RoundTrip(req)
+	}
+	return rt.base.RoundTrip(req)
+}
@@ -0,0 +1,87 @@
+package httpclient
+
+import (
+	"os"
+	"strings"
+)
+
+// netrcEntry is a machine of a .netrc file, the default entry has an empty machine
+type netrcEntry struct {
+	machine  string
+	login    string
+	password string
+}
+
+// parseNetrc reads the machine, default, login and password tokens of a .netrc, macdef bodies are skipped
+func parseNetrc(data string) []netrcEntry {
+	var entries []netrcEntry
+	var current *netrcEntry
+
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		for j := 0; j < len(fields); j++ {
+			if strings.HasPrefix(fields[j], "#") {
+				break
+			}
+
+			value := ""
+			if j+1 < len(fields) {
+				value = fields[j+1]
+			}
+			switch fields[j] {
+			case "machine":
+				entries = append(entries, netrcEntry{machine: value})
+				current = &entries[len(entries)-1]
+				j++
+			case "default":
+				entries = append(entries, netrcEntry{})
+				current = &entries[len(entries)-1]
+			case "login":
+				if current != nil {
+					current.login = value
+				}
+				j++
+			case "password":
+				if current != nil {
+					current.password = value
+				}
+				j++
+			case "account":
+				j++
+			case "macdef":
+				// the macro runs until the next empty line
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				j = len(fields)
+			}
+		}
+	}
+	return entries
+}
+
+func readNetrc(path string) ([]netrcEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseNetrc(string(data)), nil
+}
+
+// lookupNetrc returns the entry of host, falling back to the default entry
+func lookupNetrc(entries []netrcEntry, host string) (netrcEntry, bool) {
+	var fallback *netrcEntry
+	for i, entry := range entries {
+		if entry.machine == host {
+			return entry, true
+		}
+		if entry.machine == "" && fallback == nil {
+			fallback = &entries[i]
+		}
+	}
+	if fallback != nil {
+		return *fallback, true
+	}
+	return netrcEntry{}, false
+}
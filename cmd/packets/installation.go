@@ -1,29 +1,466 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
 	"io"
+	"maps"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 
+	"github.com/roboogg133/packets/cmd/packets/database"
+	"github.com/roboogg133/packets/cmd/packets/decompress"
+	"github.com/roboogg133/packets/cmd/packets/lockfile"
+	"github.com/roboogg133/packets/cmd/packets/repo"
+	"github.com/roboogg133/packets/pkg/install"
 	"github.com/roboogg133/packets/pkg/packet.lua.d"
 )
 
-func InstallFiles(instructions []packet.InstallInstruction) error {
+// InstallTarget is a package available in a repository and where it is going to be installed
+type InstallTarget struct {
+	Id       packet.PackageID
+	Location string
+
+	// Prefix relocates every installed file, empty means the live system
+	Prefix string
+	// Reason is recorded as the install_reason of packages installed into the live system
+	Reason string
+	// Flags are the build options recorded in the lockfile of a new package root dir
+	Flags []string
+	// SHA256 is the expected hash of the .pkt, empty accepts whatever the repository serves
+	SHA256 string
+	// Needs are the names of the runtime and build dependencies, the target is skipped when one of them fails
+	Needs []string
+}
+
+func (target InstallTarget) Url() string {
+	return PrefixForLocations + path.Join(strings.Split(target.Location, "/")[0], PrefixForPackages, string(target.Id)+".pkt")
+}
+
+func (target InstallTarget) RootDir() string {
+	return filepath.Join(PackageRootDir, string(target.Id))
+}
+
+// FetchPackage unpacks the .pkt into its PackageRootDir entry, unless the lockfile says it was already done,
+// the .pkt is only downloaded when the cache has no copy of it
+func FetchPackage(target InstallTarget) error {
+	rootdir := target.RootDir()
+	url := target.Url()
+
+	if lf, err := lockfile.Read(filepath.Join(rootdir, LockFileName)); err == nil && lf.Downloaded(url) {
+		if download, _ := lf.FindDownload(url); target.SHA256 != "" && download.SHA256 != target.SHA256 {
+			return fmt.Errorf("%s was downloaded with sha256 %s, expected %s", target.Id, download.SHA256, target.SHA256)
+		}
+		fmt.Printf("=> %s already downloaded\n", target.Id)
+		return nil
+	}
+
+	// the cache belongs to the packets user like the package root dirs
+	_ = ChangeToNoPermission()
+
+	request := DownloadRequest{
+		Urls:  []string{url},
+		Kind:  lockfile.PackageDownload,
+		ByUrl: true,
+		NewRequest: func(url string) (*http.Request, error) {
+			return http.NewRequest("GET", url, nil)
+		},
+	}
+	if target.SHA256 != "" {
+		request.Accepted = []string{target.SHA256}
+	}
+	cached, sum, err := CachedDownload(request)
+	if err != nil {
+		return err
+	}
+
+	pkt, err := os.Open(cached)
+	if err != nil {
+		return err
+	}
+	defer pkt.Close()
+
+	_ = os.MkdirAll(rootdir, 0755)
+	if err := decompress.Decompress(pkt, rootdir, string(target.Id)+".pkt"); err != nil {
+		return err
+	}
+
+	lockFile, err := OpenLockFile(rootdir, target.Flags)
+	if err != nil {
+		return err
+	}
+
+	lockFile.Location, lockFile.Prefix, lockFile.Reason = target.Location, target.Prefix, target.Reason
+	lockFile.RecordDownload(lockfile.Download{Url: url, Kind: lockfile.PackageDownload, SHA256: sum})
+	return lockFile.Save()
+}
+
+// InstallPackage runs build() and install() of a fetched package and copies the result into the system or the target prefix
+func InstallPackage(target InstallTarget, db *sql.DB) error {
+	if target.Prefix == "" {
+		if installed, err := database.SearchIfIsInstalled(string(target.Id), db); err != nil {
+			return err
+		} else if installed {
+			fmt.Printf("=> package %s is already installed\n", target.Id)
+			return nil
+		}
+	}
+
+	rootdir := target.RootDir()
+	configs := &packet.Config{
+		BinDir:     Config.BinDir,
+		RootDir:    rootdir,
+		SourcesDir: filepath.Join(rootdir, "src"),
+	}
+
+	backupDir, _ := filepath.Abs(".")
+	defer os.Chdir(backupDir)
+
+	_ = ChangeToNoPermission()
+
+	lockFile, err := OpenLockFile(rootdir, target.Flags)
+	if err != nil {
+		_ = ElevatePermission()
+		return err
+	}
+
+	if lockFile.TargetOS != runtime.GOOS || lockFile.TargetArch != runtime.GOARCH {
+		_ = ElevatePermission()
+		return fmt.Errorf("mismatched package target plataform %s/%s", lockFile.TargetOS, lockFile.TargetArch)
+	}
+	lockFile.Location, lockFile.Prefix, lockFile.Reason = target.Location, target.Prefix, target.Reason
+	// a package installed again from its cached directory is incomplete until it is registered again
+	lockFile.Completed = nil
+
+	fileContent, err := os.ReadFile(filepath.Join(rootdir, "Packet.lua"))
+	if err != nil {
+		_ = ElevatePermission()
+		return err
+	}
+
+	pkg, err := packet.ReadPacket(fileContent, configs)
+	if err != nil {
+		_ = ElevatePermission()
+		return err
+	}
+	// install() closes the Lua state, this closes it when something fails before
+	defer pkg.Close()
+
+	_ = os.MkdirAll(configs.SourcesDir, 0755)
+	if err := DownloadSource(&pkg.GlobalSources, configs, lockFile); err != nil {
+		_ = ElevatePermission()
+		return err
+	}
+	patches := pkg.GlobalPatches
+	if plataform, exists := pkg.Plataforms[packet.OperationalSystem(runtime.GOOS)]; exists {
+		if err := DownloadSource(&plataform.Sources, configs, lockFile); err != nil {
+			_ = ElevatePermission()
+			return err
+		}
+		patches = append(patches, plataform.Patches...)
+	}
+	if err := ApplyPatches(patches, configs, lockFile); err != nil {
+		_ = ElevatePermission()
+		return err
+	}
+
+	configs.Env = BuildEnv(pkg, db)
+
+	// what build() asked to install is kept in the lockfile, without it the build runs again
+	if lockFile.Succeeded(lockfile.BuildPhase) && RestoreBuildOutput(&pkg, lockFile) {
+		fmt.Printf("==> %s already built\n", target.Id)
+	} else if err := RunPhase(lockfile.BuildPhase, &pkg, configs, lockFile); err != nil {
+		_ = ElevatePermission()
+		return err
+	}
+
+	if err := RunPhase(lockfile.InstallPhase, &pkg, configs, lockFile); err != nil {
+		_ = ElevatePermission()
+		return err
+	}
+
+	// destinations are recorded before copying, so abort can roll back a copy that was interrupted
+	if err := RecordInstalledPaths(lockFile, InstructionPaths(pkg.InstallInstructions, target.Prefix)); err != nil {
+		_ = ElevatePermission()
+		return err
+	}
+	_ = ElevatePermission()
+
+	createdDirs, err := InstallFiles(pkg.InstallInstructions, target.Prefix)
+	if err != nil {
+		return err
+	}
+
+	if target.Prefix != "" {
+		err = database.MarkAsBuildPackage(pkg, target.Location, target.Prefix, db)
+	} else {
+		var owned []packet.InstallInstruction
+		var files []install.BasicFileStatus
+		if owned, err = OwnedInstructions(pkg.InstallInstructions, createdDirs, target.Id, db); err == nil {
+			files, err = FileStatuses(owned)
+		}
+		if err == nil {
+			err = database.MarkAsInstalled(pkg, files, pkg.Flags, db, nil, 0, target.Location, target.Reason)
+		}
+		if err == nil {
+			change := database.HistoryChange{Name: pkg.Name, After: string(target.Id), Location: target.Location, Reason: target.Reason}
+			if historyErr := RecordChange(change, db); historyErr != nil {
+				fmt.Printf("error: recording history: %s\n", historyErr.Error())
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// the package root dir belongs to the packets user, keep the lockfile owned by it too
+	_ = ChangeToNoPermission()
+	lockFile.MarkCompleted()
+	err = RecordInstalledPaths(lockFile, append(InstructionPaths(pkg.InstallInstructions, target.Prefix), createdDirs...))
+	_ = ElevatePermission()
+	return err
+}
+
+// DependencyQueue puts the solved dependencies before targets: build dependencies go to their own prefix first,
+// runtime dependencies before who needs them
+func DependencyQueue(targets []InstallTarget, depsMap map[string]map[string]repo.DependencyStatus, sourceDB *sql.DB) ([]InstallTarget, error) {
+	var queue []InstallTarget
+	for _, name := range slices.Sorted(maps.Keys(depsMap["build"])) {
+		dep := depsMap["build"][name]
+		queue = append(queue, BuildDependencyTarget(dep.Id, dep.Location))
+	}
+	for _, name := range slices.Sorted(maps.Keys(depsMap["runtime"])) {
+		dep := depsMap["runtime"][name]
+		queue = append(queue, InstallTarget{Id: dep.Id, Location: dep.Location, Reason: database.ReasonDependency})
+	}
+	return OrderQueue(append(queue, targets...), sourceDB)
+}
+
+// OrderQueue fills in what every target of queue needs and sorts it so each one comes after the queued packages
+// it depends on, whether they go to the live system or to a build prefix. Packages in a dependency cycle keep
+// their order
+func OrderQueue(queue []InstallTarget, sourceDB *sql.DB) ([]InstallTarget, error) {
+	byName := make(map[string][]int)
+	for i := range queue {
+		needs, err := repo.DependencyNames(queue[i].Id, sourceDB)
+		if err != nil {
+			return nil, err
+		}
+		queue[i].Needs = needs
+		byName[queue[i].Id.Name()] = append(byName[queue[i].Id.Name()], i)
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make([]int, len(queue))
+	ordered := make([]InstallTarget, 0, len(queue))
+	var visit func(i int)
+	visit = func(i int) {
+		if state[i] != 0 {
+			return
+		}
+		state[i] = visiting
+		for _, name := range queue[i].Needs {
+			for _, j := range byName[name] {
+				visit(j)
+			}
+		}
+		state[i] = done
+		ordered = append(ordered, queue[i])
+	}
+	for i := range queue {
+		visit(i)
+	}
+	return ordered, nil
+}
+
+func BuildDependencyTarget(id packet.PackageID, location string) InstallTarget {
+	return InstallTarget{Id: id, Location: location, Prefix: filepath.Join(PackageBuildDepsFS, string(id))}
+}
+
+// InstallQueue downloads every package of queue in parallel and installs them in order, skipping the ones that
+// need a package that failed. It reports if every package was installed
+func InstallQueue(queue []InstallTarget, db *sql.DB) bool {
+	fetched := make([]bool, len(queue))
+	var wg sync.WaitGroup
+	for i, target := range queue {
+		wg.Go(func() {
+			fmt.Printf("[%d/%d] Downloading %s\n", i+1, len(queue), target.Id)
+			if err := FetchPackage(target); err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				return
+			}
+			fetched[i] = true
+		})
+	}
+	wg.Wait()
+
+	// a package is never installed without its dependencies, what needs a failed one fails too
+	failed := make(map[string]bool)
+	for i, target := range queue {
+		if missing := slices.IndexFunc(target.Needs, func(name string) bool { return failed[name] }); missing >= 0 {
+			fmt.Printf("error: skipped %s, its dependency %s was not installed\n", target.Id, target.Needs[missing])
+			failed[target.Id.Name()] = true
+			continue
+		}
+		if !fetched[i] {
+			failed[target.Id.Name()] = true
+			continue
+		}
+		fmt.Printf("[%d/%d] Installing %s\n", i+1, len(queue), target.Id)
+		if err := InstallPackage(target, db); err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			failed[target.Id.Name()] = true
+		}
+	}
+	return len(failed) == 0
+}
+
+// BuildEnv exposes the build packages a recipe depends on to build() and install() through PATH and friends
+func BuildEnv(pkg packet.PacketLua, db *sql.DB) []string {
+	var prefixes []string
+	for name := range pkg.BuildDependencies() {
+		prefix, err := database.GetBuildPackagePrefix(name, db)
+		if err != nil {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+	slices.Sort(prefixes)
+
+	var binDirs, libDirs, includeDirs, pkgConfigDirs []string
+	for _, prefix := range prefixes {
+		for _, dir := range []string{Config.BinDir, "/usr/bin", "/bin", "/usr/local/bin"} {
+			if dir = filepath.Join(prefix, dir); !slices.Contains(binDirs, dir) {
+				binDirs = append(binDirs, dir)
+			}
+		}
+		for _, dir := range []string{"/usr/lib", "/usr/lib64", "/lib", "/lib64", "/usr/local/lib"} {
+			libDirs = append(libDirs, filepath.Join(prefix, dir))
+			pkgConfigDirs = append(pkgConfigDirs, filepath.Join(prefix, dir, "pkgconfig"))
+		}
+		includeDirs = append(includeDirs, filepath.Join(prefix, "/usr/include"), filepath.Join(prefix, "/usr/local/include"))
+		pkgConfigDirs = append(pkgConfigDirs, filepath.Join(prefix, "/usr/share/pkgconfig"))
+	}
+
+	return []string{
+		"PATH=" + joinPathList(binDirs, os.Getenv("PATH")),
+		"LD_LIBRARY_PATH=" + joinPathList(libDirs, os.Getenv("LD_LIBRARY_PATH")),
+		"LIBRARY_PATH=" + joinPathList(libDirs, os.Getenv("LIBRARY_PATH")),
+		"C_INCLUDE_PATH=" + joinPathList(includeDirs, os.Getenv("C_INCLUDE_PATH")),
+		"CPLUS_INCLUDE_PATH=" + joinPathList(includeDirs, os.Getenv("CPLUS_INCLUDE_PATH")),
+		"PKG_CONFIG_PATH=" + joinPathList(pkgConfigDirs, os.Getenv("PKG_CONFIG_PATH")),
+		"PACKETS_BUILD_PREFIXES=" + joinPathList(prefixes, ""),
+	}
+}
+
+func joinPathList(dirs []string, existing string) string {
+	if existing != "" {
+		dirs = append(dirs, existing)
+	}
+	return strings.Join(dirs, string(os.PathListSeparator))
+}
+
+// InstallFiles copies every instruction destination, relocated under prefix when it is not empty. It returns
+// the parent directories that did not exist before, so the package can own them and remove them later
+func InstallFiles(instructions []packet.InstallInstruction, prefix string) ([]string, error) {
+	var created []string
+	recordMissing := func(dir string) {
+		for ; dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			if _, err := os.Lstat(dir); err == nil {
+				return
+			}
+			if !slices.Contains(created, dir) {
+				created = append(created, dir)
+			}
+		}
+	}
 
 	for _, v := range instructions {
+		destination := v.Destination
+		if prefix != "" {
+			destination = filepath.Join(prefix, destination)
+		}
 
 		if v.IsDir {
-			if err := os.MkdirAll(v.Destination, v.FileMode); err != nil {
-				return err
+			recordMissing(destination)
+			if err := os.MkdirAll(destination, v.FileMode.Perm()); err != nil {
+				return created, err
 			}
 		} else {
-			if err := copyFile(v.Source, v.Destination); err != nil {
-				return err
+			recordMissing(filepath.Dir(destination))
+			if err := copyFile(v.Source, destination); err != nil {
+				return created, err
 			}
 		}
 	}
 
-	return nil
+	return created, nil
+}
+
+// OwnedInstructions are the entries recorded as owned by id: the files of instructions and the directories
+// InstallFiles created. A directory of the recipe that was already there is only shared when another package
+// owns it, otherwise it belongs to the system and removing id must not delete it
+func OwnedInstructions(instructions []packet.InstallInstruction, createdDirs []string, id packet.PackageID, db *sql.DB) ([]packet.InstallInstruction, error) {
+	created := make([]string, len(createdDirs))
+	for i, dir := range createdDirs {
+		created[i] = filepath.Clean(dir)
+	}
+
+	owned := make([]packet.InstallInstruction, 0, len(instructions)+len(created))
+	for _, v := range instructions {
+		if v.IsDir && !slices.Contains(created, filepath.Clean(v.Destination)) {
+			if owners, err := database.CountOtherOwners(filepath.Clean(v.Destination), id, db); err != nil {
+				return nil, err
+			} else if owners == 0 {
+				continue
+			}
+		}
+		owned = append(owned, v)
+	}
+	for _, dir := range DirInstructions(created) {
+		if !slices.ContainsFunc(owned, func(v packet.InstallInstruction) bool { return filepath.Clean(v.Destination) == dir.Destination }) {
+			owned = append(owned, dir)
+		}
+	}
+	return owned, nil
+}
+
+// DirInstructions turns directories created by InstallFiles into entries recorded as owned by the package
+func DirInstructions(dirs []string) []packet.InstallInstruction {
+	instructions := make([]packet.InstallInstruction, 0, len(dirs))
+	for _, dir := range dirs {
+		instructions = append(instructions, packet.InstallInstruction{
+			IsDir:       true,
+			Destination: dir,
+			FileMode:    os.ModeDir | 0755,
+		})
+	}
+	return instructions
+}
+
+// FileStatuses reads hash, mode, owner, size and link target of every installed destination so it can be verified later
+func FileStatuses(instructions []packet.InstallInstruction) ([]install.BasicFileStatus, error) {
+	statuses := make([]install.BasicFileStatus, 0, len(instructions))
+	for _, v := range instructions {
+		status, err := install.Stat(v.Destination)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
 }
 
 func copyFile(source string, destination string) error {
@@ -43,27 +480,24 @@ func copyFile(source string, destination string) error {
 		return err
 	}
 
-	dst, err := os.Create(destination)
+	// the destination is replaced instead of truncated, so payloads hardlinked to it keep the old content
+	dst, err := os.CreateTemp(filepath.Dir(destination), "."+filepath.Base(destination)+".packets-*")
 	if err != nil {
-		if !os.IsExist(err) {
-			dst, err = os.Open(destination)
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
+		return err
 	}
+	defer os.Remove(dst.Name())
 
-	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
 	if err := dst.Chmod(status.Mode()); err != nil {
+		dst.Close()
 		return err
 	}
-
-	_, err = io.Copy(dst, src)
-	if err != nil {
+	if err := dst.Close(); err != nil {
 		return err
 	}
 
-	return nil
+	return os.Rename(dst.Name(), destination)
 }
@@ -0,0 +1,270 @@
+package lockfile
+
+import (
+	"slices"
+	"time"
+)
+
+// FormatVersion is the version written by this packets, the legacy text format is version 1
+const FormatVersion = 2
+
+const (
+	BuildPhase   = "build"
+	InstallPhase = "install"
+
+	// DownloadPhase and FinishPhase are only reported by StoppedIn, they are not recorded as phases:
+	// downloads have their own entries and finishing is copying the files and registering the package
+	DownloadPhase = "download"
+	FinishPhase   = "finish"
+)
+
+const (
+	StatusRunning = "running"
+	StatusOK      = "ok"
+	StatusFailed  = "failed"
+)
+
+const (
+	PackageDownload = "package"
+	SourceDownload  = "source"
+)
+
+// Lockfile is the packet.lock kept in every package root dir, it records what was already done so an
+// interrupted install can continue where it stopped
+type Lockfile struct {
+	Format         int      `toml:"format"`
+	PacketsVersion string   `toml:"packets_version"`
+	PacketsSerial  int      `toml:"packets_serial"`
+	TargetOS       string   `toml:"target_os"`
+	TargetArch     string   `toml:"target_arch"`
+	FlagsGiven     []string `toml:"flags"`
+
+	// where the package comes from and where it goes, so an interrupted install can be resumed
+	Location string `toml:"location,omitempty"`
+	Prefix   string `toml:"prefix,omitempty"`
+	Reason   string `toml:"reason,omitempty"`
+
+	// Completed is set once the package is registered as installed
+	Completed *time.Time `toml:"completed,omitempty"`
+
+	Downloads []Download `toml:"download,omitempty"`
+	Patches   []Patch    `toml:"patch,omitempty"`
+	Phases    []Phase    `toml:"phase,omitempty"`
+
+	path string
+}
+
+// Download is the .pkt itself or one of the sources of the package
+type Download struct {
+	Url    string    `toml:"url"`
+	Kind   string    `toml:"kind"`
+	SHA256 string    `toml:"sha256,omitempty"`
+	Commit string    `toml:"commit,omitempty"`
+	Time   time.Time `toml:"time"`
+
+	Signature *Signature `toml:"signature,omitempty"`
+}
+
+// Signature is the key a download was verified with
+type Signature struct {
+	Url         string `toml:"url"`
+	Type        string `toml:"type"`
+	Fingerprint string `toml:"fingerprint"`
+	Signer      string `toml:"signer,omitempty"`
+}
+
+// Patch is the result of applying a patch to the sources, a failed one keeps the hunks that did not apply
+type Patch struct {
+	Name   string    `toml:"name"`
+	SHA256 string    `toml:"sha256"`
+	Status string    `toml:"status"`
+	Error  string    `toml:"error,omitempty"`
+	Time   time.Time `toml:"time"`
+}
+
+// Phase is a single run of build() or install(), a phase run again after a failure is appended again
+type Phase struct {
+	Name     string    `toml:"name"`
+	Status   string    `toml:"status"`
+	Started  time.Time `toml:"started"`
+	Finished time.Time `toml:"finished"`
+	Log      string    `toml:"log,omitempty"`
+	Error    string    `toml:"error,omitempty"`
+	Paths    []string  `toml:"paths,omitempty"`
+
+	// Output is what a build() run asked for, a resumed install that skips build() gets it from here. Builds
+	// recorded by older versions have none
+	Output *Output `toml:"output,omitempty"`
+}
+
+// Output is what build() asked for with install() and setflags()
+type Output struct {
+	Instructions []Instruction `toml:"instruction,omitempty"`
+	Flags        []Flag        `toml:"flag,omitempty"`
+}
+
+// Instruction is a file or directory install() copies into the system
+type Instruction struct {
+	Source      string `toml:"source"`
+	Destination string `toml:"destination"`
+	IsDir       bool   `toml:"is_dir,omitempty"`
+	Mode        uint32 `toml:"mode,omitempty"`
+}
+
+// Flag is a flag registered with setflags()
+type Flag struct {
+	Name string `toml:"name"`
+	Path string `toml:"path"`
+	Type string `toml:"type"`
+}
+
+// Path is the file the lockfile is read from and saved to
+func (l *Lockfile) Path() string { return l.path }
+
+// Downloaded reports if url was already downloaded
+func (l *Lockfile) Downloaded(url string) bool {
+	return slices.ContainsFunc(l.Downloads, func(d Download) bool { return d.Url == url })
+}
+
+// FindDownload returns the recorded download of url
+func (l *Lockfile) FindDownload(url string) (Download, bool) {
+	i := slices.IndexFunc(l.Downloads, func(d Download) bool { return d.Url == url })
+	if i < 0 {
+		return Download{}, false
+	}
+	return l.Downloads[i], true
+}
+
+// RecordDownload adds d, replacing an earlier download of the same url
+func (l *Lockfile) RecordDownload(d Download) {
+	if d.Time.IsZero() {
+		d.Time = now()
+	}
+	l.Downloads = slices.DeleteFunc(l.Downloads, func(old Download) bool { return old.Url == d.Url })
+	l.Downloads = append(l.Downloads, d)
+}
+
+// PatchApplied reports if the patch name with sum was applied
+func (l *Lockfile) PatchApplied(name, sum string) bool {
+	return slices.ContainsFunc(l.Patches, func(p Patch) bool {
+		return p.Name == name && p.SHA256 == sum && p.Status == StatusOK
+	})
+}
+
+// RecordPatch adds p, replacing an earlier result of the same patch
+func (l *Lockfile) RecordPatch(p Patch) {
+	if p.Time.IsZero() {
+		p.Time = now()
+	}
+	l.Patches = slices.DeleteFunc(l.Patches, func(old Patch) bool { return old.Name == p.Name })
+	l.Patches = append(l.Patches, p)
+}
+
+// ForgetSources drops the source downloads, so they are downloaded and extracted again
+func (l *Lockfile) ForgetSources() {
+	l.Downloads = slices.DeleteFunc(l.Downloads, func(d Download) bool { return d.Kind == SourceDownload })
+}
+
+// ForgetPatches drops every patch result, the sources they were applied to were downloaded again
+func (l *Lockfile) ForgetPatches() {
+	l.Patches = nil
+}
+
+// StartPhase appends a running phase
+func (l *Lockfile) StartPhase(name, logPath string) {
+	l.Phases = append(l.Phases, Phase{
+		Name:    name,
+		Status:  StatusRunning,
+		Started: now(),
+		Log:     logPath,
+	})
+}
+
+// FinishPhase marks the latest run of name as ok, or failed when phaseErr is not nil
+func (l *Lockfile) FinishPhase(name string, phaseErr error) {
+	phase := l.LastPhase(name)
+	if phase == nil {
+		return
+	}
+	phase.Finished = now()
+	if phaseErr != nil {
+		phase.Status = StatusFailed
+		phase.Error = phaseErr.Error()
+	} else {
+		phase.Status = StatusOK
+	}
+}
+
+// SetPaths records the files the latest run of name put into the system
+func (l *Lockfile) SetPaths(name string, paths []string) {
+	if phase := l.LastPhase(name); phase != nil {
+		phase.Paths = paths
+	}
+}
+
+// SetOutput records what the latest run of name asked for with install() and setflags()
+func (l *Lockfile) SetOutput(name string, output Output) {
+	if phase := l.LastPhase(name); phase != nil {
+		phase.Output = &output
+	}
+}
+
+// LastPhase returns the latest run of name, or nil if it never ran
+func (l *Lockfile) LastPhase(name string) *Phase {
+	for i := len(l.Phases) - 1; i >= 0; i-- {
+		if l.Phases[i].Name == name {
+			return &l.Phases[i]
+		}
+	}
+	return nil
+}
+
+// Succeeded reports if the latest run of name finished without errors
+func (l *Lockfile) Succeeded(name string) bool {
+	phase := l.LastPhase(name)
+	return phase != nil && phase.Status == StatusOK
+}
+
+// InstalledPaths returns every path recorded by all install() runs
+func (l *Lockfile) InstalledPaths() []string {
+	var paths []string
+	for _, phase := range l.Phases {
+		if phase.Name != InstallPhase {
+			continue
+		}
+		for _, p := range phase.Paths {
+			if !slices.Contains(paths, p) {
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
+
+// MarkCompleted records that the package was installed and registered
+func (l *Lockfile) MarkCompleted() {
+	t := now()
+	l.Completed = &t
+}
+
+// StoppedIn returns the phase an unfinished install stopped in and its status, running means the process
+// died in the middle of it and an empty status means it never started
+func (l *Lockfile) StoppedIn() (string, string) {
+	if l.Completed != nil {
+		return "", StatusOK
+	}
+	if n := len(l.Phases); n > 0 && l.Phases[n-1].Status != StatusOK {
+		return l.Phases[n-1].Name, l.Phases[n-1].Status
+	}
+
+	switch {
+	case l.LastPhase(BuildPhase) == nil:
+		return DownloadPhase, ""
+	case !l.Succeeded(InstallPhase):
+		return InstallPhase, ""
+	}
+	return FinishPhase, ""
+}
+
+// timestamps are kept to the second, more precision only makes the file harder to read
+func now() time.Time { return time.Now().UTC().Truncate(time.Second) }
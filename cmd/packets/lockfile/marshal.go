@@ -1,24 +1,56 @@
 package lockfile
 
 import (
-	"fmt"
-	"strings"
+	"os"
+	"path/filepath"
+
+	"github.com/pelletier/go-toml/v2"
 )
 
-func NewLockfile(packetsVersion, targetOS, targetArch string, packetSerial int, flagsGiven []string) string {
+// New returns an empty lockfile that will be saved to path
+func New(path, packetsVersion, targetOS, targetArch string, packetSerial int, flagsGiven []string) *Lockfile {
+	if flagsGiven == nil {
+		flagsGiven = []string{}
+	}
+	return &Lockfile{
+		Format:         FormatVersion,
+		PacketsVersion: packetsVersion,
+		PacketsSerial:  packetSerial,
+		TargetOS:       targetOS,
+		TargetArch:     targetArch,
+		FlagsGiven:     flagsGiven,
+		path:           path,
+	}
+}
 
-	var builder strings.Builder
+func (l *Lockfile) Marshal() ([]byte, error) {
+	l.Format = FormatVersion
+	return toml.Marshal(l)
+}
 
-	builder.WriteString(fmt.Sprintf("PACKETS VERSION %s = SERIAL %d\nTarget Plataform: %s\nTarget Architecture: %s\n", packetsVersion, packetSerial, targetOS, targetArch))
+// Save writes the lockfile next to its path and renames it over, so a reader never sees half of it
+func (l *Lockfile) Save() error {
+	data, err := l.Marshal()
+	if err != nil {
+		return err
+	}
 
-	builder.WriteString("FLAGS: [ ")
-	for _, flag := range flagsGiven {
-		builder.WriteString(flag)
-		builder.WriteRune(' ')
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), "."+filepath.Base(l.path)+"-*")
+	if err != nil {
+		return err
 	}
-	builder.WriteRune(']')
-	builder.WriteString("\n")
-	builder.WriteString("\n")
+	defer os.Remove(tmp.Name())
 
-	return builder.String()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path)
 }
@@ -2,25 +2,16 @@ package lockfile
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
+	"os"
 	"strconv"
 	"strings"
-)
-
-type Lockfile struct {
-	PacketsVersion string
-	PacketsSerial  int
-	Status         string
-	TargetOS       string
-	TargetArch     string
-	FlagsGiven     []string
-	Progress       []Status
-}
 
-type Status struct {
-	Action string
-	Value  string
-}
+	"github.com/pelletier/go-toml/v2"
+)
 
+// prefixes of the legacy text format, only read to migrate old lockfiles
 const (
 	VersionPrefix         = "PACKETS VERSION "
 	TargetPlataformPrefix = "Target Plataform: "
@@ -32,54 +23,126 @@ const (
 	DownloadAction = "download: "
 	BuildAction    = "build: "
 	InstallAction  = "install: "
+	LogAction      = "log: "
 )
 
-func ParseStatus(s string) Lockfile {
+// Read parses the lockfile at path in either format, it is saved back in the current format on the next Save
+func Read(path string) (*Lockfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	l.path = path
+	return l, nil
+}
+
+// Parse reads a TOML lockfile, or a legacy text one when it starts with the old version line
+func Parse(data []byte) (*Lockfile, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(VersionPrefix)) {
+		return ParseLegacy(string(data))
+	}
+
+	var l Lockfile
+	if err := toml.Unmarshal(data, &l); err != nil {
+		return nil, err
+	}
+	if l.Format > FormatVersion {
+		return nil, fmt.Errorf("lockfile format %d is newer than this packets supports (%d)", l.Format, FormatVersion)
+	}
+	if l.Format < 2 {
+		return nil, fmt.Errorf("unknown lockfile format %d", l.Format)
+	}
+	return &l, nil
+}
 
-	lockfile := Lockfile{}
+// ParseLegacy reads the text format written before FormatVersion 2
+func ParseLegacy(s string) (*Lockfile, error) {
+	l := &Lockfile{Format: 1}
 
+	var pendingLog string
 	scanner := bufio.NewScanner(strings.NewReader(s))
-	for scanner.Scan() {
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
 		line := scanner.Text()
 
 		switch {
+		case strings.TrimSpace(line) == "":
 		case strings.HasPrefix(line, VersionPrefix):
-			version := strings.TrimPrefix(line, VersionPrefix)
-			lockfile.PacketsVersion = strings.Split(version, " =")[0]
-
-			lockfile.PacketsSerial, _ = strconv.Atoi(strings.TrimPrefix(strings.Split(version, " = ")[1], "SERIAL "))
-			continue
+			version, serial, found := strings.Cut(strings.TrimPrefix(line, VersionPrefix), " = SERIAL ")
+			if !found {
+				return nil, fmt.Errorf("line %d: malformed version line %q", lineNumber, line)
+			}
+			number, err := strconv.Atoi(strings.TrimSpace(serial))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: malformed serial %q", lineNumber, serial)
+			}
+			l.PacketsVersion = strings.TrimSpace(version)
+			l.PacketsSerial = number
 		case strings.HasPrefix(line, TargetPlataformPrefix):
-			lockfile.TargetOS = strings.TrimPrefix(line, TargetPlataformPrefix)
-			continue
+			l.TargetOS = strings.TrimPrefix(line, TargetPlataformPrefix)
 		case strings.HasPrefix(line, TargetArchPrefix):
-			lockfile.TargetArch = strings.TrimPrefix(line, TargetArchPrefix)
-			continue
+			l.TargetArch = strings.TrimPrefix(line, TargetArchPrefix)
 		case strings.HasPrefix(line, FlagsGivenPrefix):
-			line = strings.TrimPrefix(line, FlagsGivenPrefix)
-			line = strings.TrimSuffix(line, " ]")
-
-			lockfile.FlagsGiven = strings.Fields(line)
-			continue
-		}
-
-		switch {
+			flags := strings.TrimSuffix(strings.TrimPrefix(line, FlagsGivenPrefix), "]")
+			l.FlagsGiven = strings.Fields(flags)
 		case strings.HasPrefix(line, DownloadAction):
-			lockfile.Progress = append(lockfile.Progress, Status{
-				Action: "download",
-				Value:  strings.TrimPrefix(line, DownloadAction),
-			})
+			url := strings.TrimPrefix(line, DownloadAction)
+			kind := SourceDownload
+			if strings.HasSuffix(url, ".pkt") {
+				kind = PackageDownload
+			}
+			l.Downloads = append(l.Downloads, Download{Url: url, Kind: kind})
+		case strings.HasPrefix(line, LogAction):
+			pendingLog = strings.TrimPrefix(line, LogAction)
 		case strings.HasPrefix(line, BuildAction):
-			lockfile.Progress = append(lockfile.Progress, Status{
-				Action: "build",
-				Value:  strings.TrimPrefix(line, BuildAction),
-			})
+			status, ok := legacyStatus(strings.TrimPrefix(line, BuildAction))
+			if !ok {
+				return nil, fmt.Errorf("line %d: unknown build status %q", lineNumber, line)
+			}
+			l.Phases = append(l.Phases, Phase{Name: BuildPhase, Status: status, Log: pendingLog})
+			pendingLog = ""
 		case strings.HasPrefix(line, InstallAction):
-			lockfile.Progress = append(lockfile.Progress, Status{
-				Action: "install",
-				Value:  strings.TrimPrefix(line, InstallAction),
-			})
+			value := strings.TrimPrefix(line, InstallAction)
+			if status, ok := legacyStatus(value); ok {
+				l.Phases = append(l.Phases, Phase{Name: InstallPhase, Status: status, Log: pendingLog})
+				pendingLog = ""
+				continue
+			}
+			// any other value is a path the install put into the system
+			if last := len(l.Phases) - 1; last < 0 || l.Phases[last].Name != InstallPhase || pendingLog != "" {
+				l.Phases = append(l.Phases, Phase{Name: InstallPhase, Status: StatusOK, Log: pendingLog})
+				pendingLog = ""
+			}
+			phase := &l.Phases[len(l.Phases)-1]
+			phase.Paths = append(phase.Paths, value)
+		default:
+			return nil, fmt.Errorf("line %d: unknown entry %q", lineNumber, line)
 		}
 	}
-	return lockfile
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if l.PacketsVersion == "" {
+		return nil, fmt.Errorf("missing %q line", strings.TrimSpace(VersionPrefix))
+	}
+	if l.FlagsGiven == nil {
+		l.FlagsGiven = []string{}
+	}
+	return l, nil
+}
+
+// legacy lockfiles wrote both OK and SUCCESS for a finished phase
+func legacyStatus(value string) (string, bool) {
+	switch strings.TrimSpace(value) {
+	case "OK", "SUCCESS":
+		return StatusOK, true
+	case "FAILED":
+		return StatusFailed, true
+	}
+	return "", false
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/roboogg133/packets/cmd/packets/buildlog"
+	"github.com/roboogg133/packets/cmd/packets/lockfile"
+	"github.com/roboogg133/packets/cmd/packets/oplock"
+	"github.com/spf13/cobra"
+)
+
+var logCmd = &cobra.Command{
+	Use:   "log {name or id}",
+	Short: "Show the build or install log of a package",
+	Long:  "Show the latest build or install log recorded in the package lockfile",
+	Args:  cobra.RangeArgs(1, 1),
+	Run: func(cmd *cobra.Command, args []string) {
+		follow, _ := cmd.Flags().GetBool("follow")
+		phase, _ := cmd.Flags().GetString("phase")
+
+		rootdir, err := FindPackageRootDir(args[0])
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		lockPath := filepath.Join(rootdir, LockFileName)
+		lf, err := lockfile.Read(lockPath)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		var logPath string
+		for _, p := range lf.Phases {
+			if p.Log != "" && (phase == "" || p.Name == phase) {
+				logPath = p.Log
+			}
+		}
+		if logPath == "" {
+			fmt.Printf("no logs recorded for %s\n", filepath.Base(rootdir))
+			os.Exit(1)
+		}
+
+		f, err := os.Open(logPath)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		defer f.Close()
+
+		if !follow {
+			io.Copy(os.Stdout, f)
+			return
+		}
+
+		// keep the end of what was read so the closing line is found even if it arrives split
+		var tail []byte
+		var stopped bool
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := f.Read(buf)
+			if n > 0 {
+				os.Stdout.Write(buf[:n])
+				tail = append(tail, buf[:n]...)
+				if len(tail) > 4096 {
+					tail = tail[len(tail)-4096:]
+				}
+				continue
+			}
+			if err != nil && err != io.EOF {
+				fmt.Printf("error: %s\n", err.Error())
+				os.Exit(1)
+			}
+			if buildlog.IsDone(string(tail)) {
+				return
+			}
+			if stopped {
+				fmt.Println("==> the phase stopped without closing its log")
+				return
+			}
+
+			// a builder that was killed never closes the log, what is left is read once more before stopping
+			stopped = !phaseRunning(lockPath, logPath) || oplock.Free(filepath.Join(HomeDir, oplock.FileName))
+			if !stopped {
+				time.Sleep(500 * time.Millisecond)
+			}
+		}
+	},
+}
+
+// phaseRunning reports if packet.lock still has the phase writing logPath running, packet.lock is replaced
+// atomically so an error only means it is gone
+func phaseRunning(lockPath, logPath string) bool {
+	lf, err := lockfile.Read(lockPath)
+	if err != nil {
+		return false
+	}
+	var running bool
+	for _, p := range lf.Phases {
+		if p.Log == logPath {
+			running = p.Status == lockfile.StatusRunning
+		}
+	}
+	return running
+}
+
+func init() {
+	logCmd.Flags().BoolP("follow", "f", false, "keep printing the log while the phase is running")
+	logCmd.Flags().String("phase", "", "show the log of a specific phase (build or install)")
+}
@@ -2,19 +2,14 @@ package main
 
 import (
 	"archive/tar"
-	"bytes"
 	"database/sql"
 	"fmt"
 	"io"
 	"io/fs"
-	"net/http"
 	"os"
-	"path"
 	"path/filepath"
 	"runtime"
-	"slices"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/klauspost/compress/zstd"
@@ -42,6 +37,12 @@ var rootCmd = &cobra.Command{
 	Use:   "packets",
 	Short: "A tool for managing packets",
 	Long:  "A multiplatform package manager",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if err := AcquireOperationLock(cmd); err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+	},
 }
 
 var executeCmd = &cobra.Command{
@@ -90,18 +91,16 @@ var executeCmd = &cobra.Command{
 				SourcesDir: sourcesdir,
 			}
 
-			db, err := sql.Open("sqlite3", InternalDB)
+			db, err := database.OpenInternal(InternalDB)
 			if err != nil {
-				fmt.Printf("error: %s", err.Error())
+				fmt.Printf("error: %s\n", err.Error())
 				os.Exit(1)
 			}
-			defer db.Close()
-
-			database.PrepareDataBase(db)
 
 			if installed, err := database.SearchIfIsInstalled(pkg.Name, db); err == nil {
 				if installed {
 					fmt.Printf("=> package %s is already installed\n", pkg.Name)
+					pkg.Close()
 					continue
 				}
 			} else {
@@ -119,31 +118,66 @@ var executeCmd = &cobra.Command{
 			}
 			_ = os.MkdirAll(configs.SourcesDir, 0755)
 
-			if err := DownloadSource(&pkg.GlobalSources, configs, nil); err != nil {
+			lockFile, err := OpenLockFile(configs.RootDir, []string{})
+			if err != nil {
+				fmt.Printf("error: %s", err.Error())
+				os.Exit(1)
+			}
+			lockFile.Location, lockFile.Reason = LocalLocation, database.ReasonExplicit
+
+			// execute always starts from fresh sources, the lockfile only records what they turned out to be
+			lockFile.ForgetSources()
+			lockFile.ForgetPatches()
+			if err := DownloadSource(&pkg.GlobalSources, configs, lockFile); err != nil {
 				fmt.Printf("error: %s", err.Error())
 				os.Exit(1)
 			}
 
+			patches := pkg.GlobalPatches
 			if pkg.Plataforms != nil {
 				if plataform, exists := pkg.Plataforms[packet.OperationalSystem(runtime.GOOS)]; exists {
-					if err := DownloadSource(&plataform.Sources, configs, nil); err != nil {
+					if err := DownloadSource(&plataform.Sources, configs, lockFile); err != nil {
 						fmt.Printf("error: %s", err.Error())
 						os.Exit(1)
 					}
+					patches = append(patches, plataform.Patches...)
 				}
 			}
+
+			if err := ApplyPatches(patches, configs, lockFile); err != nil {
+				_ = ElevatePermission()
+				os.Chdir(backupDir)
+				fmt.Printf("error: %s\n", err.Error())
+				pkg.Close()
+				continue
+			}
 			if err != nil {
 				fmt.Printf("error: %s", err.Error())
 				os.Exit(1)
 			}
 
-			pkg.ExecuteBuild(configs)
-			pkg.ExecuteInstall(configs)
+			if err := RunPhase(lockfile.BuildPhase, &pkg, configs, lockFile); err != nil {
+				_ = ElevatePermission()
+				os.Chdir(backupDir)
+				fmt.Printf("error: %s\n", err.Error())
+				continue
+			}
+			if err := RunPhase(lockfile.InstallPhase, &pkg, configs, lockFile); err != nil {
+				_ = ElevatePermission()
+				os.Chdir(backupDir)
+				fmt.Printf("error: %s\n", err.Error())
+				continue
+			}
+			if err := RecordInstalledPaths(lockFile, InstructionPaths(pkg.InstallInstructions, "")); err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				os.Exit(1)
+			}
 			_ = ElevatePermission()
 
 			os.Chdir(backupDir)
 
-			if err := InstallFiles(pkg.InstallInstructions); err != nil {
+			createdDirs, err := InstallFiles(pkg.InstallInstructions, "")
+			if err != nil {
 				fmt.Printf("error: %s", err.Error())
 				os.Exit(1)
 			}
@@ -152,10 +186,35 @@ var executeCmd = &cobra.Command{
 				fmt.Printf("(%s) -> (%s) IsDir? %t\n", instruction.Source, instruction.Destination, instruction.IsDir)
 			}
 
-			if err := database.MarkAsInstalled(pkg, pkg.InstallInstructions, pkg.Flags, db, nil, 0); err != nil {
+			owned, err := OwnedInstructions(pkg.InstallInstructions, createdDirs, packet.PackageID(pkg.Name+"@"+pkg.Version), db)
+			if err != nil {
+				fmt.Printf("error: %s", err.Error())
+				os.Exit(1)
+			}
+			files, err := FileStatuses(owned)
+			if err != nil {
+				fmt.Printf("error: %s", err.Error())
+				os.Exit(1)
+			}
+
+			if err := database.MarkAsInstalled(pkg, files, pkg.Flags, db, nil, 0, LocalLocation, database.ReasonExplicit); err != nil {
 				fmt.Printf("error: %s", err.Error())
 				os.Exit(1)
 			}
+
+			change := database.HistoryChange{Name: pkg.Name, After: pkg.Name + "@" + pkg.Version, Location: LocalLocation, Reason: database.ReasonExplicit}
+			if err := RecordChange(change, db); err != nil {
+				fmt.Printf("error: recording history: %s\n", err.Error())
+			}
+
+			_ = ChangeToNoPermission()
+			lockFile.MarkCompleted()
+			err = RecordInstalledPaths(lockFile, append(InstructionPaths(pkg.InstallInstructions, ""), createdDirs...))
+			_ = ElevatePermission()
+			if err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				os.Exit(1)
+			}
 		}
 	},
 }
@@ -163,21 +222,24 @@ var executeCmd = &cobra.Command{
 var removeCmd = &cobra.Command{
 	Use:   "remove {name or id}",
 	Short: "Removes a package from the system",
-	Long:  "Removes a package from the system",
+	Long:  "Removes a package from the system, refusing to break packages that depend on it",
 	Args:  cobra.MinimumNArgs(1),
-	PreRun: func(cmd *cobra.Command, args []string) {
+	PreRunE: func(cmd *cobra.Command, args []string) error {
 		GrantPrivilegies()
+		// every removal records a generation, old ones are pruned with the retention of config.toml
+		return GetConfiguration()
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		for _, arg := range args {
+		cascade, _ := cmd.Flags().GetBool("cascade")
 
-			db, err := sql.Open("sqlite3", InternalDB)
-			if err != nil {
-				fmt.Printf("error: %s\n", err.Error())
-				os.Exit(1)
-			}
-			defer db.Close()
+		db, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
 
+		var requested []packet.PackageID
+		for _, arg := range args {
 			id, err := database.GetPackageId(arg, db)
 			if err != nil {
 				if err == sql.ErrNoRows {
@@ -187,27 +249,25 @@ var removeCmd = &cobra.Command{
 				fmt.Printf("error: %s\n", err.Error())
 				continue
 			}
+			requested = append(requested, id)
+		}
 
-			files, err := database.GetPackageFiles(id, db)
-			if err != nil {
-				fmt.Printf("error: %s\n", err.Error())
-				continue
-			}
+		order, blocked, err := RemovalOrder(requested, cascade, db)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
 
-			for _, file := range files {
-				if !file.IsDir {
-					if err := os.Remove(file.Filepath); err != nil {
-						fmt.Printf("error: %s\n", err.Error())
-						continue
-					}
-				}
-			}
+		for id, dependents := range blocked {
+			fmt.Printf("error: can't remove %s, required by %s (use --cascade to remove them too)\n", id, joinIds(dependents))
+		}
 
-			if err := database.MarkAsUninstalled(id, db); err != nil {
-				fmt.Printf("error removing package from database but successfully removed it from the system: %s\n", err.Error())
+		for _, id := range order {
+			if err := RemovePackage(id, db); err != nil {
+				fmt.Printf("error: %s\n", err.Error())
 				continue
 			}
-
+			fmt.Printf("=> removed %s\n", id)
 		}
 	},
 }
@@ -236,6 +296,8 @@ var packCmd = &cobra.Command{
 				fmt.Printf("error: %s\n", err.Error())
 				continue
 			}
+			// only the name and version are needed
+			packet.Close()
 
 			packageFile, err := os.OpenFile(packet.Name+"@"+packet.Version+".pkt", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 			if err != nil {
@@ -300,11 +362,11 @@ var listCmd = &cobra.Command{
 	Short: "List all installed packages",
 	Long:  "List all installed packages",
 	Run: func(cmd *cobra.Command, args []string) {
-		db, err := sql.Open("sqlite3", InternalDB)
+		db, err := database.OpenInternal(InternalDB)
 		if err != nil {
-			panic(err)
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
 		}
-		database.PrepareDataBase(db)
 
 		pkgs, err := database.ListAllInstalledPackages(db)
 		if err != nil {
@@ -318,6 +380,7 @@ var listCmd = &cobra.Command{
 			fmt.Printf("  \033[1mVerified:\033[0m %v\n", pkg.Verified)
 			fmt.Printf("  \033[1mDescription:\033[0m %s\n", pkg.Description)
 			fmt.Printf("  \033[1mRepository:\033[0m %s\n", pkg.Location)
+			fmt.Printf("  \033[1mInstall reason:\033[0m %s\n", pkg.InstallReason)
 			if pkg.UploadTimeUnix == pkg.InstalledTimeUnix {
 				fmt.Printf("  \033[1mInstalled timestamp:\033[0m %s\n", time.Unix(pkg.InstalledTimeUnix, 0).UTC().Local().Format("01-02-2006 15:04 Monday"))
 			} else {
@@ -340,26 +403,28 @@ var installCmd = &cobra.Command{
 		return GetConfiguration()
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		sourceDB, err := sql.Open("sqlite3", SourceDB)
+		sourceDB, err := database.OpenSource(SourceDB)
 		if err != nil {
-			panic(err)
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
 		}
-		defer sourceDB.Close()
 
-		internalDB, err := sql.Open("sqlite3", InternalDB)
+		internalDB, err := database.OpenInternal(InternalDB)
 		if err != nil {
-			panic(err)
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
 		}
-		defer internalDB.Close()
 
 		depsMap := make(map[string]map[string]repo.DependencyStatus)
-		var info database.SDBPkg
-		var download []string
+		var targets []InstallTarget
 		for _, arg := range args {
 
 			if installed, err := database.SearchIfIsInstalled(arg, internalDB); err == nil {
 				if installed {
 					fmt.Printf("=> package %s is already installed\n", arg)
+					if err := database.SetInstallReason(arg, database.ReasonExplicit, internalDB); err != nil {
+						fmt.Printf("error: %s\n", err.Error())
+					}
 					continue
 				}
 			} else {
@@ -367,7 +432,7 @@ var installCmd = &cobra.Command{
 				os.Exit(1)
 			}
 
-			info, err = database.RetrievePackageInformation(arg, "", sourceDB)
+			info, err := database.RetrievePackageInformation(arg, "", sourceDB)
 			if err != nil {
 				fmt.Println(err)
 				continue
@@ -376,209 +441,18 @@ var installCmd = &cobra.Command{
 				fmt.Printf("error: package %s not found\n", arg)
 				continue
 			}
-			download = append(download, PrefixForLocations+path.Join(strings.Split(info.Location, "/")[0], PrefixForPackages, string(info.Id)+".pkt"))
+			targets = append(targets, InstallTarget{Id: packet.PackageID(info.Id), Location: info.Location, Reason: database.ReasonExplicit})
 			if err := repo.SolveDeps(packet.PackageID(info.Id), "", internalDB, sourceDB, &depsMap); err != nil {
 				panic(err)
 			}
-			for _, dep := range depsMap["build"] {
-				strings.Split(dep.Location, "/")
-				download = append(download, PrefixForLocations+path.Join(strings.Split(dep.Location, "/")[0], PrefixForPackages, string(info.Id)+".pkt"))
-			}
-			for _, dep := range depsMap["runtime"] {
-				strings.Split(dep.Location, "/")
-				download = append(download, PrefixForLocations+filepath.Join(strings.Split(dep.Location, "/")[0], PrefixForPackages, string(info.Id)+".pkt"))
-			}
 		}
 
-		var wg sync.WaitGroup
-		for i, url := range download {
-			wg.Go(func() {
-				fmt.Printf("[%d/%d] Downloading package\n", i+1, len(download))
-
-				pkgID := packet.PackageID(path.Base(url))
-
-				emptyReader := bytes.NewReader([]byte{})
-				data := io.NopCloser(emptyReader)
-
-				rootdir, err := filepath.Abs(filepath.Join(PackageRootDir, strings.TrimSuffix(string(pkgID), ".pkt")))
-				if err != nil {
-					fmt.Printf("error: %s", err.Error())
-					os.Exit(1)
-				}
-
-				if _, err := os.Stat(rootdir); err != nil {
-					if os.IsNotExist(err) {
-						resp, err := http.Get(url)
-						if err != nil {
-							fmt.Println(err)
-							return
-						}
-						data = resp.Body
-					}
-				} else {
-					fmt.Printf("=> Packet directory already exists checking if %s exists\n", LockFileName)
-					_, err := os.Stat(filepath.Join(rootdir, LockFileName))
-					if err != nil {
-						if os.IsNotExist(err) {
-							fmt.Printf("==> Packet directory don't have %s, the installation might be corrupted or incomplete\n", LockFileName)
-							resp, err := http.Get(url)
-							if err != nil {
-								fmt.Println(err)
-								return
-							}
-							data = resp.Body
-						}
-					} else {
-						f, err := os.ReadFile(filepath.Join(rootdir, LockFileName))
-						if err != nil {
-							fmt.Printf("error: %s", err.Error())
-							os.Exit(1)
-						}
-						lf := lockfile.ParseStatus(string(f))
-
-						if !slices.Contains(lf.Progress, lockfile.Status{Action: "download", Value: url}) {
-							resp, err := http.Get(url)
-							if err != nil {
-								fmt.Println(err)
-								return
-							}
-							data = resp.Body
-						}
-					}
-				}
-
-				sourcesdir, err := filepath.Abs(filepath.Join(rootdir, "src"))
-				if err != nil {
-					fmt.Printf("error: %s", err.Error())
-					os.Exit(1)
-				}
-				configs := &packet.Config{
-					BinDir:     Config.BinDir,
-					RootDir:    rootdir,
-					SourcesDir: sourcesdir,
-				}
-
-				db, err := sql.Open("sqlite3", InternalDB)
-				if err != nil {
-					fmt.Printf("error: %s", err.Error())
-					os.Exit(1)
-				}
-				defer db.Close()
-
-				database.PrepareDataBase(db)
-
-				if installed, err := database.SearchIfIsInstalled(pkgID.Name(), db); err == nil {
-					if installed {
-						fmt.Printf("=> package %s is already installed\n", pkgID.Name())
-						return
-					}
-				} else {
-					fmt.Printf("error: %s", err.Error())
-					os.Exit(1)
-				}
-
-				// backupDir, err := filepath.Abs(".")
-				_ = ChangeToNoPermission()
-				_ = os.MkdirAll(configs.RootDir, 0755)
-
-				if err := decompress.Decompress(data, configs.RootDir, string(pkgID)); err != nil {
-					fmt.Printf("error: %s", err.Error())
-					os.Exit(1)
-				}
-				lockFile, err := os.OpenFile(filepath.Join(rootdir, LockFileName), os.O_CREATE|os.O_RDWR, 0644)
-				if err != nil {
-					fmt.Printf("error: %s", err.Error())
-					os.Exit(1)
-				}
-				defer lockFile.Close()
-
-
-			
-				lockContent, err :=  io.ReadAll(lockFile)
-				if err != nil {
-					panic(err)
-				}
-
-				lf := lockfile.ParseStatus(string(lockContent))
-				
-				
-				
-
-				if len(lockContent) == 0 {	
-						_, err = lockFile.WriteString(lockfile.NewLockfile(PacketsVersion, runtime.GOOS, runtime.GOARCH, PacketsSerial, []string{}))
-					if err != nil {
-						fmt.Printf("error: %s", err.Error())
-						os.Exit(1)
-					}
-					lockFile.Seek(0, io.SeekStart)
-					lockContent, err = io.ReadAll(lockFile)
-					if err != nil {
-						panic(err)
-					}
-					lf = lockfile.ParseStatus(string(lockContent))
-					
-
-				}
-				if !slices.Contains(lf.Progress, lockfile.Status{Action: "download", Value: url}) {
-					lockFile.WriteString("download: " + url + "\n")
-				}
-				
-				if lf.TargetOS != runtime.GOOS {
-					fmt.Println("==> FATAL: mismatched package target plataform")
-					return 
-				}
-				if lf.TargetArch != runtime.GOARCH {
-					fmt.Println("==> FATAL: architeture")
-
-				}
-
-				
-				_ = os.MkdirAll(configs.SourcesDir, 0755)
-
-				fileContent, err := os.ReadFile(filepath.Join(rootdir, "Packet.lua"))
-				if err != nil { fmt.Printf("error: %s", err.Error())
-					os.Exit(1)
-				}
-
-				pkg, err := packet.ReadPacket(fileContent, configs)
-				if err != nil {
-					fmt.Printf("error: %s", err.Error())
-					os.Exit(1)
-				}
-
-				lockFile.Seek(0, io.SeekStart)
-				if err := DownloadSource(&pkg.GlobalSources, configs, lockFile); err != nil {
-					fmt.Printf("error: %s", err.Error())
-					os.Exit(1)
-				}
-
-				if pkg.Plataforms != nil {
-					if plataform, exists := pkg.Plataforms[packet.OperationalSystem(runtime.GOOS)]; exists {
-						if err := DownloadSource(&plataform.Sources, configs, lockFile); err != nil {
-							fmt.Printf("error: %s", err.Error())
-							os.Exit(1)
-						}
-					}
-				}
-				lockFile.Seek(0, io.SeekStart)
-				lockContent, err = io.ReadAll(lockFile)
-				if err != nil {
-					panic(err)
-				}
-				lf = lockfile.ParseStatus(string(lockContent))
-
-				if slices.Contains(lf.Progress, lockfile.Status{Value: "OK", Action: "build"}) {
-					fmt.Println("==> Package alredy builded")
-				} else {
-					pkg.ExecuteBuild(configs)
-					lockFile.WriteString("build: OK\n")
-				}
-
-			})
-
+		queue, err := DependencyQueue(targets, depsMap, sourceDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
 		}
-		wg.Wait()
-
+		InstallQueue(queue, internalDB)
 	},
 }
 
@@ -592,13 +466,25 @@ var syncCmd = &cobra.Command{
 		return GetConfiguration()
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		db, err := sql.Open("sqlite3", SourceDB)
+		if err := os.MkdirAll(ConfigurationDir, 0755); err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		db, err := database.OpenSource(SourceDB)
 		if err != nil {
-			panic(err)
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
 		}
-		defer db.Close()
-		if err := repo.FetchPackagesToDB(args[0], db); err != nil {
-			panic(err)
+
+		client, err := HTTPClient()
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if err := repo.FetchPackagesToDB(client, args[0], db); err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
 		}
 	},
 }
@@ -607,15 +493,42 @@ func main() {
 
 	verbosityLevel = os.Getenv("VERBOSE_LEVEL")
 
+	rootCmd.PersistentFlags().Bool("no-wait", false, "fail instead of waiting when another packets process holds the lock")
+
 	rootCmd.AddCommand(installCmd)
 	rootCmd.AddCommand(syncCmd)
 	rootCmd.AddCommand(executeCmd)
 	rootCmd.AddCommand(removeCmd)
+	rootCmd.AddCommand(autoremoveCmd)
 	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(flagCmd)
 	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(logCmd)
+	rootCmd.AddCommand(verifyCmd)
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(resumeCmd)
+	rootCmd.AddCommand(abortCmd)
+	rootCmd.AddCommand(historyCmd)
+	historyCmd.AddCommand(historyUndoCmd)
+	rootCmd.AddCommand(generationsCmd)
+	rootCmd.AddCommand(rollbackCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(lockCmd)
+	rootCmd.AddCommand(syncProjectCmd)
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheListCmd)
+	cacheCmd.AddCommand(cacheCleanCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+	cachePruneCmd.Flags().String("older-than", "", "remove what was not used for this long, e.g. 30d or 12h")
+
+	rootCmd.AddCommand(buildDepsCmd)
+	buildDepsCmd.AddCommand(buildDepsListCmd)
+	buildDepsCmd.AddCommand(buildDepsGcCmd)
 
 	rootCmd.AddCommand(devCmd)
 	devCmd.AddCommand(packCmd)
 	rootCmd.Execute()
+	database.CloseAll()
+	ReleaseOperationLock()
 }
@@ -0,0 +1,69 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// FormatVersion is the version written by this packets
+const FormatVersion = 1
+
+// Manifest is the set of explicitly installed packages of a machine, written by packets export and
+// installed again on another machine by packets import
+type Manifest struct {
+	Format    int       `toml:"format"`
+	Generated time.Time `toml:"generated"`
+
+	Packages []Package `toml:"package"`
+}
+
+// Package pins a single package to the exact build that was installed
+type Package struct {
+	Id       string   `toml:"id"`
+	Serial   int      `toml:"serial"`
+	Location string   `toml:"location"`
+	Flags    []string `toml:"flags,omitempty"`
+}
+
+func Parse(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := toml.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if m.Format > FormatVersion {
+		return nil, fmt.Errorf("manifest format %d is newer than this packets supports (%d)", m.Format, FormatVersion)
+	}
+	if m.Format < 1 {
+		return nil, fmt.Errorf("unknown manifest format %d", m.Format)
+	}
+	for i, pkg := range m.Packages {
+		if pkg.Id == "" {
+			return nil, fmt.Errorf("package %d has no id", i+1)
+		}
+		if pkg.Location == "" {
+			return nil, fmt.Errorf("%s has no location", pkg.Id)
+		}
+	}
+	return &m, nil
+}
+
+func Read(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+func (m *Manifest) Marshal() ([]byte, error) {
+	m.Format = FormatVersion
+	return toml.Marshal(m)
+}
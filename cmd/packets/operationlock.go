@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/roboogg133/packets/cmd/packets/oplock"
+	"github.com/spf13/cobra"
+)
+
+var operationLock *oplock.Lock
+
+// commands that change packages, files or databases hold the operation lock alone
+var exclusiveCommands = []*cobra.Command{installCmd, executeCmd, removeCmd, autoremoveCmd, syncCmd, buildDepsGcCmd, resumeCmd, abortCmd, historyUndoCmd, rollbackCmd, importCmd, syncProjectCmd, cacheCleanCmd, cachePruneCmd}
+
+// read-only commands share it, so they only wait while something is being changed. log and status take none,
+// they are run to watch an install that holds the lock for as long as it lasts
+var sharedCommands = []*cobra.Command{listCmd, verifyCmd, configCmd, flagCmd, buildDepsListCmd, historyCmd, generationsCmd, exportCmd, lockCmd, cacheListCmd}
+
+func operationLockMode(cmd *cobra.Command) (oplock.Mode, bool) {
+	for _, c := range exclusiveCommands {
+		if c == cmd {
+			return oplock.Exclusive, true
+		}
+	}
+	for _, c := range sharedCommands {
+		if c == cmd {
+			return oplock.Shared, true
+		}
+	}
+	return 0, false
+}
+
+// AcquireOperationLock takes the system wide lock needed by cmd, it is released when the process exits
+func AcquireOperationLock(cmd *cobra.Command) error {
+	mode, ok := operationLockMode(cmd)
+	if !ok {
+		return nil
+	}
+
+	if mode == oplock.Exclusive {
+		// the command itself refuses to run without root, so let it print that instead
+		if os.Geteuid() != 0 {
+			return nil
+		}
+		if err := os.MkdirAll(HomeDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	noWait, _ := cmd.Flags().GetBool("no-wait")
+
+	lock, err := oplock.Acquire(filepath.Join(HomeDir, oplock.FileName), mode, cmd.CommandPath(), !noWait, func(holder oplock.Holder) {
+		fmt.Printf("==> waiting for lock held by %s\n", holder)
+	})
+	if err != nil {
+		return err
+	}
+
+	operationLock = lock
+	return nil
+}
+
+func ReleaseOperationLock() error {
+	err := operationLock.Release()
+	operationLock = nil
+	return err
+}
@@ -0,0 +1,36 @@
+//go:build unix
+
+package oplock
+
+import (
+	"errors"
+	"syscall"
+)
+
+const implemented = true
+
+func (l *Lock) how() int {
+	if l.Mode == Exclusive {
+		return syscall.LOCK_EX
+	}
+	return syscall.LOCK_SH
+}
+
+func (l *Lock) tryLock() (bool, error) {
+	err := syscall.Flock(int(l.file.Fd()), l.how()|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *Lock) lock() error {
+	for {
+		err := syscall.Flock(int(l.file.Fd()), l.how())
+		if !errors.Is(err, syscall.EINTR) {
+			return err
+		}
+	}
+}
+
+func (l *Lock) unlock() error { return syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN) }
@@ -0,0 +1,149 @@
+package oplock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const FileName = "operation.lock"
+
+type Mode int
+
+const (
+	// Shared is taken by read-only commands, any number of them can hold it together
+	Shared Mode = iota
+	// Exclusive is taken by commands that change the system, it waits for every other holder
+	Exclusive
+)
+
+// ErrLocked is returned when the lock is held by another process and waiting was not allowed
+var ErrLocked = errors.New("operation lock is held by another packets process")
+
+// Holder is the process that last took the lock exclusively, as written in the lock file
+type Holder struct {
+	PID     int
+	Command string
+}
+
+func (h Holder) String() string {
+	if h.PID == 0 {
+		return "another packets process"
+	}
+	return fmt.Sprintf("PID %d (%s)", h.PID, h.Command)
+}
+
+// Lock is an advisory lock on a file, released by Release or when the process exits
+type Lock struct {
+	Path string
+	Mode Mode
+
+	file *os.File
+}
+
+// Acquire takes the lock at path. When it is busy, onWait is called with the current holder before blocking,
+// or ErrLocked is returned if wait is false. A nil Lock and no error means the lock file does not exist and
+// could not be created, which only happens for read-only commands run without privileges.
+func Acquire(path string, mode Mode, command string, wait bool, onWait func(Holder)) (*Lock, error) {
+	file, err := openLockFile(path, mode)
+	if err != nil {
+		if mode == Shared && (errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission)) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	l := &Lock{Path: path, Mode: mode, file: file}
+
+	locked, err := l.tryLock()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if !locked {
+		holder := readHolder(file)
+		if !wait {
+			file.Close()
+			return nil, fmt.Errorf("%w: held by %s", ErrLocked, holder)
+		}
+		if onWait != nil {
+			onWait(holder)
+		}
+		if err := l.lock(); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	if mode == Exclusive {
+		writeHolder(file, command)
+	}
+	return l, nil
+}
+
+// Free reports if no process holds the lock at path exclusively. It only tries a shared lock and never waits,
+// and where locks are not implemented the lock is never known to be free
+func Free(path string) bool {
+	if !implemented {
+		return false
+	}
+	// read only, so checking never creates the lock file
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Is(err, os.ErrNotExist)
+	}
+	defer file.Close()
+
+	l := &Lock{Path: path, Mode: Shared, file: file}
+	locked, err := l.tryLock()
+	if err != nil || !locked {
+		return false
+	}
+	l.unlock()
+	return true
+}
+
+// Release unlocks and closes the lock file, it is safe to call on a nil Lock
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	if l.Mode == Exclusive {
+		l.file.Truncate(0)
+	}
+	l.unlock()
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func openLockFile(path string, mode Mode) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err == nil || mode == Exclusive {
+		return file, err
+	}
+	// unprivileged readers can still share a lock file created by root
+	return os.Open(path)
+}
+
+func readHolder(file *os.File) Holder {
+	buf := make([]byte, 512)
+	n, _ := file.ReadAt(buf, 0)
+
+	pid, command, _ := strings.Cut(strings.TrimSpace(string(buf[:n])), " ")
+	number, err := strconv.Atoi(pid)
+	if err != nil {
+		return Holder{}
+	}
+	return Holder{PID: number, Command: command}
+}
+
+func writeHolder(file *os.File, command string) {
+	if err := file.Truncate(0); err != nil {
+		return
+	}
+	file.WriteAt([]byte(fmt.Sprintf("%d %s\n", os.Getpid(), command)), 0)
+}
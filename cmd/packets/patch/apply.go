@@ -0,0 +1,319 @@
+package patch
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MaxFuzz is how many context lines may be ignored at each end of a hunk that does not match as a whole
+const MaxFuzz = 2
+
+// HunkError is a hunk that could not be applied
+type HunkError struct {
+	File string
+	// Hunk is the position of the hunk in the file, from 1
+	Hunk   int
+	Line   int
+	Reason string
+}
+
+func (e HunkError) Error() string {
+	if e.Hunk == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Reason)
+	}
+	return fmt.Sprintf("%s: hunk #%d at line %d: %s", e.File, e.Hunk, e.Line, e.Reason)
+}
+
+// Error lists every hunk that failed, nothing is written when there is one
+type Error struct {
+	Failed []HunkError
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString("patch does not apply:")
+	for _, failed := range e.Failed {
+		fmt.Fprintf(&b, "\n  %s", failed.Error())
+	}
+	return b.String()
+}
+
+// change is the result of a file, nil content deletes it. A rename removes moved once path is written
+type change struct {
+	path    string
+	content []byte
+	mode    os.FileMode
+	moved   string
+}
+
+// Apply applies files to the tree at dir, stripping strip leading components from their names like patch -p.
+// Every file is patched in memory first, the tree is only written when every hunk applies
+func Apply(files []File, dir string, strip int) error {
+	failed := &Error{}
+	var changes []change
+
+	for _, file := range files {
+		name := file.NewName
+		if file.Deleted() {
+			name = file.OldName
+		}
+
+		relative, err := StripPath(name, strip)
+		if err != nil {
+			failed.Failed = append(failed.Failed, HunkError{File: name, Reason: err.Error()})
+			continue
+		}
+		target := filepath.Join(dir, relative)
+
+		// a renamed file is read from its old name, which must be inside the tree too
+		source := target
+		if file.Rename {
+			oldRelative, err := StripPath(file.OldName, strip)
+			if err != nil {
+				failed.Failed = append(failed.Failed, HunkError{File: file.OldName, Reason: err.Error()})
+				continue
+			}
+			source = filepath.Join(dir, oldRelative)
+		}
+
+		c, errs := applyFile(file, source, target, relative)
+		if len(errs) > 0 {
+			failed.Failed = append(failed.Failed, errs...)
+			continue
+		}
+		changes = append(changes, c)
+	}
+
+	if len(failed.Failed) > 0 {
+		return failed
+	}
+
+	for _, c := range changes {
+		if err := write(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StripPath removes strip leading components of name, the result must stay inside the tree
+func StripPath(name string, strip int) (string, error) {
+	parts := strings.Split(filepath.ToSlash(name), "/")
+	if strip > 0 {
+		if strip >= len(parts) {
+			return "", fmt.Errorf("can't strip %d components from %s", strip, name)
+		}
+		parts = parts[strip:]
+	}
+
+	relative := filepath.Clean(filepath.FromSlash(strings.Join(parts, "/")))
+	if filepath.IsAbs(relative) || relative == "." || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s points outside of the sources", name)
+	}
+	return relative, nil
+}
+
+// applyFile patches source, which is target unless the file is renamed
+func applyFile(file File, source, target, relative string) (change, []HunkError) {
+	c := change{path: target, mode: 0644}
+	if file.Mode != 0 {
+		c.mode = file.Mode
+	}
+
+	if source != target {
+		if _, err := os.Lstat(target); err == nil {
+			reason := "is the new name of " + file.OldName + " but already exists"
+			if _, err := os.Lstat(source); errors.Is(err, fs.ErrNotExist) {
+				reason = "already applied"
+			}
+			return c, []HunkError{{File: relative, Reason: reason}}
+		}
+		c.moved = source
+	}
+
+	data, err := os.ReadFile(source)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && file.Created():
+	case err != nil:
+		return c, []HunkError{{File: relative, Reason: err.Error()}}
+	case file.Created() && len(data) > 0:
+		return c, []HunkError{{File: relative, Reason: "is created by the patch but already exists"}}
+	case file.Mode == 0:
+		if stat, err := os.Stat(source); err == nil {
+			c.mode = stat.Mode().Perm()
+		}
+	}
+
+	lines := splitLines(string(data))
+	var result []string
+	var errs []HunkError
+
+	// pos is the first line not yet copied, offset is how far the last hunk was from where the diff put it
+	pos, offset := 0, 0
+	for n, hunk := range file.Hunks {
+		at, trimmed, ok := locate(lines, hunk, pos, offset)
+		if !ok {
+			errs = append(errs, HunkError{File: relative, Hunk: n + 1, Line: hunk.OldStart, Reason: mismatch(lines, hunk, offset)})
+			continue
+		}
+
+		old := trimmed.oldLines()
+		result = append(result, lines[pos:at]...)
+		result = append(result, trimmed.newLines()...)
+		pos = at + len(old)
+		offset = at - expected(trimmed)
+	}
+	if len(errs) > 0 {
+		return c, errs
+	}
+	result = append(result, lines[pos:]...)
+
+	if file.Deleted() {
+		if len(result) > 0 {
+			return c, []HunkError{{File: relative, Reason: "is deleted by the patch but has lines left"}}
+		}
+		return c, nil
+	}
+	c.content = joinLines(result)
+	if c.content == nil {
+		c.content = []byte{}
+	}
+	return c, nil
+}
+
+// expected is the index the old lines of hunk start at in the original file
+func expected(hunk Hunk) int {
+	if hunk.OldLines == 0 {
+		// an insertion without context goes after line OldStart
+		return hunk.OldStart
+	}
+	return hunk.OldStart - 1
+}
+
+// locate finds where hunk applies at or after pos, the nearest position to where the diff put it wins.
+// Without a match the context lines at both ends are ignored, up to MaxFuzz of them
+func locate(lines []string, hunk Hunk, pos, offset int) (int, Hunk, bool) {
+	for fuzz := 0; fuzz <= MaxFuzz; fuzz++ {
+		trimmed, ok := trimContext(hunk, fuzz)
+		if !ok {
+			break
+		}
+		old := trimmed.oldLines()
+		want := expected(trimmed) + offset
+
+		for distance := 0; ; distance++ {
+			before, after := want-distance, want+distance
+			if before < pos && after > len(lines)-len(old) {
+				break
+			}
+			if after >= pos && after <= len(lines)-len(old) && matches(lines, after, old) {
+				return after, trimmed, true
+			}
+			if distance > 0 && before >= pos && before <= len(lines)-len(old) && matches(lines, before, old) {
+				return before, trimmed, true
+			}
+		}
+	}
+	return 0, hunk, false
+}
+
+// trimContext drops up to fuzz context lines from both ends of hunk, it fails when there are none to drop
+func trimContext(hunk Hunk, fuzz int) (Hunk, bool) {
+	if fuzz == 0 {
+		return hunk, true
+	}
+
+	lines := hunk.Lines
+	start, end := 0, len(lines)
+	for start < fuzz && start < end && lines[start].Op == ' ' {
+		start++
+	}
+	for len(lines)-end < fuzz && end > start && lines[end-1].Op == ' ' {
+		end--
+	}
+	if start+len(lines)-end < fuzz || start == end {
+		return hunk, false
+	}
+
+	trimmed := hunk
+	trimmed.Lines = lines[start:end]
+	trimmed.OldStart += start
+	trimmed.NewStart += start
+	trimmed.OldLines = len(trimmed.oldLines())
+	trimmed.NewLines = len(trimmed.newLines())
+	if trimmed.OldLines == 0 {
+		// the lines are inserted after the context that was dropped
+		trimmed.OldStart--
+	}
+	return trimmed, true
+}
+
+func matches(lines []string, at int, want []string) bool {
+	for i, line := range want {
+		if lines[at+i] != line {
+			return false
+		}
+	}
+	return true
+}
+
+// mismatch explains why hunk does not apply where the diff put it
+func mismatch(lines []string, hunk Hunk, offset int) string {
+	if replaced := hunk.newLines(); len(replaced) > 0 {
+		for at := 0; at+len(replaced) <= len(lines); at++ {
+			if matches(lines, at, replaced) {
+				return "already applied"
+			}
+		}
+	}
+
+	at := max(expected(hunk)+offset, 0)
+	for i, want := range hunk.oldLines() {
+		if at+i >= len(lines) {
+			return fmt.Sprintf("file ends at line %d, expected %q", len(lines), strings.TrimRight(want, "\r\n"))
+		}
+		if got := lines[at+i]; got != want {
+			return fmt.Sprintf("line %d is %q, expected %q", at+i+1, strings.TrimRight(got, "\r\n"), strings.TrimRight(want, "\r\n"))
+		}
+	}
+	return "context not found"
+}
+
+// write replaces the file through a temporary one, so an interrupted write leaves the old content
+func write(c change) error {
+	if c.content == nil {
+		return os.Remove(c.path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), "."+filepath.Base(c.path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(c.content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(c.mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+	if c.moved != "" {
+		return os.Remove(c.moved)
+	}
+	return nil
+}
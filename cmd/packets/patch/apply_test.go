@@ -0,0 +1,228 @@
+package patch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStripPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		strip int
+		want  string
+		bad   bool
+	}{
+		{name: "a/src/main.c", strip: 1, want: filepath.Join("src", "main.c")},
+		{name: "src/main.c", strip: 0, want: filepath.Join("src", "main.c")},
+		{name: "a/b/c", strip: 2, want: "c"},
+		{name: "a/src/../main.c", strip: 1, want: "main.c"},
+		{name: "a/b", strip: 2, bad: true},
+		{name: "a/../../etc/passwd", strip: 1, bad: true},
+		{name: "a/src/../../x", strip: 1, bad: true},
+		{name: "/etc/passwd", strip: 0, bad: true},
+		{name: "a/.", strip: 1, bad: true},
+		{name: "a/..", strip: 1, bad: true},
+	}
+
+	for _, test := range tests {
+		got, err := StripPath(test.name, test.strip)
+		if test.bad {
+			if err == nil {
+				t.Errorf("StripPath(%q, %d) = %q, want an error", test.name, test.strip, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("StripPath(%q, %d) = %q, %v, want %q", test.name, test.strip, got, err, test.want)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	const change = "--- a/f\n+++ b/f\n@@ -7,7 +7,7 @@\n x\n y\n z\n-ab\n+changed\n xbc\n xxd\n e\n"
+	original := "v\nw\nx\ny\nz\nab\nxbc\nxxd\ne\nf\n"
+	patched := "v\nw\nx\ny\nz\nchanged\nxbc\nxxd\ne\nf\n"
+
+	tests := []struct {
+		name   string
+		before string
+		patch  string
+		after  string
+		reason string
+		// deleted expects the file to be gone
+		deleted bool
+	}{
+		{name: "exact", before: "a\nb\nc\nd\n" + original, patch: change, after: "a\nb\nc\nd\n" + patched},
+		{name: "offset", before: "a\nb\nc\nd\n1\n2\n3\n" + original, patch: change, after: "a\nb\nc\nd\n1\n2\n3\n" + patched},
+		{name: "offset backwards", before: "a\n" + original, patch: change, after: "a\n" + patched},
+		{name: "fuzz", before: "a\nb\nc\nd\n" + strings.Replace(original, "x\n", "changed upstream\n", 1), patch: change, after: "a\nb\nc\nd\n" + strings.Replace(patched, "x\n", "changed upstream\n", 1)},
+		{name: "already applied", before: "a\nb\nc\nd\n" + patched, patch: change, reason: "already applied"},
+		{name: "wrong content", before: "a\nb\nc\nd\nv\nw\nx\ny\nz\nother\nxbc\nxxd\ne\nf\n", patch: change, reason: `line 10 is "other", expected "ab"`},
+		{name: "no newline at the end", before: "a\nb", patch: "--- a/f\n+++ b/f\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n", after: "a\nc\n"},
+		{name: "deleted", before: "a\n", patch: "--- a/f\n+++ /dev/null\n@@ -1 +0,0 @@\n-a\n", deleted: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "f")
+			if err := os.WriteFile(path, []byte(test.before), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			files, err := Parse([]byte(test.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Apply(files, dir, 1)
+
+			if test.reason != "" {
+				var failed *Error
+				if !errors.As(err, &failed) || len(failed.Failed) != 1 || failed.Failed[0].Reason != test.reason {
+					t.Fatalf("got error %v, want %q", err, test.reason)
+				}
+				if data, _ := os.ReadFile(path); string(data) != test.before {
+					t.Fatalf("a failed patch changed the file to %q", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(path)
+			if test.deleted {
+				if !os.IsNotExist(err) {
+					t.Fatalf("deleted file still exists: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.after {
+				t.Fatalf("got %q, want %q", data, test.after)
+			}
+		})
+	}
+}
+
+func TestApplyAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "good"), []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bad"), []byte("z\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := Parse([]byte("--- a/good\n+++ b/good\n@@ -1 +1 @@\n-a\n+b\n--- a/bad\n+++ b/bad\n@@ -1 +1 @@\n-a\n+b\n--- a/../escape\n+++ b/../escape\n@@ -0,0 +1 @@\n+x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failed *Error
+	if err := Apply(files, dir, 1); !errors.As(err, &failed) || len(failed.Failed) != 2 {
+		t.Fatalf("got %v, want the bad file and the escaping one", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "good")); string(data) != "a\n" {
+		t.Fatalf("good was written although the patch failed: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escape")); !os.IsNotExist(err) {
+		t.Fatal("a file was written outside of the tree")
+	}
+}
+
+func TestApplyGitHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		patch  string
+		exists map[string]string
+		gone   []string
+		// mode is the expected mode of file
+		file string
+		mode os.FileMode
+	}{
+		{
+			name:   "pure rename",
+			patch:  "diff --git a/old.c b/src/new.c\nsimilarity index 100%\nrename from old.c\nrename to src/new.c\n",
+			exists: map[string]string{"src/new.c": "a\nb\n"},
+			gone:   []string{"old.c"},
+			file:   "src/new.c",
+			mode:   0640,
+		},
+		{
+			name:   "rename with edits",
+			patch:  "diff --git a/old.c b/new.c\nsimilarity index 50%\nrename from old.c\nrename to new.c\n--- a/old.c\n+++ b/new.c\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n",
+			exists: map[string]string{"new.c": "a\nc\n"},
+			gone:   []string{"old.c"},
+			file:   "new.c",
+			mode:   0640,
+		},
+		{
+			name:   "mode change",
+			patch:  "diff --git a/old.c b/old.c\nold mode 100640\nnew mode 100755\n",
+			exists: map[string]string{"old.c": "a\nb\n"},
+			file:   "old.c",
+			mode:   0755,
+		},
+		{
+			name:   "empty file",
+			patch:  "diff --git a/empty b/empty\nnew file mode 100644\nindex 0000000..e69de29\n",
+			exists: map[string]string{"empty": "", "old.c": "a\nb\n"},
+			file:   "empty",
+			mode:   0644,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "old.c"), []byte("a\nb\n"), 0640); err != nil {
+				t.Fatal(err)
+			}
+
+			files, err := Parse([]byte(test.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Apply(files, dir, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			for name, want := range test.exists {
+				path := filepath.Join(dir, filepath.FromSlash(name))
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != want {
+					t.Errorf("%s is %q, want %q", name, data, want)
+				}
+			}
+			for _, name := range test.gone {
+				if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+					t.Errorf("%s is still there", name)
+				}
+			}
+
+			stat, err := os.Stat(filepath.Join(dir, filepath.FromSlash(test.file)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat.Mode().Perm() != test.mode {
+				t.Errorf("%s has mode %o, want %o", test.file, stat.Mode().Perm(), test.mode)
+			}
+
+			// applying it again must fail instead of doing nothing
+			if files[0].Rename {
+				if err := Apply(files, dir, 1); err == nil || !strings.Contains(err.Error(), "already applied") {
+					t.Errorf("applying the rename twice gave %v", err)
+				}
+			}
+		})
+	}
+}
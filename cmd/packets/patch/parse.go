@@ -0,0 +1,339 @@
+package patch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DevNull is the name diff gives to the missing side of a created or deleted file
+const DevNull = "/dev/null"
+
+var (
+	ErrBinary = errors.New("binary patches are not supported")
+	ErrCopy   = errors.New("copied files are not supported")
+)
+
+// File is every hunk of a patch that changes one file
+type File struct {
+	OldName string
+	NewName string
+	// Rename is set by a git diff that moves OldName to NewName, plain diffs name the two sides as they like
+	Rename bool
+	// Mode is the mode a git diff gives a new file or changes a file to, 0 keeps the current mode or uses 0644
+	Mode  os.FileMode
+	Hunks []Hunk
+}
+
+// Created reports if the file does not exist before the patch, diff -N names it but gives it no lines
+func (f *File) Created() bool {
+	return f.OldName == DevNull || len(f.Hunks) == 1 && f.Hunks[0].OldStart == 0 && f.Hunks[0].OldLines == 0
+}
+
+// Deleted reports if the file does not exist after the patch
+func (f *File) Deleted() bool {
+	return f.NewName == DevNull || len(f.Hunks) == 1 && f.Hunks[0].NewStart == 0 && f.Hunks[0].NewLines == 0
+}
+
+// Hunk is a @@ block, line numbers start at 1 like in the diff
+type Hunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Lines    []Line
+}
+
+// Line is a line of a hunk, Op is ' ', '-' or '+' and Text keeps its line ending, a line without a newline
+// at the end of the file has none
+type Line struct {
+	Op   byte
+	Text string
+}
+
+// oldLines returns the lines the hunk expects to find
+func (h *Hunk) oldLines() []string {
+	var lines []string
+	for _, l := range h.Lines {
+		if l.Op != '+' {
+			lines = append(lines, l.Text)
+		}
+	}
+	return lines
+}
+
+// newLines returns the lines the hunk leaves in place of the old ones
+func (h *Hunk) newLines() []string {
+	var lines []string
+	for _, l := range h.Lines {
+		if l.Op != '-' {
+			lines = append(lines, l.Text)
+		}
+	}
+	return lines
+}
+
+// Parse reads a unified diff, text before and between the files, like a commit message, is skipped. The
+// extended headers of git give renames, mode changes and files created or deleted without any line
+func Parse(data []byte) ([]File, error) {
+	lines := splitLines(string(data))
+
+	var files []File
+	// header is the diff --git block being read, it becomes a file of its own when no hunks follow it
+	var header *gitHeader
+	flush := func() error {
+		if header == nil {
+			return nil
+		}
+		file, ok, err := header.file()
+		header = nil
+		if ok {
+			files = append(files, file)
+		}
+		return err
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		value := func(prefix string) string {
+			return headerName(strings.TrimPrefix(line, prefix))
+		}
+
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			if err := flush(); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i, err)
+			}
+			header = newGitHeader(strings.TrimRight(strings.TrimPrefix(line, "diff --git "), "\r\n"))
+			continue
+		case strings.HasPrefix(line, "GIT binary patch"), strings.HasPrefix(line, "Binary files "):
+			return nil, fmt.Errorf("line %d: %w", i+1, ErrBinary)
+		case header != nil && (strings.HasPrefix(line, "copy from ") || strings.HasPrefix(line, "copy to ")):
+			return nil, fmt.Errorf("line %d: %w", i+1, ErrCopy)
+		case header != nil && strings.HasPrefix(line, "new file mode "):
+			header.created, header.mode = true, parseMode(value("new file mode "))
+			continue
+		case header != nil && strings.HasPrefix(line, "new mode "):
+			header.mode = parseMode(value("new mode "))
+			continue
+		case header != nil && strings.HasPrefix(line, "deleted file mode "):
+			header.deleted = true
+			continue
+		case header != nil && strings.HasPrefix(line, "rename from "):
+			header.rename, header.oldName = true, header.oldPrefix+value("rename from ")
+			continue
+		case header != nil && strings.HasPrefix(line, "rename to "):
+			header.rename, header.newName = true, header.newPrefix+value("rename to ")
+			continue
+		case !strings.HasPrefix(line, "--- ") || i+1 >= len(lines) || !strings.HasPrefix(lines[i+1], "+++ "):
+			continue
+		}
+
+		file := File{
+			OldName: headerName(strings.TrimPrefix(line, "--- ")),
+			NewName: headerName(strings.TrimPrefix(lines[i+1], "+++ ")),
+		}
+		if header != nil {
+			file.Rename, file.Mode = header.rename, header.mode
+			header = nil
+		}
+		i += 2
+
+		for i < len(lines) && strings.HasPrefix(lines[i], "@@ ") {
+			hunk, next, err := parseHunk(lines, i)
+			if err != nil {
+				return nil, err
+			}
+			file.Hunks = append(file.Hunks, hunk)
+			i = next
+		}
+		i--
+
+		if len(file.Hunks) == 0 {
+			return nil, fmt.Errorf("%s has no hunks", file.NewName)
+		}
+		files = append(files, file)
+	}
+	if err := flush(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", len(lines), err)
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("no unified diff found")
+	}
+	return files, nil
+}
+
+// gitHeader is what the extended header lines of a diff --git block say about its file
+type gitHeader struct {
+	// names is the rest of the diff --git line, "a/{name} b/{name}" unless git was told otherwise
+	names            string
+	oldPrefix        string
+	newPrefix        string
+	oldName, newName string
+	rename           bool
+	created, deleted bool
+	mode             os.FileMode
+}
+
+func newGitHeader(names string) *gitHeader {
+	h := &gitHeader{names: names}
+	if strings.HasPrefix(names, "a/") && strings.Contains(names, " b/") {
+		h.oldPrefix, h.newPrefix = "a/", "b/"
+	}
+	return h
+}
+
+// file is the change of a block without hunks, ok is false when it changes nothing
+func (h *gitHeader) file() (File, bool, error) {
+	if !h.rename && !h.created && !h.deleted && h.mode == 0 {
+		return File{}, false, nil
+	}
+
+	file := File{OldName: h.oldName, NewName: h.newName, Rename: h.rename, Mode: h.mode}
+	if !h.rename {
+		// both sides have the same name, so it is the second half of the line
+		half := len(h.names) / 2
+		if len(h.names)%2 == 0 || h.names[half] != ' ' {
+			return File{}, false, fmt.Errorf("can't read the file name of diff --git %s", h.names)
+		}
+		file.OldName, file.NewName = h.names[:half], h.names[half+1:]
+	}
+	if h.created {
+		file.OldName = DevNull
+	}
+	if h.deleted {
+		file.NewName = DevNull
+	}
+	return file, true, nil
+}
+
+// parseMode reads the octal mode of a git header, only the permission bits are kept
+func parseMode(s string) os.FileMode {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0
+	}
+	return os.FileMode(m & 0777)
+}
+
+// parseHunk reads the hunk starting at lines[start], it returns the index of the line after it
+func parseHunk(lines []string, start int) (Hunk, int, error) {
+	var hunk Hunk
+	header := strings.TrimRight(lines[start], "\r\n")
+
+	fields := strings.Fields(header)
+	if len(fields) < 4 || fields[3] != "@@" {
+		return hunk, 0, fmt.Errorf("line %d: malformed hunk header %q", start+1, header)
+	}
+	var err error
+	if hunk.OldStart, hunk.OldLines, err = parseRange(fields[1], "-"); err != nil {
+		return hunk, 0, fmt.Errorf("line %d: %w", start+1, err)
+	}
+	if hunk.NewStart, hunk.NewLines, err = parseRange(fields[2], "+"); err != nil {
+		return hunk, 0, fmt.Errorf("line %d: %w", start+1, err)
+	}
+
+	oldLeft, newLeft := hunk.OldLines, hunk.NewLines
+	i := start + 1
+	for ; i < len(lines) && (oldLeft > 0 || newLeft > 0); i++ {
+		line := lines[i]
+		if line == "\n" || line == "\r\n" || line == "" {
+			// editors strip the space of empty context lines
+			line = " " + line
+		}
+
+		switch line[0] {
+		case ' ':
+			oldLeft--
+			newLeft--
+		case '-':
+			oldLeft--
+		case '+':
+			newLeft--
+		case '\\':
+			noNewline(&hunk)
+			continue
+		default:
+			return hunk, 0, fmt.Errorf("line %d: hunk ends %d lines early", i+1, max(oldLeft, newLeft))
+		}
+		if oldLeft < 0 || newLeft < 0 {
+			return hunk, 0, fmt.Errorf("line %d: hunk has more lines than its header says", i+1)
+		}
+		hunk.Lines = append(hunk.Lines, Line{Op: line[0], Text: line[1:]})
+	}
+	if oldLeft > 0 || newLeft > 0 {
+		return hunk, 0, fmt.Errorf("line %d: hunk ends %d lines early", i, max(oldLeft, newLeft))
+	}
+
+	if i < len(lines) && strings.HasPrefix(lines[i], "\\") {
+		noNewline(&hunk)
+		i++
+	}
+	return hunk, i, nil
+}
+
+// noNewline handles "\ No newline at end of file", the line before it has no line ending
+func noNewline(hunk *Hunk) {
+	if n := len(hunk.Lines); n > 0 {
+		text := hunk.Lines[n-1].Text
+		text = strings.TrimSuffix(text, "\n")
+		hunk.Lines[n-1].Text = strings.TrimSuffix(text, "\r")
+	}
+}
+
+// parseRange reads "-start,count", count is 1 when omitted
+func parseRange(s, prefix string) (int, int, error) {
+	s, ok := strings.CutPrefix(s, prefix)
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed range %q", s)
+	}
+	startString, countString, hasCount := strings.Cut(s, ",")
+	start, err := strconv.Atoi(startString)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed range %q", s)
+	}
+	count := 1
+	if hasCount {
+		if count, err = strconv.Atoi(countString); err != nil {
+			return 0, 0, fmt.Errorf("malformed range %q", s)
+		}
+	}
+	return start, count, nil
+}
+
+// headerName is the path of a --- or +++ line, without the timestamp diff -u writes after a tab
+func headerName(s string) string {
+	s = strings.TrimRight(s, "\r\n")
+	if name, _, found := strings.Cut(s, "\t"); found {
+		s = name
+	}
+	s = strings.TrimSpace(s)
+	if unquoted, err := strconv.Unquote(s); err == nil && strings.HasPrefix(s, `"`) {
+		s = unquoted
+	}
+	return s
+}
+
+// splitLines splits s keeping the line endings
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func joinLines(lines []string) []byte {
+	var b bytes.Buffer
+	for _, line := range lines {
+		b.WriteString(line)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,117 @@
+package patch
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+		want  []File
+		err   error
+	}{
+		{
+			name:  "unified diff after a commit message",
+			patch: "Fix the build\n\n--- a/src/main.c\t2024-01-01\n+++ b/src/main.c\n@@ -1,3 +1,3 @@\n int a;\n-int b;\n+long b;\n int c;\n",
+			want: []File{{OldName: "a/src/main.c", NewName: "b/src/main.c", Hunks: []Hunk{{
+				OldStart: 1, OldLines: 3, NewStart: 1, NewLines: 3,
+				Lines: []Line{{' ', "int a;\n"}, {'-', "int b;\n"}, {'+', "long b;\n"}, {' ', "int c;\n"}},
+			}}}},
+		},
+		{
+			name:  "new file with its mode",
+			patch: "diff --git a/run.sh b/run.sh\nnew file mode 100755\nindex 0000000..1111111\n--- /dev/null\n+++ b/run.sh\n@@ -0,0 +1 @@\n+echo hi\n",
+			want: []File{{OldName: DevNull, NewName: "b/run.sh", Mode: 0755, Hunks: []Hunk{{
+				OldStart: 0, OldLines: 0, NewStart: 1, NewLines: 1,
+				Lines: []Line{{'+', "echo hi\n"}},
+			}}}},
+		},
+		{
+			name:  "pure rename",
+			patch: "diff --git a/old.c b/new.c\nsimilarity index 100%\nrename from old.c\nrename to new.c\n",
+			want:  []File{{OldName: "a/old.c", NewName: "b/new.c", Rename: true}},
+		},
+		{
+			name:  "rename with edits",
+			patch: "diff --git a/old.c b/new.c\nsimilarity index 80%\nrename from old.c\nrename to new.c\n--- a/old.c\n+++ b/new.c\n@@ -1 +1 @@\n-a\n+b\n",
+			want: []File{{OldName: "a/old.c", NewName: "b/new.c", Rename: true, Hunks: []Hunk{{
+				OldStart: 1, OldLines: 1, NewStart: 1, NewLines: 1,
+				Lines: []Line{{'-', "a\n"}, {'+', "b\n"}},
+			}}}},
+		},
+		{
+			name:  "mode change only",
+			patch: "diff --git a/configure b/configure\nold mode 100644\nnew mode 100755\ndiff --git a/x b/x\n--- a/x\n+++ b/x\n@@ -1 +1 @@\n-1\n+2\n",
+			want: []File{
+				{OldName: "a/configure", NewName: "b/configure", Mode: 0755},
+				{OldName: "a/x", NewName: "b/x", Hunks: []Hunk{{
+					OldStart: 1, OldLines: 1, NewStart: 1, NewLines: 1,
+					Lines: []Line{{'-', "1\n"}, {'+', "2\n"}},
+				}}},
+			},
+		},
+		{
+			name:  "empty file created and deleted",
+			patch: "diff --git a/empty b/empty\nnew file mode 100644\nindex 0000000..e69de29\ndiff --git a/gone b/gone\ndeleted file mode 100644\nindex e69de29..0000000\n",
+			want: []File{
+				{OldName: DevNull, NewName: "b/empty", Mode: 0644},
+				{OldName: "a/gone", NewName: DevNull},
+			},
+		},
+		{
+			name:  "binary",
+			patch: "diff --git a/logo.png b/logo.png\nindex 1..2 100644\nGIT binary patch\nliteral 1\n",
+			err:   ErrBinary,
+		},
+		{
+			name:  "copy",
+			patch: "diff --git a/a.c b/b.c\nsimilarity index 100%\ncopy from a.c\ncopy to b.c\n",
+			err:   ErrCopy,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := Parse([]byte(test.patch))
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("got error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(test.want) {
+				t.Fatalf("got %d files, want %d", len(files), len(test.want))
+			}
+			for i, want := range test.want {
+				if !reflect.DeepEqual(files[i], want) {
+					t.Errorf("file %d is %+v, want %+v", i, files[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+	}{
+		{"no diff", "just a commit message\n"},
+		{"no hunks", "--- a/x\n+++ b/x\n"},
+		{"short hunk", "--- a/x\n+++ b/x\n@@ -1,3 +1,3 @@\n a\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Parse([]byte(test.patch)); err == nil {
+				t.Fatal("parsed an invalid patch")
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/roboogg133/packets/cmd/packets/database"
+	"github.com/roboogg133/packets/cmd/packets/download"
+	"github.com/roboogg133/packets/cmd/packets/lockfile"
+	"github.com/roboogg133/packets/cmd/packets/project"
+	"github.com/roboogg133/packets/cmd/packets/repo"
+	"github.com/roboogg133/packets/pkg/packet.lua.d"
+	"github.com/spf13/cobra"
+)
+
+// HashPackage returns the sha256 of the .pkt of target. It goes through the download cache, so sync-project finds
+// it there, and a user that can't write the cache gets a temporary copy that is only hashed
+func HashPackage(target InstallTarget) (string, error) {
+	request := DownloadRequest{
+		Urls:  []string{target.Url()},
+		Kind:  lockfile.PackageDownload,
+		ByUrl: true,
+		NewRequest: func(url string) (*http.Request, error) {
+			return http.NewRequest("GET", url, nil)
+		},
+	}
+
+	// the cache belongs to the packets user like in install
+	root := os.Geteuid() == 0
+	if root {
+		_ = ChangeToNoPermission()
+	}
+	_, sum, err := CachedDownload(request)
+	if root {
+		_ = ElevatePermission()
+	}
+	if !errors.Is(err, fs.ErrPermission) {
+		return sum, err
+	}
+
+	tmp, err := os.MkdirTemp("", "packets-lock-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	client, err := HTTPClient()
+	if err != nil {
+		return "", err
+	}
+	sum, _, err = download.File(client, request.Urls, request.NewRequest, filepath.Join(tmp, "packet.pkt"), NumberOfTryAttempts)
+	return sum, err
+}
+
+// LockProject resolves every dependency of p and what they need. Dependencies are solved against an empty
+// internal database, so the lock is the same whatever the machine running it has installed
+func LockProject(p *project.Project, sourceDB *sql.DB) (*project.Lock, error) {
+	empty, err := database.OpenEmptyInternal()
+	if err != nil {
+		return nil, err
+	}
+	defer empty.Close()
+
+	lock := &project.Lock{ManifestSHA256: p.SHA256()}
+	depsMap := make(map[string]map[string]repo.DependencyStatus)
+
+	names := make([]string, 0, len(p.Dependencies))
+	for name := range p.Dependencies {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		status, err := repo.ResolveConstraint(name, p.Dependencies[name], p.Repository, sourceDB)
+		if err != nil {
+			return nil, err
+		}
+		lock.Packages = append(lock.Packages, project.LockedPackage{Name: name, Id: string(status.Id), Serial: status.Serial, Location: status.Location, Kind: project.KindProject})
+
+		// dependencies come from the repository the package was found in, like packets install does
+		if err := repo.SolveDeps(status.Id, status.Location, empty, sourceDB, &depsMap); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, kind := range []string{project.KindBuild, project.KindRuntime} {
+		var deps []project.LockedPackage
+		for name, dep := range depsMap[kind] {
+			// what the project asks for itself wins over what its dependencies ask for
+			if _, ok := p.Dependencies[name]; ok && kind == project.KindRuntime {
+				continue
+			}
+			deps = append(deps, project.LockedPackage{Name: name, Id: string(dep.Id), Serial: dep.Serial, Location: dep.Location, Kind: kind})
+		}
+		slices.SortFunc(deps, func(a, b project.LockedPackage) int { return strings.Compare(a.Name, b.Name) })
+		lock.Packages = append(lock.Packages, deps...)
+	}
+
+	for i, pkg := range lock.Packages {
+		fmt.Printf("=> hashing %s\n", pkg.Id)
+		sum, err := HashPackage(InstallTarget{Id: packet.PackageID(pkg.Id), Location: pkg.Location})
+		if err != nil {
+			return nil, err
+		}
+		lock.Packages[i].SHA256 = sum
+	}
+
+	// build dependencies first and the project packages last, the order they are installed in
+	slices.SortStableFunc(lock.Packages, func(a, b project.LockedPackage) int { return lockedOrder(a.Kind) - lockedOrder(b.Kind) })
+	return lock, nil
+}
+
+func lockedOrder(kind string) int {
+	switch kind {
+	case project.KindBuild:
+		return 0
+	case project.KindRuntime:
+		return 1
+	}
+	return 2
+}
+
+// LockedQueue turns a lock into install targets, skipping what is already installed with the locked id.
+// Nothing is returned when a locked package is installed with another version
+func LockedQueue(lock *project.Lock, db *sql.DB) ([]InstallTarget, error) {
+	var queue []InstallTarget
+	var conflicts, explicit []string
+	for _, pkg := range lock.Packages {
+		id := packet.PackageID(pkg.Id)
+
+		if pkg.Kind == project.KindBuild {
+			if installed, _, _, err := database.CheckVersionInBuild(pkg.Name, db); err == nil && installed == id {
+				continue
+			} else if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+			target := BuildDependencyTarget(id, pkg.Location)
+			target.SHA256 = pkg.SHA256
+			queue = append(queue, target)
+			continue
+		}
+
+		reason := database.ReasonDependency
+		if pkg.Kind == project.KindProject {
+			reason = database.ReasonExplicit
+		}
+
+		if installed, err := database.GetInstalledPackage(pkg.Name, db); err == nil {
+			if installed.Id != pkg.Id {
+				conflicts = append(conflicts, fmt.Sprintf("%s is locked but %s is installed", pkg.Id, installed.Id))
+			} else if reason == database.ReasonExplicit && installed.InstallReason != reason {
+				explicit = append(explicit, pkg.Id)
+			}
+			continue
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+
+		queue = append(queue, InstallTarget{Id: id, Location: pkg.Location, Reason: reason, SHA256: pkg.SHA256})
+	}
+
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(conflicts, ", "))
+	}
+	for _, id := range explicit {
+		if err := database.SetInstallReason(id, database.ReasonExplicit, db); err != nil {
+			return nil, err
+		}
+	}
+	return queue, nil
+}
+
+// openProject reads packets.toml of the project the current directory is in
+func openProject() (string, *project.Project, error) {
+	dir, err := project.Find(".")
+	if err != nil {
+		return "", nil, err
+	}
+	p, err := project.ReadProject(filepath.Join(dir, project.ManifestName))
+	return dir, p, err
+}
+
+var lockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Resolve packets.toml into packets.lock",
+	Long:  "Resolve the dependencies of packets.toml and everything they need into packets.lock, with the exact ids, repositories and .pkt hashes",
+	Args:  cobra.NoArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		// hashing the .pkt files needs the proxy, CA files and repository credentials, but not root
+		return GetUnprivilegedConfiguration()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, p, err := openProject()
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		sourceDB, err := database.OpenSource(SourceDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		lock, err := LockProject(p, sourceDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		lockPath := filepath.Join(dir, project.LockName)
+		if err := lock.Save(lockPath); err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("=> %d packages locked in %s\n", len(lock.Packages), lockPath)
+	},
+}
+
+var syncProjectCmd = &cobra.Command{
+	Use:   "sync-project",
+	Short: "Install the packages locked in packets.lock",
+	Long:  "Install exactly the packages locked in packets.lock, checking every .pkt against its locked hash",
+	Args:  cobra.NoArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		GrantPrivilegies()
+		return GetConfiguration()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, p, err := openProject()
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		lock, err := project.ReadLock(filepath.Join(dir, project.LockName))
+		if err != nil {
+			if os.IsNotExist(err) {
+				fmt.Printf("error: %s has no %s, run packets lock first\n", dir, project.LockName)
+			} else {
+				fmt.Printf("error: %s\n", err.Error())
+			}
+			os.Exit(1)
+		}
+		if lock.ManifestSHA256 != p.SHA256() {
+			fmt.Printf("error: %s changed since %s was written, run packets lock again\n", project.ManifestName, project.LockName)
+			os.Exit(1)
+		}
+
+		db, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		queue, err := LockedQueue(lock, db)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if len(queue) == 0 {
+			fmt.Println("=> every locked package is installed")
+			return
+		}
+
+		sourceDB, err := database.OpenSource(SourceDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if queue, err = OrderQueue(queue, sourceDB); err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		if !InstallQueue(queue, db) {
+			os.Exit(1)
+		}
+	},
+}
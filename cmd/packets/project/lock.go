@@ -0,0 +1,68 @@
+package project
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// LockFormatVersion is the version written by this packets
+const LockFormatVersion = 1
+
+const (
+	KindProject = "project"
+	KindRuntime = "runtime"
+	KindBuild   = "build"
+)
+
+// Lock is the packets.lock of a project, every package needed by packets.toml resolved to an exact build
+type Lock struct {
+	Format int `toml:"format"`
+	// ManifestSHA256 is the hash of the packets.toml the lock was resolved from
+	ManifestSHA256 string `toml:"manifest_sha256"`
+
+	Packages []LockedPackage `toml:"package"`
+}
+
+// LockedPackage is a package required by the project itself, a runtime dependency or a build dependency
+type LockedPackage struct {
+	Name     string `toml:"name"`
+	Id       string `toml:"id"`
+	Serial   int    `toml:"serial"`
+	Location string `toml:"location"`
+	SHA256   string `toml:"sha256"`
+	Kind     string `toml:"kind"`
+}
+
+func ReadLock(path string) (*Lock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var l Lock
+	if err := toml.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if l.Format > LockFormatVersion {
+		return nil, fmt.Errorf("%s: lock format %d is newer than this packets supports (%d)", path, l.Format, LockFormatVersion)
+	}
+	if l.Format < 1 {
+		return nil, fmt.Errorf("%s: unknown lock format %d", path, l.Format)
+	}
+	return &l, nil
+}
+
+func (l *Lock) Marshal() ([]byte, error) {
+	l.Format = LockFormatVersion
+	return toml.Marshal(l)
+}
+
+func (l *Lock) Save(path string) error {
+	data, err := l.Marshal()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
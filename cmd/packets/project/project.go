@@ -0,0 +1,68 @@
+package project
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+const (
+	ManifestName = "packets.toml"
+	LockName     = "packets.lock"
+)
+
+// Project is the packets.toml of a project, Dependencies maps package names to version constraints
+// written like in Packet.lua: ">=1.22", "<=2.0", "1.24.0" or empty for the highest version
+type Project struct {
+	// Repository is preferred when more than one synced repository has a matching package
+	Repository   string            `toml:"repository,omitempty"`
+	Dependencies map[string]string `toml:"dependencies"`
+
+	sha256 string
+}
+
+// SHA256 is the hash of the packets.toml the project was read from, the lock records it to notice edits
+func (p *Project) SHA256() string { return p.sha256 }
+
+func ReadProject(path string) (*Project, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Project
+	if err := toml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	sum := sha256.Sum256(data)
+	p.sha256 = hex.EncodeToString(sum[:])
+	return &p, nil
+}
+
+// Find returns the closest directory to dir, dir included, that has a packets.toml
+func Find(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ManifestName)); err == nil {
+			return dir, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no %s found", ManifestName)
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/roboogg133/packets/cmd/packets/database"
+	"github.com/roboogg133/packets/pkg/install"
+	"github.com/roboogg133/packets/pkg/packet.lua.d"
+	"github.com/spf13/cobra"
+)
+
+// RemovalOrder returns the packages to remove with every dependent before its dependencies. Without cascade a
+// package still needed by something outside the request is left out and reported in blocked with its dependents
+func RemovalOrder(requested []packet.PackageID, cascade bool, db *sql.DB) ([]packet.PackageID, map[packet.PackageID][]packet.PackageID, error) {
+	var order []packet.PackageID
+	blocked := make(map[packet.PackageID][]packet.PackageID)
+	visiting := make(map[packet.PackageID]bool)
+
+	var visit func(id packet.PackageID) error
+	visit = func(id packet.PackageID) error {
+		if visiting[id] || slices.Contains(order, id) {
+			return nil
+		}
+		visiting[id] = true
+		defer delete(visiting, id)
+
+		dependents, err := database.GetDependents(id.Name(), db)
+		if err != nil {
+			return err
+		}
+
+		var outside []packet.PackageID
+		for _, dependent := range dependents {
+			if dependent == id {
+				continue
+			}
+			if cascade {
+				if err := visit(dependent); err != nil {
+					return err
+				}
+			} else if !slices.Contains(requested, dependent) {
+				outside = append(outside, dependent)
+			} else if err := visit(dependent); err != nil {
+				return err
+			} else if _, ok := blocked[dependent]; ok {
+				// a requested dependent that stays installed still needs id
+				outside = append(outside, dependent)
+			}
+		}
+
+		if len(outside) > 0 {
+			blocked[id] = outside
+			return nil
+		}
+		order = append(order, id)
+		return nil
+	}
+
+	for _, id := range requested {
+		if err := visit(id); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return order, blocked, nil
+}
+
+// RemovePackage deletes the installed files of a package and its database entries. Directories are removed
+// deepest first once no other package owns them and they are empty, every path left behind is reported
+func RemovePackage(id packet.PackageID, db *sql.DB) error {
+	installed, err := database.GetInstalledPackage(string(id), db)
+	if err != nil {
+		return err
+	}
+
+	files, err := database.GetPackageFiles(id, db)
+	if err != nil {
+		return err
+	}
+
+	// packages installed before payloads were kept get one now, so generations that have them can be restored
+	if !HasPayload(id) {
+		if err := SavePayload(id, db); err != nil {
+			fmt.Printf("error: saving payload of %s: %s\n", id, err.Error())
+		}
+	}
+
+	if err := RemoveFiles(files, id, db); err != nil {
+		return err
+	}
+
+	if err := database.MarkAsUninstalled(id, db); err != nil {
+		return fmt.Errorf("error removing package from database but successfully removed it from the system: %s", err.Error())
+	}
+
+	change := database.HistoryChange{Name: installed.Name, Before: installed.Id, Location: installed.Location, Reason: installed.InstallReason}
+	if err := RecordChange(change, db); err != nil {
+		fmt.Printf("error: recording history: %s\n", err.Error())
+	}
+	return nil
+}
+
+// RemoveFiles deletes the files of id that no other package owns, then its directories deepest first
+func RemoveFiles(files []install.BasicFileStatus, id packet.PackageID, db *sql.DB) error {
+	var dirs []string
+	for _, file := range files {
+		if file.IsDir {
+			dirs = append(dirs, filepath.Clean(file.Filepath))
+			continue
+		}
+
+		if owners, err := database.CountOtherOwners(file.Filepath, id, db); err != nil {
+			return err
+		} else if owners > 0 {
+			fmt.Printf("==> kept %s: also installed by %d other package(s)\n", file.Filepath, owners)
+			continue
+		}
+
+		if err := os.Remove(file.Filepath); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("==> kept %s: %s\n", file.Filepath, err.Error())
+		}
+	}
+
+	slices.SortFunc(dirs, func(a, b string) int {
+		if depth := strings.Count(b, string(os.PathSeparator)) - strings.Count(a, string(os.PathSeparator)); depth != 0 {
+			return depth
+		}
+		return strings.Compare(b, a)
+	})
+
+	for _, dir := range dirs {
+		if owners, err := database.CountOtherOwners(dir, id, db); err != nil {
+			return err
+		} else if owners > 0 {
+			continue
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Printf("==> kept %s: %s\n", dir, err.Error())
+			}
+			continue
+		}
+
+		if len(entries) > 0 {
+			users, err := database.ListOwnersInside(dir, id, db)
+			if err != nil {
+				return err
+			}
+			if len(users) > 0 {
+				fmt.Printf("==> kept %s: still used by %s\n", dir, joinIds(users))
+			} else {
+				fmt.Printf("==> kept %s: contains %d untracked file(s)\n", dir, len(entries))
+			}
+			continue
+		}
+
+		if err := os.Remove(dir); err != nil {
+			fmt.Printf("==> kept %s: %s\n", dir, err.Error())
+		}
+	}
+	return nil
+}
+
+func joinIds(ids []packet.PackageID) string {
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = string(id)
+	}
+	return strings.Join(names, ", ")
+}
+
+var autoremoveCmd = &cobra.Command{
+	Use:   "autoremove",
+	Short: "Removes unneeded dependencies",
+	Long:  "Removes packages installed as a dependency that no installed package needs anymore",
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		GrantPrivilegies()
+		// like remove, each package removed records a generation and prunes the old ones
+		return GetConfiguration()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		db, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		if dryRun {
+			unneeded, err := database.ListUnneeded(db)
+			if err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				os.Exit(1)
+			}
+			if len(unneeded) == 0 {
+				fmt.Println("0 unneeded packages")
+			}
+			for _, id := range unneeded {
+				fmt.Printf("=> would remove %s\n", id)
+			}
+			return
+		}
+
+		var removed int
+		// removing an orphan can orphan its own dependencies, so repeat until nothing changes
+		for {
+			orphans, err := database.ListOrphans(db)
+			if err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			var progress bool
+			for _, id := range orphans {
+				if err := RemovePackage(id, db); err != nil {
+					fmt.Printf("error: %s\n", err.Error())
+					continue
+				}
+				fmt.Printf("=> removed %s\n", id)
+				removed++
+				progress = true
+			}
+			if !progress {
+				break
+			}
+		}
+
+		if removed == 0 {
+			fmt.Println("0 unneeded packages")
+		}
+	},
+}
+
+func init() {
+	removeCmd.Flags().Bool("cascade", false, "also remove every package that depends on the removed ones")
+	autoremoveCmd.Flags().Bool("dry-run", false, "only show what would be removed")
+}
@@ -0,0 +1,55 @@
+package repo
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/roboogg133/packets/pkg/packet.lua.d"
+)
+
+// ConstraintQuery matches a dependency name and version constraint given as parameters against every synced
+// repository, instead of the dependencies of a package, it returns the highest matching version of each repository
+const ConstraintQuery = dependencyInfoSelect + `   FROM (SELECT DISTINCT ? AS dependency_name, ? AS version_constraint, location FROM packages) d
+` + matchDependencyVersions
+
+// ResolveConstraint picks the package that satisfies name and constraint, an empty constraint means the highest
+// version. favoriteLocation wins when it has a match, otherwise the first repository by name, so the result
+// does not depend on the order the repositories were synced
+func ResolveConstraint(name, constraint, favoriteLocation string, sourcesDB *sql.DB) (DependencyStatus, error) {
+	if constraint == "" || constraint == "*" {
+		constraint = "\x00"
+	}
+
+	rows, err := sourcesDB.Query(ConstraintQuery, name, constraint)
+	if err != nil {
+		return DependencyStatus{}, err
+	}
+	defer rows.Close()
+
+	var matches []DependencyStatus
+	for rows.Next() {
+		var packageId, location, version, packageName string
+		var serial int
+		if err := rows.Scan(&packageId, &location, &version, &serial, &packageName); err != nil {
+			return DependencyStatus{}, err
+		}
+		matches = append(matches, DependencyStatus{Id: packet.NewId(packageId), Serial: serial, Location: location})
+	}
+	if err := rows.Err(); err != nil {
+		return DependencyStatus{}, err
+	}
+
+	if len(matches) == 0 {
+		return DependencyStatus{}, fmt.Errorf("no synced repository has %s %s", name, strings.Trim(constraint, "\x00"))
+	}
+
+	slices.SortFunc(matches, func(a, b DependencyStatus) int { return strings.Compare(a.Location, b.Location) })
+	for _, match := range matches {
+		if match.Location == favoriteLocation {
+			return match, nil
+		}
+	}
+	return matches[0], nil
+}
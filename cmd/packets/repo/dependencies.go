@@ -14,7 +14,10 @@ type DependencyStatus struct {
 }
 
 const (
-	RuntimeDependenciesQuery = `WITH dependency_info AS (
+	// dependencyInfoSelect reads a dependency name and version constraint from a source completed by a
+	// FROM clause of dependency_info, matchDependencyVersions then picks the highest matching version of each
+	// repository. Every query below is one of them with its FROM clause in between
+	dependencyInfoSelect = `WITH dependency_info AS (
    SELECT
        d.dependency_name,
        d.version_constraint,
@@ -33,9 +36,8 @@ const (
            WHEN d.version_constraint LIKE '%@%' THEN SUBSTR(d.version_constraint, INSTR(d.version_constraint, '@') + 1)
            ELSE d.version_constraint
        END as constraint_version
-   FROM dependencies d
-   WHERE d.package_id = ?
-),
+`
+	matchDependencyVersions = `),
 version_parts AS (
    SELECT
        p.name,
@@ -130,249 +132,21 @@ SELECT
    package_id,
    location,
    package_version,
-   serial
+   serial,
+   dependency_name
 FROM matched_packages
 WHERE version_rank = 1;`
-	BuildDependenciesQuery = `WITH dependency_info AS (
-   SELECT
-       d.dependency_name,
-       d.version_constraint,
-       d.location,
-       CASE
-           WHEN d.version_constraint = char(0) THEN 'HIGHEST'
-           WHEN d.version_constraint LIKE '>=%' THEN 'GREATER_EQUAL'
-           WHEN d.version_constraint LIKE '<=%' THEN 'LESS_EQUAL'
-           WHEN d.version_constraint LIKE '%@%' THEN 'EXACT'
-           ELSE 'EXACT'
-       END as constraint_type,
-       CASE
-           WHEN d.version_constraint = char(0) THEN NULL
-           WHEN d.version_constraint LIKE '>=%' THEN SUBSTR(d.version_constraint, 3)
-           WHEN d.version_constraint LIKE '<=%' THEN SUBSTR(d.version_constraint, 3)
-           WHEN d.version_constraint LIKE '%@%' THEN SUBSTR(d.version_constraint, INSTR(d.version_constraint, '@') + 1)
-           ELSE d.version_constraint
-       END as constraint_version
-   FROM build_dependencies d
+
+	RuntimeDependenciesQuery = dependencyInfoSelect + `   FROM dependencies d
    WHERE d.package_id = ?
-),
-version_parts AS (
-   SELECT
-       p.name,
-       p.id,
-       p.version,
-       p.serial,
-       p.location,
-       CAST(SUBSTR(p.version, 1, INSTR(p.version || '.', '.') - 1) AS INTEGER) as major,
-       CASE
-           WHEN INSTR(p.version, '.') > 0 THEN
-               CAST(SUBSTR(
-                   SUBSTR(p.version, INSTR(p.version, '.') + 1),
-                   1,
-                   INSTR(SUBSTR(p.version, INSTR(p.version, '.') + 1) || '.', '.') - 1
-               ) AS INTEGER)
-           ELSE 0
-       END as minor,
-       CASE
-           WHEN (LENGTH(p.version) - LENGTH(REPLACE(p.version, '.', ''))) >= 2 THEN
-               CAST(SUBSTR(
-                   p.version,
-                   INSTR(p.version, '.') + INSTR(SUBSTR(p.version, INSTR(p.version, '.') + 1), '.') + 1
-               ) AS INTEGER)
-           ELSE 0
-       END as patch
-   FROM packages p
-),
-constraint_version_parts AS (
-   SELECT
-       di.dependency_name,
-       di.version_constraint,
-       di.location,
-       di.constraint_type,
-       di.constraint_version,
-       CAST(SUBSTR(di.constraint_version, 1, INSTR(di.constraint_version || '.', '.') - 1) AS INTEGER) as const_major,
-       CASE
-           WHEN INSTR(di.constraint_version, '.') > 0 THEN
-               CAST(SUBSTR(
-                   SUBSTR(di.constraint_version, INSTR(di.constraint_version, '.') + 1),
-                   1,
-                   INSTR(SUBSTR(di.constraint_version, INSTR(di.constraint_version, '.') + 1) || '.', '.') - 1
-               ) AS INTEGER)
-           ELSE 0
-       END as const_minor,
-       CASE
-           WHEN (LENGTH(di.constraint_version) - LENGTH(REPLACE(di.constraint_version, '.', ''))) >= 2 THEN
-               CAST(SUBSTR(
-                   di.constraint_version,
-                   INSTR(di.constraint_version, '.') + INSTR(SUBSTR(di.constraint_version, INSTR(di.constraint_version, '.') + 1), '.') + 1
-               ) AS INTEGER)
-           ELSE 0
-       END as const_patch
-   FROM dependency_info di
-   WHERE di.constraint_version IS NOT NULL
-),
-matched_packages AS (
-   SELECT
-       di.dependency_name,
-       di.version_constraint,
-       di.location,
-       di.constraint_type,
-       vp.id as package_id,
-       vp.version as package_version,
-       vp.serial,
-       vp.major,
-       vp.minor,
-       vp.patch,
-       RANK() OVER (
-           PARTITION BY di.dependency_name, di.location
-           ORDER BY vp.major DESC, vp.minor DESC, vp.patch DESC
-       ) as version_rank
-   FROM dependency_info di
-   JOIN version_parts vp ON vp.name = di.dependency_name AND vp.location = di.location
-   LEFT JOIN constraint_version_parts cvp ON di.dependency_name = cvp.dependency_name
-       AND di.location = cvp.location
-       AND di.constraint_type = cvp.constraint_type
-   WHERE
-       (di.constraint_type = 'HIGHEST')
-       OR (di.constraint_type = 'EXACT' AND vp.version = di.constraint_version)
-       OR (di.constraint_type = 'GREATER_EQUAL' AND (
-           vp.major > cvp.const_major OR
-           (vp.major = cvp.const_major AND vp.minor > cvp.const_minor) OR
-           (vp.major = cvp.const_major AND vp.minor = cvp.const_minor AND vp.patch >= cvp.const_patch)
-       ))
-       OR (di.constraint_type = 'LESS_EQUAL' AND (
-           vp.major < cvp.const_major OR
-           (vp.major = cvp.const_major AND vp.minor < cvp.const_minor) OR
-           (vp.major = cvp.const_major AND vp.minor = cvp.const_minor AND vp.patch <= cvp.const_patch)
-       ))
-)
-SELECT
-   package_id,
-   location,
-   package_version,
-   serial
-FROM matched_packages
-WHERE version_rank = 1;`
+` + matchDependencyVersions
+	BuildDependenciesQuery = dependencyInfoSelect + `   FROM build_dependencies d
+   WHERE d.package_id = ?
+` + matchDependencyVersions
 
-	ConflictsQuery = `WITH dependency_info AS (
-   SELECT
-       d.dependency_name,
-       d.version_constraint,
-       d.location,
-       CASE
-           WHEN d.version_constraint = char(0) THEN 'HIGHEST'
-           WHEN d.version_constraint LIKE '>=%' THEN 'GREATER_EQUAL'
-           WHEN d.version_constraint LIKE '<=%' THEN 'LESS_EQUAL'
-           WHEN d.version_constraint LIKE '%@%' THEN 'EXACT'
-           ELSE 'EXACT'
-       END as constraint_type,
-       CASE
-           WHEN d.version_constraint = char(0) THEN NULL
-           WHEN d.version_constraint LIKE '>=%' THEN SUBSTR(d.version_constraint, 3)
-           WHEN d.version_constraint LIKE '<=%' THEN SUBSTR(d.version_constraint, 3)
-           WHEN d.version_constraint LIKE '%@%' THEN SUBSTR(d.version_constraint, INSTR(d.version_constraint, '@') + 1)
-           ELSE d.version_constraint
-       END as constraint_version
-   FROM conflicts d
+	ConflictsQuery = dependencyInfoSelect + `   FROM conflicts d
    WHERE d.package_id = ?
-),
-version_parts AS (
-   SELECT
-       p.name,
-       p.id,
-       p.version,
-       p.serial,
-       p.location,
-       CAST(SUBSTR(p.version, 1, INSTR(p.version || '.', '.') - 1) AS INTEGER) as major,
-       CASE
-           WHEN INSTR(p.version, '.') > 0 THEN
-               CAST(SUBSTR(
-                   SUBSTR(p.version, INSTR(p.version, '.') + 1),
-                   1,
-                   INSTR(SUBSTR(p.version, INSTR(p.version, '.') + 1) || '.', '.') - 1
-               ) AS INTEGER)
-           ELSE 0
-       END as minor,
-       CASE
-           WHEN (LENGTH(p.version) - LENGTH(REPLACE(p.version, '.', ''))) >= 2 THEN
-               CAST(SUBSTR(
-                   p.version,
-                   INSTR(p.version, '.') + INSTR(SUBSTR(p.version, INSTR(p.version, '.') + 1), '.') + 1
-               ) AS INTEGER)
-           ELSE 0
-       END as patch
-   FROM packages p
-),
-constraint_version_parts AS (
-   SELECT
-       di.dependency_name,
-       di.version_constraint,
-       di.location,
-       di.constraint_type,
-       di.constraint_version,
-       CAST(SUBSTR(di.constraint_version, 1, INSTR(di.constraint_version || '.', '.') - 1) AS INTEGER) as const_major,
-       CASE
-           WHEN INSTR(di.constraint_version, '.') > 0 THEN
-               CAST(SUBSTR(
-                   SUBSTR(di.constraint_version, INSTR(di.constraint_version, '.') + 1),
-                   1,
-                   INSTR(SUBSTR(di.constraint_version, INSTR(di.constraint_version, '.') + 1) || '.', '.') - 1
-               ) AS INTEGER)
-           ELSE 0
-       END as const_minor,
-       CASE
-           WHEN (LENGTH(di.constraint_version) - LENGTH(REPLACE(di.constraint_version, '.', ''))) >= 2 THEN
-               CAST(SUBSTR(
-                   di.constraint_version,
-                   INSTR(di.constraint_version, '.') + INSTR(SUBSTR(di.constraint_version, INSTR(di.constraint_version, '.') + 1), '.') + 1
-               ) AS INTEGER)
-           ELSE 0
-       END as const_patch
-   FROM dependency_info di
-   WHERE di.constraint_version IS NOT NULL
-),
-matched_packages AS (
-   SELECT
-       di.dependency_name,
-       di.version_constraint,
-       di.location,
-       di.constraint_type,
-       vp.id as package_id,
-       vp.version as package_version,
-       vp.serial,
-       vp.major,
-       vp.minor,
-       vp.patch,
-       RANK() OVER (
-           PARTITION BY di.dependency_name, di.location
-           ORDER BY vp.major DESC, vp.minor DESC, vp.patch DESC
-       ) as version_rank
-   FROM dependency_info di
-   JOIN version_parts vp ON vp.name = di.dependency_name AND vp.location = di.location
-   LEFT JOIN constraint_version_parts cvp ON di.dependency_name = cvp.dependency_name
-       AND di.location = cvp.location
-       AND di.constraint_type = cvp.constraint_type
-   WHERE
-       (di.constraint_type = 'HIGHEST')
-       OR (di.constraint_type = 'EXACT' AND vp.version = di.constraint_version)
-       OR (di.constraint_type = 'GREATER_EQUAL' AND (
-           vp.major > cvp.const_major OR
-           (vp.major = cvp.const_major AND vp.minor > cvp.const_minor) OR
-           (vp.major = cvp.const_major AND vp.minor = cvp.const_minor AND vp.patch >= cvp.const_patch)
-       ))
-       OR (di.constraint_type = 'LESS_EQUAL' AND (
-           vp.major < cvp.const_major OR
-           (vp.major = cvp.const_major AND vp.minor < cvp.const_minor) OR
-           (vp.major = cvp.const_major AND vp.minor = cvp.const_minor AND vp.patch <= cvp.const_patch)
-       ))
-)
-SELECT
-   package_id,
-   location,
-   package_version,
-   serial,
-   dependency_name
-FROM matched_packages
-WHERE version_rank = 1;`
+` + matchDependencyVersions
 
 /*  can select
 *     package_id,
@@ -384,6 +158,25 @@ WHERE version_rank = 1;`
  */
 )
 
+// DependencyNames returns the names of the runtime and build dependencies of id
+func DependencyNames(id packet.PackageID, sourcesDB *sql.DB) ([]string, error) {
+	rows, err := sourcesDB.Query("SELECT dependency_name FROM dependencies WHERE package_id = ? UNION SELECT dependency_name FROM build_dependencies WHERE package_id = ?", id, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
 func SolveDeps(id packet.PackageID, favoriteLocation string, installedDB *sql.DB, sourcesDB *sql.DB, maps *map[string]map[string]DependencyStatus) error {
 
 	rows, err := sourcesDB.Query(RuntimeDependenciesQuery, id)
@@ -394,6 +187,12 @@ func SolveDeps(id packet.PackageID, favoriteLocation string, installedDB *sql.DB
 	var pkgSerial int
 
 	tempMap := *maps
+	for _, kind := range []string{"runtime", "build", "conflicts"} {
+		if tempMap[kind] == nil {
+			tempMap[kind] = make(map[string]DependencyStatus)
+		}
+	}
+
 	// RUNTIME
 	for rows.Next() {
 		if err := rows.Scan(&packageId, &location, &version, &pkgSerial, &packageName); err != nil {
@@ -408,15 +207,12 @@ func SolveDeps(id packet.PackageID, favoriteLocation string, installedDB *sql.DB
 		}
 
 		installedID, installedSerial, installedLocation, err := database.CheckVersionInstalled(packageName, installedDB)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				continue
-			} else {
-				return err
-			}
+		if err != nil && err != sql.ErrNoRows {
+			rows.Close()
+			return err
 		}
 
-		if (location == installedLocation && installedSerial > pkgSerial) || (installedID.Version() == packageIdNormalized.Version()) {
+		if err == nil && ((location == installedLocation && installedSerial > pkgSerial) || (installedID.Version() == packageIdNormalized.Version())) {
 			continue
 		}
 
@@ -453,16 +249,21 @@ func SolveDeps(id packet.PackageID, favoriteLocation string, installedDB *sql.DB
 			return err
 		}
 
+		// a build dependency already in the live system or in the build prefix doesn't need to be installed again
+		if installed, err := database.SearchIfIsInstalled(packageName, installedDB); err != nil {
+			rows.Close()
+			return err
+		} else if installed {
+			continue
+		}
+
 		installedID, installedSerial, installedLocation, err := database.CheckVersionInBuild(packageName, installedDB)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				continue
-			} else {
-				return err
-			}
+		if err != nil && err != sql.ErrNoRows {
+			rows.Close()
+			return err
 		}
 
-		if (location == installedLocation && installedSerial > pkgSerial) || (installedID.Version() == packageIdNormalized.Version()) {
+		if err == nil && ((location == installedLocation && installedSerial > pkgSerial) || (installedID.Version() == packageIdNormalized.Version())) {
 			continue
 		}
 
@@ -482,7 +283,7 @@ func SolveDeps(id packet.PackageID, favoriteLocation string, installedDB *sql.DB
 	rows.Close()
 
 	// CONFLICTS
-	rows, err = sourcesDB.Query(BuildDependenciesQuery, id)
+	rows, err = sourcesDB.Query(ConflictsQuery, id)
 	if err != nil {
 		return err
 	}
@@ -493,12 +294,6 @@ func SolveDeps(id packet.PackageID, favoriteLocation string, installedDB *sql.DB
 			return err
 		}
 
-		packageIdNormalized := packet.NewId(packageId)
-		if err := SolveDeps(packageIdNormalized, favoriteLocation, installedDB, sourcesDB, &tempMap); err != nil {
-			rows.Close()
-			return err
-		}
-
 		if v, exists := tempMap["conflicts"][packageName]; exists {
 			if location == favoriteLocation || (v.Location == location && v.Serial > pkgSerial) {
 			} else {
@@ -3,10 +3,12 @@ package repo
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"runtime"
 	"strings"
 
+	"github.com/roboogg133/packets/cmd/packets/database"
 	"github.com/roboogg133/packets/pkg/packet.lua.d"
 )
 
@@ -32,22 +34,22 @@ type PackageJsonInfo struct {
 	AvailableCompiled bool `json:"compiled"`
 }
 
-func FetchPackagesToDB(url string, db *sql.DB) error {
+// FetchPackagesToDB downloads the index of the repository at url with client and replaces what db knows about it
+func FetchPackagesToDB(client *http.Client, url string, db *sql.DB) error {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Packets-Plataform", runtime.GOOS)
 
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return err
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status %s", url, resp.Status)
 	}
 
 	var data []PackageJsonInfo
@@ -57,40 +59,41 @@ func FetchPackagesToDB(url string, db *sql.DB) error {
 		return err
 	}
 
-	defer func() {
-		if r := recover(); r != nil {
-			if !strings.HasPrefix(r.(string), "UNIQUE constraint failed") {
-				panic(r)
-			}
-		}
-	}()
-
 	urlNormalized := strings.TrimPrefix(url, "https://")
 	urlNormalized = strings.TrimPrefix(urlNormalized, "http://")
 
-	for _, info := range data {
-		if _, err := db.Exec("INSERT OR REPLACE INTO packages (name, version, serial, maintainer, verified, description, upload_time, available_compiled, location, id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", info.Name, info.Version, info.Serial, info.Maintainer, info.Verified, info.Description, info.UploadTime, info.AvailableCompiled, urlNormalized, info.Id); err != nil {
-			return err
+	// the index replaces everything known about this repository at once, a failed sync leaves the previous one untouched
+	return database.Transaction(db, func(tx *sql.Tx) error {
+		for _, table := range []string{"packages", "dependencies", "build_dependencies", "conflicts"} {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE location = ?", urlNormalized); err != nil {
+				return err
+			}
 		}
 
-		for _, dep := range info.RuntimeDeps {
-			if _, err := db.Exec("INSERT OR REPLACE INTO dependencies (package_id, dependency_name, version_constraint, location) VALUES (?, ?, ?, ?)", info.Id, dep.Name, dep.Constraint, urlNormalized); err != nil {
-				panic(err)
+		for _, info := range data {
+			if _, err := database.TxExec(tx, db, "INSERT OR REPLACE INTO packages (name, version, serial, maintainer, verified, description, upload_time, available_compiled, location, id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", info.Name, info.Version, info.Serial, info.Maintainer, info.Verified, info.Description, info.UploadTime, info.AvailableCompiled, urlNormalized, info.Id); err != nil {
+				return err
 			}
-		}
 
-		for _, dep := range info.BuildDeps {
-			if _, err := db.Exec("INSERT OR REPLACE INTO dependencies (package_id, dependency_name, version_constraint, location) VALUES (?, ?, ?, ?)", info.Id, dep.Name, dep.Constraint, urlNormalized); err != nil {
-				panic(err)
+			for _, dep := range info.RuntimeDeps {
+				if _, err := database.TxExec(tx, db, "INSERT OR REPLACE INTO dependencies (package_id, dependency_name, version_constraint, location) VALUES (?, ?, ?, ?)", info.Id, dep.Name, dep.Constraint, urlNormalized); err != nil {
+					return err
+				}
 			}
-		}
 
-		for _, dep := range info.Conflicts {
-			if _, err := db.Exec("INSERT OR REPLACE INTO dependencies (package_id, dependency_name, version_constraint, location) VALUES (?, ?, ?, ?)", info.Id, dep.Name, dep.Constraint, urlNormalized); err != nil {
-				panic(err)
+			for _, dep := range info.BuildDeps {
+				if _, err := database.TxExec(tx, db, "INSERT OR REPLACE INTO build_dependencies (package_id, dependency_name, version_constraint, location) VALUES (?, ?, ?, ?)", info.Id, dep.Name, dep.Constraint, urlNormalized); err != nil {
+					return err
+				}
+			}
+
+			for _, dep := range info.Conflicts {
+				if _, err := database.TxExec(tx, db, "INSERT OR REPLACE INTO conflicts (package_id, dependency_name, version_constraint, location) VALUES (?, ?, ?, ?)", info.Id, dep.Name, dep.Constraint, urlNormalized); err != nil {
+					return err
+				}
 			}
 		}
-	}
 
-	return nil
+		return nil
+	})
 }
@@ -0,0 +1,124 @@
+package signature
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisign algorithms, ED signs the BLAKE2b-512 of the file and Ed the file itself
+const (
+	minisignPrehashed = "ED"
+	minisignLegacy    = "Ed"
+)
+
+type minisignKey struct {
+	id  uint64
+	key ed25519.PublicKey
+}
+
+// parseMinisignKey reads a public key, the untrusted comment line of a .pub file is skipped
+func parseMinisignKey(s string) (minisignKey, error) {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[len(lines)-1]))
+	if err != nil || len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != minisignLegacy {
+		return minisignKey{}, errors.New("invalid minisign public key")
+	}
+	return minisignKey{id: binary.LittleEndian.Uint64(raw[2:10]), key: ed25519.PublicKey(raw[10:])}, nil
+}
+
+type minisignSignature struct {
+	algorithm      string
+	keyId          uint64
+	signature      []byte
+	trustedComment string
+	globalSig      []byte
+}
+
+// parseMinisignSignature reads the four lines of a .minisig file
+func parseMinisignSignature(data []byte) (minisignSignature, error) {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return minisignSignature{}, errors.New("invalid minisign signature")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(raw) != 2+8+ed25519.SignatureSize {
+		return minisignSignature{}, errors.New("invalid minisign signature")
+	}
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return minisignSignature{}, errors.New("invalid minisign global signature")
+	}
+
+	return minisignSignature{
+		algorithm:      string(raw[:2]),
+		keyId:          binary.LittleEndian.Uint64(raw[2:10]),
+		signature:      raw[10:],
+		trustedComment: strings.TrimPrefix(lines[2], "trusted comment: "),
+		globalSig:      global,
+	}, nil
+}
+
+func verifyMinisign(signed io.Reader, data []byte, keys []string) (Result, error) {
+	sig, err := parseMinisignSignature(data)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var key *minisignKey
+	for _, s := range keys {
+		parsed, err := parseMinisignKey(s)
+		if err != nil {
+			return Result{}, err
+		}
+		if parsed.id == sig.keyId {
+			key = &parsed
+			break
+		}
+	}
+	keyId := fmt.Sprintf("%016X", sig.keyId)
+	if key == nil {
+		return Result{}, fmt.Errorf("minisign signature made by key %s, which is not listed", keyId)
+	}
+
+	var message []byte
+	switch sig.algorithm {
+	case minisignPrehashed:
+		hash, _ := blake2b.New512(nil)
+		if _, err := io.Copy(hash, signed); err != nil {
+			return Result{}, err
+		}
+		message = hash.Sum(nil)
+	case minisignLegacy:
+		if message, err = io.ReadAll(signed); err != nil {
+			return Result{}, err
+		}
+	default:
+		return Result{}, fmt.Errorf("unknown minisign algorithm %q", sig.algorithm)
+	}
+
+	if !ed25519.Verify(key.key, message, sig.signature) {
+		return Result{}, errors.New("minisign signature does not match the file")
+	}
+	// the trusted comment is signed together with the signature
+	if !ed25519.Verify(key.key, append(bytes.Clone(sig.signature), sig.trustedComment...), sig.globalSig) {
+		return Result{}, errors.New("minisign trusted comment was tampered with")
+	}
+
+	return Result{Type: Minisign, Fingerprint: keyId, Signer: sig.trustedComment}, nil
+}
@@ -0,0 +1,111 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const testKeyId = 0x1122334455667788
+
+type testSigner struct {
+	id   uint64
+	priv ed25519.PrivateKey
+}
+
+func newTestSigner(t *testing.T, id uint64) testSigner {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigner{id: id, priv: priv}
+}
+
+// publicKey is the .pub file of the signer
+func (s testSigner) publicKey() string {
+	raw := binary.LittleEndian.AppendUint64([]byte(minisignLegacy), s.id)
+	raw = append(raw, s.priv.Public().(ed25519.PublicKey)...)
+	return fmt.Sprintf("untrusted comment: minisign public key %016X\n%s\n", s.id, base64.StdEncoding.EncodeToString(raw))
+}
+
+// sign returns the .minisig of data made with algorithm
+func (s testSigner) sign(data []byte, algorithm, comment string) []byte {
+	message := data
+	if algorithm == minisignPrehashed {
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	}
+	signature := ed25519.Sign(s.priv, message)
+	raw := binary.LittleEndian.AppendUint64([]byte(algorithm), s.id)
+	raw = append(raw, signature...)
+	global := ed25519.Sign(s.priv, append(bytes.Clone(signature), comment...))
+
+	return []byte(fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(raw), comment, base64.StdEncoding.EncodeToString(global)))
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	signer := newTestSigner(t, testKeyId)
+	other := newTestSigner(t, 0x99)
+	// same id, another key
+	impostor := newTestSigner(t, testKeyId)
+
+	data := []byte("packets-1.0.tar.gz")
+	comment := "timestamp:1700000000\tfile:packets-1.0.tar.gz"
+	valid := signer.sign(data, minisignPrehashed, comment)
+
+	tests := []struct {
+		name string
+		data []byte
+		sig  []byte
+		keys []string
+		err  string
+	}{
+		{name: "prehashed", data: data, sig: valid, keys: []string{signer.publicKey()}},
+		{name: "legacy", data: data, sig: signer.sign(data, minisignLegacy, comment), keys: []string{signer.publicKey()}},
+		{name: "second key", data: data, sig: valid, keys: []string{other.publicKey(), signer.publicKey()}},
+		{name: "bare base64 key", data: data, sig: valid, keys: []string{strings.Split(signer.publicKey(), "\n")[1]}},
+		{name: "key not listed", data: data, sig: valid, keys: []string{other.publicKey()}, err: "not listed"},
+		{name: "wrong key with the same id", data: data, sig: valid, keys: []string{impostor.publicKey()}, err: "does not match"},
+		{name: "modified file", data: []byte("packets-1.1.tar.gz"), sig: valid, keys: []string{signer.publicKey()}, err: "does not match"},
+		{name: "tampered comment", data: data, sig: bytes.Replace(valid, []byte("timestamp:1700000000"), []byte("timestamp:1800000000"), 1), keys: []string{signer.publicKey()}, err: "tampered"},
+		{name: "unknown algorithm", data: data, sig: signer.sign(data, "EX", comment), keys: []string{signer.publicKey()}, err: "unknown minisign algorithm"},
+		{name: "truncated", data: data, sig: valid[:len(valid)/2], keys: []string{signer.publicKey()}, err: "invalid minisign"},
+		{name: "invalid key", data: data, sig: valid, keys: []string{"RWQ="}, err: "invalid minisign public key"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := verifyMinisign(bytes.NewReader(test.data), test.sig, test.keys)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := Result{Type: Minisign, Fingerprint: fmt.Sprintf("%016X", uint64(testKeyId)), Signer: comment}
+			if result != want {
+				t.Fatalf("got %+v, want %+v", result, want)
+			}
+		})
+	}
+}
+
+func TestDetect(t *testing.T) {
+	signer := newTestSigner(t, testKeyId)
+	if kind := Detect(signer.sign([]byte("x"), minisignPrehashed, "c")); kind != Minisign {
+		t.Errorf("a minisign signature is detected as %s", kind)
+	}
+	if kind := Detect([]byte("-----BEGIN PGP SIGNATURE-----\n")); kind != OpenPGP {
+		t.Errorf("an armored signature is detected as %s", kind)
+	}
+}
@@ -0,0 +1,94 @@
+package signature
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+const (
+	OpenPGP  = "openpgp"
+	Minisign = "minisign"
+)
+
+var ErrNoKeys = errors.New("no keys to verify the signature with")
+
+// Result is the key a file was verified with
+type Result struct {
+	Type string
+	// Fingerprint is the hex fingerprint of the OpenPGP primary key, or the minisign key id
+	Fingerprint string
+	// Signer is the user id of the OpenPGP key, or the trusted comment of the minisign signature
+	Signer string
+}
+
+// Detect returns the type of a detached signature
+func Detect(sig []byte) string {
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("untrusted comment:")) {
+		return Minisign
+	}
+	return OpenPGP
+}
+
+// VerifyFile checks the detached signature sig of the file at path against keys, any of them may have made it.
+// OpenPGP keys are armored public key blocks, minisign keys are the base64 public key
+func VerifyFile(path string, sig []byte, keys []string, kind string) (Result, error) {
+	if len(keys) == 0 {
+		return Result{}, ErrNoKeys
+	}
+	if kind == "" {
+		kind = Detect(sig)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer file.Close()
+
+	switch kind {
+	case OpenPGP:
+		return verifyOpenPGP(file, sig, keys)
+	case Minisign:
+		return verifyMinisign(file, sig, keys)
+	}
+	return Result{}, fmt.Errorf("unknown signature type %s", kind)
+}
+
+func verifyOpenPGP(signed io.Reader, sig []byte, keys []string) (Result, error) {
+	var keyring openpgp.EntityList
+	for _, key := range keys {
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key))
+		if err != nil {
+			return Result{}, fmt.Errorf("reading OpenPGP key: %w", err)
+		}
+		keyring = append(keyring, entities...)
+	}
+
+	// .asc signatures are armored, .sig ones are binary
+	var sigReader io.Reader = bytes.NewReader(sig)
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN")) {
+		block, err := armor.Decode(bytes.NewReader(sig))
+		if err != nil {
+			return Result{}, fmt.Errorf("reading signature: %w", err)
+		}
+		sigReader = block.Body
+	}
+
+	_, signer, err := openpgp.VerifyDetachedSignature(keyring, signed, sigReader, nil)
+	if err != nil {
+		return Result{}, fmt.Errorf("OpenPGP signature: %w", err)
+	}
+
+	result := Result{Type: OpenPGP, Fingerprint: fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)}
+	if identity := signer.PrimaryIdentity(); identity != nil {
+		result.Signer = identity.Name
+	}
+	return result, nil
+}
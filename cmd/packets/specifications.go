@@ -9,10 +9,15 @@ const (
 	ConfigurationDir       = "/etc/packets"
 	InternalDB             = ConfigurationDir + "/internal.db"
 	SourceDB               = ConfigurationDir + "/source.db"
+	CredentialsFile        = ConfigurationDir + "/credentials.toml"
 	PacketsUsername        = "packets"
 	HomeDir                = "/var/lib/packets"
 	PackageRootDir         = "/var/lib/packets/packages"
 	PackageBuildDepsFS     = "/var/lib/packets/buildPackages"
+	PayloadsDir            = "/var/lib/packets/payloads"
+	CacheDir               = "/var/lib/packets/cache"
+	DefaultCacheMaxSizeMB  = 4096
+	DefaultGenerationsKept = 10
 	LockFileName           = "packet.lock"
 	NumberOfTryAttempts    = 4
 	UserHomeDirPlaceholder = "{{ USER HOME FOLDER }}"
@@ -22,4 +27,5 @@ const (
 const (
 	PrefixForLocations = "https://"
 	PrefixForPackages  = "pkg"
+	LocalLocation      = "local"
 )
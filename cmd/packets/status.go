@@ -0,0 +1,318 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/roboogg133/packets/cmd/packets/database"
+	"github.com/roboogg133/packets/cmd/packets/lockfile"
+	"github.com/roboogg133/packets/cmd/packets/oplock"
+	"github.com/roboogg133/packets/pkg/install"
+	"github.com/roboogg133/packets/pkg/packet.lua.d"
+	"github.com/spf13/cobra"
+)
+
+// InterruptedInstall is a PackageRootDir entry whose install never completed
+type InterruptedInstall struct {
+	Id      packet.PackageID
+	RootDir string
+	// LockFile is nil when the .pkt was not completely unpacked
+	LockFile *lockfile.Lockfile
+
+	Phase  string
+	Status string
+}
+
+// InspectRootDir returns the interrupted install in rootdir, false means the package was installed
+func InspectRootDir(rootdir string, db *sql.DB) (InterruptedInstall, bool, error) {
+	interrupted := InterruptedInstall{
+		Id:      packet.PackageID(filepath.Base(rootdir)),
+		RootDir: rootdir,
+	}
+
+	lf, err := lockfile.Read(filepath.Join(rootdir, LockFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		interrupted.Phase = lockfile.DownloadPhase
+		return interrupted, true, nil
+	} else if err != nil {
+		return interrupted, false, err
+	}
+	interrupted.LockFile = lf
+
+	if lf.Completed != nil {
+		return interrupted, false, nil
+	}
+
+	// lockfiles written before completion was recorded only know it through the database
+	if installed, err := database.SearchIfIsInstalled(string(interrupted.Id), db); err != nil || installed {
+		return interrupted, false, err
+	}
+	if installed, err := database.SearchIfIsBuildPackage(string(interrupted.Id), db); err != nil || installed {
+		return interrupted, false, err
+	}
+
+	interrupted.Phase, interrupted.Status = lf.StoppedIn()
+	return interrupted, true, nil
+}
+
+// ListInterrupted inspects every PackageRootDir entry
+func ListInterrupted(db *sql.DB) ([]InterruptedInstall, error) {
+	entries, err := os.ReadDir(PackageRootDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var list []InterruptedInstall
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		interrupted, ok, err := InspectRootDir(filepath.Join(PackageRootDir, entry.Name()), db)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			continue
+		}
+		if ok {
+			list = append(list, interrupted)
+		}
+	}
+	return list, nil
+}
+
+func describeStatus(status string) string {
+	switch status {
+	case "":
+		return "not started"
+	case lockfile.StatusRunning:
+		return "interrupted"
+	}
+	return status
+}
+
+// ResumeTarget rebuilds the install target recorded in the lockfile of an interrupted install
+func ResumeTarget(interrupted InterruptedInstall) (InstallTarget, error) {
+	lf := interrupted.LockFile
+	if lf == nil {
+		return InstallTarget{}, fmt.Errorf("%s was not completely downloaded, abort it and install it again", interrupted.Id)
+	}
+
+	target := InstallTarget{
+		Id:       interrupted.Id,
+		Location: lf.Location,
+		Prefix:   lf.Prefix,
+		Reason:   lf.Reason,
+	}
+
+	// lockfiles written before the target was recorded still have the url the .pkt came from
+	if target.Location == "" {
+		for _, download := range lf.Downloads {
+			if download.Kind == lockfile.PackageDownload {
+				host, _, _ := strings.Cut(strings.TrimPrefix(download.Url, PrefixForLocations), "/")
+				target.Location = host
+				break
+			}
+		}
+	}
+	if target.Location == "" {
+		return InstallTarget{}, fmt.Errorf("can't tell where %s comes from, abort it and install it again", interrupted.Id)
+	}
+	if target.Reason == "" {
+		target.Reason = database.ReasonExplicit
+	}
+	return target, nil
+}
+
+// AbortInstall removes whatever an interrupted install already copied and deletes its PackageRootDir entry
+func AbortInstall(interrupted InterruptedInstall, db *sql.DB) error {
+	if filepath.Dir(interrupted.RootDir) != filepath.Clean(PackageRootDir) {
+		return fmt.Errorf("refusing to remove %s outside %s", interrupted.RootDir, PackageRootDir)
+	}
+
+	if lf := interrupted.LockFile; lf != nil {
+		if lf.Prefix != "" {
+			if !strings.HasPrefix(filepath.Clean(lf.Prefix), filepath.Clean(PackageBuildDepsFS)+string(os.PathSeparator)) {
+				return fmt.Errorf("refusing to remove %s outside %s", lf.Prefix, PackageBuildDepsFS)
+			}
+			if err := os.RemoveAll(lf.Prefix); err != nil {
+				return err
+			}
+		} else {
+			var files []install.BasicFileStatus
+			for _, p := range lf.InstalledPaths() {
+				info, err := os.Lstat(p)
+				if err != nil {
+					continue
+				}
+				files = append(files, install.BasicFileStatus{Filepath: p, IsDir: info.IsDir()})
+			}
+			if err := RemoveFiles(files, interrupted.Id, db); err != nil {
+				return err
+			}
+		}
+	}
+
+	return os.RemoveAll(interrupted.RootDir)
+}
+
+// findInterrupted resolves a command argument to an interrupted install
+func findInterrupted(nameOrId string, db *sql.DB) (InterruptedInstall, error) {
+	rootdir, err := FindPackageRootDir(nameOrId)
+	if err != nil {
+		return InterruptedInstall{}, err
+	}
+
+	interrupted, ok, err := InspectRootDir(rootdir, db)
+	if err != nil {
+		return InterruptedInstall{}, err
+	}
+	if !ok {
+		return InterruptedInstall{}, fmt.Errorf("%s is not an interrupted install", filepath.Base(rootdir))
+	}
+	return interrupted, nil
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "List interrupted installs",
+	Long:  "List every package whose install did not complete and the phase it stopped in",
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		list, err := ListInterrupted(db)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		if len(list) == 0 {
+			fmt.Println("no interrupted installs")
+			return
+		}
+		if !oplock.Free(filepath.Join(HomeDir, oplock.FileName)) {
+			fmt.Print("==> another packets process holds the operation lock, what it is installing is listed too\n\n")
+		}
+
+		for _, interrupted := range list {
+			fmt.Printf("\033[1m==> %s\033[0m\n", interrupted.Id)
+			fmt.Printf("  \033[1mStopped in:\033[0m %s (%s)\n", interrupted.Phase, describeStatus(interrupted.Status))
+			if lf := interrupted.LockFile; lf != nil {
+				if phase := lf.LastPhase(interrupted.Phase); phase != nil {
+					if phase.Error != "" {
+						fmt.Printf("  \033[1mError:\033[0m %s\n", phase.Error)
+					}
+					if phase.Log != "" {
+						fmt.Printf("  \033[1mLog:\033[0m %s\n", phase.Log)
+					}
+				}
+			}
+			fmt.Print("\n")
+		}
+	},
+}
+
+var resumeCmd = &cobra.Command{
+	Use:   "resume {name or id} ...",
+	Short: "Continue an interrupted install",
+	Long:  "Continue an interrupted install from the phase it stopped in",
+	Args:  cobra.MinimumNArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		GrantPrivilegies()
+		return GetConfiguration()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		failed := false
+		for _, arg := range args {
+			interrupted, err := findInterrupted(arg, db)
+			if err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				failed = true
+				continue
+			}
+
+			target, err := ResumeTarget(interrupted)
+			if err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				failed = true
+				continue
+			}
+
+			fmt.Printf("=> resuming %s from %s\n", target.Id, interrupted.Phase)
+
+			if target.Location != LocalLocation && !interrupted.LockFile.Downloaded(target.Url()) {
+				if err := FetchPackage(target); err != nil {
+					_ = ElevatePermission()
+					fmt.Printf("error: %s\n", err.Error())
+					failed = true
+					continue
+				}
+				_ = ElevatePermission()
+			}
+
+			if err := InstallPackage(target, db); err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				failed = true
+				continue
+			}
+			fmt.Printf("=> %s installed\n", target.Id)
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+var abortCmd = &cobra.Command{
+	Use:   "abort {name or id} ...",
+	Short: "Roll back an interrupted install",
+	Long:  "Remove the files an interrupted install already copied and delete its package directory",
+	Args:  cobra.MinimumNArgs(1),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		GrantPrivilegies()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		failed := false
+		for _, arg := range args {
+			interrupted, err := findInterrupted(arg, db)
+			if err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				failed = true
+				continue
+			}
+
+			if err := AbortInstall(interrupted, db); err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				failed = true
+				continue
+			}
+			fmt.Printf("=> aborted %s\n", interrupted.Id)
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
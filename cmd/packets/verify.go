@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/roboogg133/packets/cmd/packets/database"
+	"github.com/roboogg133/packets/pkg/install"
+	"github.com/roboogg133/packets/pkg/packet.lua.d"
+	"github.com/spf13/cobra"
+)
+
+type verifyProblem struct {
+	Package packet.PackageID `json:"package"`
+	install.Problem
+}
+
+type verifyReport struct {
+	CheckedPackages int             `json:"checked_packages"`
+	CheckedFiles    int             `json:"checked_files"`
+	Problems        []verifyProblem `json:"problems"`
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [name or id] ...",
+	Short: "Verify installed files",
+	Long:  "Report installed files that were modified, removed or had their permissions or owner changed",
+	Run: func(cmd *cobra.Command, args []string) {
+		asJson, _ := cmd.Flags().GetBool("json")
+
+		db, err := database.OpenInternal(InternalDB)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		var ids []packet.PackageID
+		if len(args) == 0 {
+			pkgs, err := database.ListAllInstalledPackages(db)
+			if err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				os.Exit(1)
+			}
+			for _, pkg := range pkgs {
+				ids = append(ids, packet.NewId(pkg.Id))
+			}
+		}
+		for _, arg := range args {
+			id, err := database.GetPackageId(arg, db)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					fmt.Printf("package %s not found\n", arg)
+					os.Exit(1)
+				}
+				fmt.Printf("error: %s\n", err.Error())
+				os.Exit(1)
+			}
+			ids = append(ids, id)
+		}
+
+		report := verifyReport{Problems: []verifyProblem{}}
+		for _, id := range ids {
+			files, err := database.GetPackageFiles(id, db)
+			if err != nil {
+				fmt.Printf("error: %s\n", err.Error())
+				os.Exit(1)
+			}
+			report.CheckedPackages++
+
+			for _, file := range files {
+				problems, err := install.Verify(file)
+				if err != nil {
+					// printing it would break the JSON report, a file that can't be checked is a problem too
+					problem := install.Problem{Kind: install.ProblemUnreadable, Path: file.Filepath, Actual: err.Error()}
+					report.Problems = append(report.Problems, verifyProblem{Package: id, Problem: problem})
+					continue
+				}
+				report.CheckedFiles++
+				for _, problem := range problems {
+					report.Problems = append(report.Problems, verifyProblem{Package: id, Problem: problem})
+				}
+			}
+		}
+
+		if asJson {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(report)
+		} else {
+			for _, problem := range report.Problems {
+				fmt.Printf("\033[1m%s\033[0m %s %s", problem.Package, problem.Kind, problem.Path)
+				switch {
+				case problem.Expected != "":
+					fmt.Printf(" (expected %s, found %s)", problem.Expected, problem.Actual)
+				case problem.Actual != "":
+					fmt.Printf(" (%s)", problem.Actual)
+				}
+				fmt.Print("\n")
+			}
+			fmt.Printf("%d packages, %d files checked, %d problems\n", report.CheckedPackages, report.CheckedFiles, len(report.Problems))
+		}
+
+		if len(report.Problems) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	verifyCmd.Flags().Bool("json", false, "print the report as JSON")
+}
@@ -10,6 +10,7 @@ CREATE TABLE installed_packages(
     installed_time INTEGER NOT NULL,
 
     location TEXT NOT NULL,
+    install_reason TEXT NOT NULL DEFAULT 'explicit',
 
     image BLOB,
 
@@ -18,13 +19,22 @@ CREATE TABLE installed_packages(
 );
 
 CREATE TABLE package_files(
-    package_id TEXT PRIMARY KEY,
+    package_id TEXT NOT NULL,
     filepath TEXT NOT NULL,
     is_dir INTEGER NOT NULL DEFAULT 0,
 
-    UNIQUE(package_id, filepath)
+    sha256 TEXT,
+    mode INTEGER,
+    uid INTEGER,
+    gid INTEGER,
+    size INTEGER,
+    link_target TEXT,
+
+    PRIMARY KEY (package_id, filepath)
 );
 
+CREATE INDEX package_files_filepath ON package_files(filepath);
+
 CREATE TABLE dependencies(
     package_id TEXT NOT NULL,
     dependency_name TEXT NOT NULL,
@@ -76,3 +86,36 @@ CREATE TABLE build_packages(
     UNIQUE(name, version),
     UNIQUE(name, serial)
 );
+
+CREATE TABLE history(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    time INTEGER NOT NULL,
+    user TEXT NOT NULL,
+    command TEXT NOT NULL
+);
+
+CREATE TABLE history_packages(
+    history_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    before_id TEXT,
+    after_id TEXT,
+    location TEXT NOT NULL,
+    install_reason TEXT NOT NULL
+);
+
+CREATE INDEX history_packages_history_id ON history_packages(history_id);
+
+CREATE TABLE generations(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    time INTEGER NOT NULL,
+    history_id INTEGER UNIQUE
+);
+
+CREATE TABLE generation_packages(
+    generation_id INTEGER NOT NULL,
+    package_id TEXT NOT NULL,
+    location TEXT NOT NULL,
+    install_reason TEXT NOT NULL,
+
+    PRIMARY KEY (generation_id, package_id)
+);
@@ -11,7 +11,7 @@ CREATE TABLE packages(
     location TEXT NOT NULL,
     available_compiled INTEGER NOT NULL DEFAULT 0,
 
-    PRIMARY KEY (location, id)
+    PRIMARY KEY (location, id),
     UNIQUE(name, version, location),
     UNIQUE(name, serial, location)
 );
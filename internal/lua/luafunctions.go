@@ -2,10 +2,13 @@ package lua
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 
 	lua "github.com/yuin/gopher-lua"
 )
@@ -110,16 +113,16 @@ func LMkdir(L *lua.LState) int {
 	return 2
 }
 
+// LError raises a Lua error with every argument joined, so it is caught by the caller of build() or install()
 func LError(L *lua.LState) int {
 	n := L.GetTop()
-	parts := make([]any, 0, n)
+	parts := make([]string, 0, n)
 
 	for i := 1; i <= n; i++ {
-		val := L.Get(i)
-		parts = append(parts, val.String())
+		parts = append(parts, L.Get(i).String())
 	}
 
-	llogger().Panic(parts...)
+	L.RaiseError("%s", strings.Join(parts, " "))
 	return 0
 }
 
@@ -168,4 +171,45 @@ func LChmod(L *lua.LState) int {
 	return 2
 }
 
-func llogger() *log.Logger { return log.New(os.Stderr, "script error: ", 0) }
+// LPrint returns a print() replacement that writes to w instead of the process stdout
+func LPrint(w io.Writer) lua.LGFunction {
+	return func(L *lua.LState) int {
+		top := L.GetTop()
+		for i := 1; i <= top; i++ {
+			fmt.Fprint(w, L.ToStringMeta(L.Get(i)).String())
+			if i != top {
+				fmt.Fprint(w, "\t")
+			}
+		}
+		fmt.Fprintln(w)
+		return 0
+	}
+}
+
+// LExecute returns an os.execute() replacement that sends the command stdout and stderr to w
+func LExecute(w io.Writer) lua.LGFunction {
+	return func(L *lua.LState) int {
+		command := L.CheckString(1)
+
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("C:\\Windows\\system32\\cmd.exe", "/c", command)
+		} else {
+			cmd = exec.Command("/bin/sh", "-c", command)
+		}
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = w
+		cmd.Stderr = w
+
+		if err := cmd.Run(); err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				L.Push(lua.LNumber(exitErr.ExitCode()))
+				return 1
+			}
+			L.Push(lua.LNumber(1))
+			return 1
+		}
+		L.Push(lua.LNumber(0))
+		return 1
+	}
+}
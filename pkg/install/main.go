@@ -1,11 +1,123 @@
 package install
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"os"
 )
 
+// UnknownOwner is the UID and GID of files recorded before ownership was tracked
+const UnknownOwner = -1
+
 type BasicFileStatus struct {
-	Filepath string
-	PermMode os.FileMode
-	IsDir    bool
+	Filepath   string
+	PermMode   os.FileMode
+	IsDir      bool
+	SHA256     string
+	Size       int64
+	UID        int
+	GID        int
+	LinkTarget string
+}
+
+const (
+	ProblemMissing  = "missing"
+	ProblemModified = "modified"
+	ProblemMode     = "mode"
+	ProblemOwner    = "owner"
+	// ProblemUnreadable is a file that could not be checked, Actual is why
+	ProblemUnreadable = "unreadable"
+)
+
+// Problem is a difference between what was installed and what is in the filesystem now
+type Problem struct {
+	Kind     string `json:"kind"`
+	Path     string `json:"path"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+// Stat reads the current status of path without following symlinks, regular files are hashed
+func Stat(path string) (BasicFileStatus, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return BasicFileStatus{}, err
+	}
+
+	status := BasicFileStatus{
+		Filepath: path,
+		PermMode: info.Mode(),
+		IsDir:    info.IsDir(),
+	}
+	status.UID, status.GID = owner(info)
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		status.LinkTarget, err = os.Readlink(path)
+		if err != nil {
+			return BasicFileStatus{}, err
+		}
+	case info.Mode().IsRegular():
+		status.Size = info.Size()
+		status.SHA256, err = hashFile(path)
+		if err != nil {
+			return BasicFileStatus{}, err
+		}
+	}
+
+	return status, nil
+}
+
+// Verify compares a recorded status with the filesystem, fields that were never recorded are not checked
+func Verify(recorded BasicFileStatus) ([]Problem, error) {
+	current, err := Stat(recorded.Filepath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Problem{{Kind: ProblemMissing, Path: recorded.Filepath}}, nil
+		}
+		return nil, err
+	}
+
+	var problems []Problem
+
+	if recorded.PermMode != 0 && recorded.PermMode.Type() != current.PermMode.Type() {
+		problems = append(problems, Problem{Kind: ProblemModified, Path: recorded.Filepath, Expected: "type " + recorded.PermMode.Type().String(), Actual: "type " + current.PermMode.Type().String()})
+		return problems, nil
+	}
+
+	switch {
+	case recorded.LinkTarget != "" && recorded.LinkTarget != current.LinkTarget:
+		problems = append(problems, Problem{Kind: ProblemModified, Path: recorded.Filepath, Expected: recorded.LinkTarget, Actual: current.LinkTarget})
+	case recorded.SHA256 != "" && recorded.SHA256 != current.SHA256:
+		problems = append(problems, Problem{Kind: ProblemModified, Path: recorded.Filepath, Expected: "sha256 " + recorded.SHA256, Actual: "sha256 " + current.SHA256})
+	case recorded.SHA256 != "" && recorded.Size != current.Size:
+		problems = append(problems, Problem{Kind: ProblemModified, Path: recorded.Filepath, Expected: fmt.Sprintf("%d bytes", recorded.Size), Actual: fmt.Sprintf("%d bytes", current.Size)})
+	}
+
+	// symlink permissions are meaningless on most systems
+	if recorded.PermMode != 0 && current.PermMode&os.ModeSymlink == 0 && recorded.PermMode.Perm() != current.PermMode.Perm() {
+		problems = append(problems, Problem{Kind: ProblemMode, Path: recorded.Filepath, Expected: recorded.PermMode.Perm().String(), Actual: current.PermMode.Perm().String()})
+	}
+
+	if recorded.UID != UnknownOwner && (recorded.UID != current.UID || recorded.GID != current.GID) {
+		problems = append(problems, Problem{Kind: ProblemOwner, Path: recorded.Filepath, Expected: fmt.Sprintf("%d:%d", recorded.UID, recorded.GID), Actual: fmt.Sprintf("%d:%d", current.UID, current.GID)})
+	}
+
+	return problems, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
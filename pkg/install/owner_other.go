@@ -0,0 +1,7 @@
+//go:build !unix
+
+package install
+
+import "os"
+
+func owner(info os.FileInfo) (int, int) { return UnknownOwner, UnknownOwner }
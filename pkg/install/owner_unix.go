@@ -0,0 +1,15 @@
+//go:build unix
+
+package install
+
+import (
+	"os"
+	"syscall"
+)
+
+func owner(info os.FileInfo) (int, int) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(stat.Uid), int(stat.Gid)
+	}
+	return UnknownOwner, UnknownOwner
+}
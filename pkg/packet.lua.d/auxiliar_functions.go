@@ -99,21 +99,30 @@ func getSourcesFromTable(table *lua.LTable, key string) []Source {
 				srcInfo.Url = url.String()
 			}
 
+			if mirrorsL := src.RawGetString("mirrors"); mirrorsL.Type() == lua.LTTable {
+				mirrorsL.(*lua.LTable).ForEach(func(_, value lua.LValue) {
+					if value.Type() == lua.LTString {
+						srcInfo.Mirrors = append(srcInfo.Mirrors, value.String())
+					}
+				})
+			}
+
+			if signatureL := src.RawGetString("signature"); signatureL.Type() == lua.LTTable {
+				signatureTable := signatureL.(*lua.LTable)
+				srcInfo.Signature = &Signature{
+					Url:  getStringFromTable(signatureTable, "url"),
+					Keys: getStringArrayFromTable(signatureTable, "keys"),
+					Type: getStringFromTable(signatureTable, "type"),
+				}
+			}
+
 		switchlabel:
 			switch srcInfo.Method {
 			case "GET":
 				var getSpecs GETSpecs
 
 				getSpecs.SHA256 = new([]string)
-				sha256sumL := src.RawGetString("sha256")
-				if sha256sumL.Type() == lua.LTTable {
-					shatable := sha256sumL.(*lua.LTable)
-					shatable.ForEach(func(_, value lua.LValue) {
-						if value.Type() == lua.LTString {
-							*getSpecs.SHA256 = append(*getSpecs.SHA256, value.String())
-						}
-					})
-				}
+				*getSpecs.SHA256, getSpecs.Digests = getDigestsFromTable(src)
 
 				headersLT := src.RawGetString("headers")
 				if headersLT.Type() == lua.LTTable {
@@ -144,23 +153,21 @@ func getSourcesFromTable(table *lua.LTable, key string) []Source {
 				tagL := src.RawGetString("tag")
 
 				if tagL.Type() == lua.LTString {
-					*gitSpecs.Tag = tagL.String()
+					tag := tagL.String()
+					gitSpecs.Tag = &tag
 				}
 
+				gitSpecs.Commit = getStringFromTable(src, "commit")
+				gitSpecs.Submodules = lua.LVAsBool(src.RawGetString("submodules"))
+				gitSpecs.Paths = getStringArrayFromTable(src, "paths")
+
 				srcInfo.Specs = gitSpecs
 				break switchlabel
 			case "POST":
 				var postSpecs POSTSpecs
 
-				sha256sumL := src.RawGetString("sha256")
-				if sha256sumL.Type() == lua.LTTable {
-					shatable := sha256sumL.(*lua.LTable)
-					shatable.ForEach(func(_, value lua.LValue) {
-						if value.Type() == lua.LTString {
-							*postSpecs.SHA256 = append(*postSpecs.SHA256, value.String())
-						}
-					})
-				}
+				postSpecs.SHA256 = new([]string)
+				*postSpecs.SHA256, postSpecs.Digests = getDigestsFromTable(src)
 
 				headersLT := src.RawGetString("headers")
 				if headersLT.Type() == lua.LTTable {
@@ -180,7 +187,8 @@ func getSourcesFromTable(table *lua.LTable, key string) []Source {
 				bodyLt := src.RawGetString("body")
 
 				if bodyLt.Type() == lua.LTString {
-					*postSpecs.Body = bodyLt.String()
+					body := bodyLt.String()
+					postSpecs.Body = &body
 				}
 
 				srcInfo.Specs = postSpecs
@@ -193,6 +201,68 @@ func getSourcesFromTable(table *lua.LTable, key string) []Source {
 	return srcList
 }
 
+// getDigestStrings reads a list of sums, a single sum can be given as a string
+func getDigestStrings(table *lua.LTable, key string) []string {
+	if sum := getStringFromTable(table, key); sum != "" {
+		return []string{strings.ToLower(sum)}
+	}
+	var sums []string
+	for _, sum := range getStringArrayFromTable(table, key) {
+		sums = append(sums, strings.ToLower(sum))
+	}
+	return sums
+}
+
+// getDigestsFromTable returns the sha256 sums of a source or patch and its digests of the other algorithms
+func getDigestsFromTable(table *lua.LTable) ([]string, []Digest) {
+	var digests []Digest
+	for _, algorithm := range DigestAlgorithms {
+		if algorithm == SHA256 {
+			continue
+		}
+		for _, sum := range getDigestStrings(table, algorithm) {
+			digests = append(digests, Digest{Algorithm: algorithm, Sum: sum})
+		}
+	}
+	return getDigestStrings(table, SHA256), digests
+}
+
+// defaultPatchStrip is the strip of a patch that sets none, diffs made by git and diff -ru have one component
+const defaultPatchStrip = 1
+
+func getPatchesFromTable(table *lua.LTable, key string) []Patch {
+	value := table.RawGetString(key)
+	if value.Type() != lua.LTTable {
+		return nil
+	}
+
+	var patches []Patch
+	value.(*lua.LTable).ForEach(func(_, value lua.LValue) {
+		if value.Type() != lua.LTTable {
+			return
+		}
+		patchTable := value.(*lua.LTable)
+
+		patch := Patch{
+			File:    getStringFromTable(patchTable, "file"),
+			Url:     getStringFromTable(patchTable, "url"),
+			Mirrors: getStringArrayFromTable(patchTable, "mirrors"),
+			Strip:   defaultPatchStrip,
+			Dir:     getStringFromTable(patchTable, "dir"),
+		}
+		if strip := patchTable.RawGetString("strip"); strip.Type() == lua.LTNumber {
+			patch.Strip = int(strip.(lua.LNumber))
+		}
+
+		patch.SHA256, patch.Digests = getDigestsFromTable(patchTable)
+
+		if patch.File != "" || patch.Url != "" {
+			patches = append(patches, patch)
+		}
+	})
+	return patches
+}
+
 func getPlataformsFromTable(table *lua.LTable, key string) map[OperationalSystem]Plataform {
 	value := table.RawGetString(key)
 
@@ -213,6 +283,7 @@ func getPlataformsFromTable(table *lua.LTable, key string) map[OperationalSystem
 		plat.Architetures = getStringArrayFromTable(value.(*lua.LTable), "arch")
 		plat.Name = osString.String()
 		plat.Sources = getSourcesFromTable(value.(*lua.LTable), "sources")
+		plat.Patches = getPatchesFromTable(value.(*lua.LTable), "patches")
 		plat.Dependencies = getDependenciesFromTable(value.(*lua.LTable), "dependencies")
 
 		tmpMap[OperationalSystem(osString.String())] = plat
@@ -1,9 +1,17 @@
 package packet
 
+import "io"
+
 type Config struct {
 	BinDir     string
 	SourcesDir string
 	RootDir    string
+
+	// Output receives everything build() and install() print or execute, nil keeps the process stdout
+	Output io.Writer
+
+	// Env holds KEY=VALUE entries set only while build() and install() run
+	Env []string
 }
 
 const defaultBinDir = "/usr/bin"
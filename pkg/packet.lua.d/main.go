@@ -3,17 +3,17 @@ package packet
 import (
 	"archive/tar"
 	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"slices"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/go-git/go-git/v6"
 	"github.com/go-git/go-git/v6/plumbing"
@@ -36,6 +36,7 @@ type PacketLua struct {
 
 	Plataforms         map[OperationalSystem]Plataform
 	GlobalSources      []Source
+	GlobalPatches      []Patch
 	GlobalDependencies PkgDependencies
 
 	Flags []Flag
@@ -70,7 +71,43 @@ type Flag struct {
 type Source struct {
 	Method string
 	Url    string
-	Specs  any
+	// Mirrors are tried in order when Url fails
+	Mirrors []string
+	Specs   any
+	// Signature is verified before a GET or POST source is extracted, nil when there is none
+	Signature *Signature
+}
+
+// Signature is a detached OpenPGP or minisign signature of a source
+type Signature struct {
+	Url string
+	// Keys are armored OpenPGP public keys or minisign public keys, the source must be signed by one of them
+	Keys []string
+	// Type is "openpgp" or "minisign", empty detects it from the signature
+	Type string
+}
+
+// Patch is a unified diff applied to the sources after they are downloaded and before build()
+type Patch struct {
+	// File is the path of a patch shipped inside the .pkt, relative to the package root dir
+	File string
+	// Url is a patch downloaded like a GET source, when there is no File
+	Url     string
+	Mirrors []string
+	SHA256  []string
+	Digests []Digest
+	// Strip is how many leading path components are removed from the names in the diff, like patch -p
+	Strip int
+	// Dir is the directory the patch is applied in, relative to SOURCESDIR
+	Dir string
+}
+
+// Name is how the patch is called in the output and in the lockfile
+func (p Patch) Name() string {
+	if p.File != "" {
+		return p.File
+	}
+	return p.Url
 }
 
 type VersionConstraint string
@@ -85,36 +122,115 @@ type Plataform struct {
 	Name         string
 	Architetures []string
 	Sources      []Source
+	Patches      []Patch
 	Dependencies PkgDependencies
 }
 
 type GitSpecs struct {
 	Branch string
 	Tag    *string
+	// Commit pins the source, it is checked out after the clone and verified
+	Commit string
+	// Submodules checks out the submodules of the commit too
+	Submodules bool
+	// Paths are the only directories checked out, none checks out everything
+	Paths []string
 }
 
 type POSTSpecs struct {
 	SHA256  *[]string
+	Digests []Digest
 	Body    *string
 	Headers *map[string]string
 }
 
 type GETSpecs struct {
 	SHA256  *[]string
+	Digests []Digest
 	Headers *map[string]string
 }
 
+const (
+	SHA256  = "sha256"
+	SHA512  = "sha512"
+	BLAKE2b = "blake2b"
+	BLAKE3  = "blake3"
+)
+
+// DigestAlgorithms are the digests a source can list, each under its own key. blake2b is BLAKE2b-512 and
+// blake3 the 256 bits default output
+var DigestAlgorithms = []string{SHA256, SHA512, BLAKE2b, BLAKE3}
+
+// Digest is an expected sum of a source, for an algorithm listed more than once any of its sums is accepted
+type Digest struct {
+	Algorithm string
+	Sum       string
+}
+
 var ErrCantFindPacketDotLua = errors.New("can't find Packet.lua in .tar.zst file")
 var ErrFileDontReturnTable = errors.New("invalid Packet.lua format: the file do not return a table")
 var ErrCannotFindPackageTable = errors.New("invalid Packet.lua format: can't find package table")
 var ErrInstallFunctionDoesNotExist = errors.New("can not find install()")
 var ErrSha256Sum = errors.New("false checksum")
 
+// ErrDigestMismatch is a file failing one of its digests, whatever the algorithm
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// PacketDotLuaChunkName is the chunk name scripts are loaded with, it prefixes every position in Lua errors
+const PacketDotLuaChunkName = "Packet.lua"
+
+var luaPositionRegex = regexp.MustCompile(regexp.QuoteMeta(PacketDotLuaChunkName) + `:(\d+):`)
+
+// ScriptError is returned when build() or install() raises a Lua error
+type ScriptError struct {
+	Phase      string
+	PackageID  PackageID
+	Line       int
+	Message    string
+	StackTrace string
+}
+
+func (e *ScriptError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s of %s failed at %s:%d: %s", e.Phase, e.PackageID, PacketDotLuaChunkName, e.Line, e.Message)
+	}
+	return fmt.Sprintf("%s of %s failed: %s", e.Phase, e.PackageID, e.Message)
+}
+
+func newScriptError(phase string, id PackageID, err error) *ScriptError {
+	scriptErr := &ScriptError{
+		Phase:     phase,
+		PackageID: id,
+		Message:   err.Error(),
+	}
+
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		scriptErr.Message = apiErr.Object.String()
+		scriptErr.StackTrace = apiErr.StackTrace
+	}
+
+	// the error position comes first, when the message has none use the innermost Packet.lua frame
+	if match := luaPositionRegex.FindStringSubmatch(scriptErr.Message); match != nil {
+		scriptErr.Line, _ = strconv.Atoi(match[1])
+		scriptErr.Message = strings.TrimSpace(strings.TrimPrefix(scriptErr.Message[strings.Index(scriptErr.Message, match[0]):], match[0]))
+	} else if match := luaPositionRegex.FindStringSubmatch(scriptErr.StackTrace); match != nil {
+		scriptErr.Line, _ = strconv.Atoi(match[1])
+	}
+
+	return scriptErr
+}
+
 // ReadPacket read a Packet.lua and alredy set global vars
-func ReadPacket(f []byte, cfg *Config) (PacketLua, error) {
+func ReadPacket(f []byte, cfg *Config) (_ PacketLua, err error) {
 	cfg = checkConfig(cfg)
 
 	L := lua.NewState()
+	// the state is only kept by a packet that was read
+	defer func() {
+		if err != nil {
+			L.Close()
+		}
+	}()
 
 	L.SetGlobal("error", L.NewFunction(lua_utils.LError))
 
@@ -137,7 +253,12 @@ func ReadPacket(f []byte, cfg *Config) (PacketLua, error) {
 	L.SetGlobal("install", L.NewFunction(newInstructions.LInstall))
 	L.SetGlobal("pathjoin", L.NewFunction(lua_utils.Ljoin))
 
-	if err := L.DoString(string(f)); err != nil {
+	chunk, err := L.Load(bytes.NewReader(f), PacketDotLuaChunkName)
+	if err != nil {
+		return PacketLua{}, err
+	}
+	L.Push(chunk)
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
 		return PacketLua{}, err
 	}
 
@@ -171,6 +292,7 @@ func ReadPacket(f []byte, cfg *Config) (PacketLua, error) {
 
 		GlobalDependencies: getDependenciesFromTable(pkgTable, "dependencies"),
 		GlobalSources:      getSourcesFromTable(pkgTable, "sources"),
+		GlobalPatches:      getPatchesFromTable(pkgTable, "patches"),
 
 		Build:   getFunctionFromTable(table, "build"),
 		Install: getFunctionFromTable(table, "install"),
@@ -219,130 +341,182 @@ func ReadPacketFromZSTDF(file io.Reader, cfg *Config) (PacketLua, error) {
 	return PacketLua{}, ErrCantFindPacketDotLua
 }
 
-// GetSource returns file []byte if method is "GET" or "POST", if is "git" returns *git.CloneOptions{}
-func GetSource(url, method string, info any, tryAttempts int) (any, error) {
-
-	switch method {
-	case "GET":
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			return nil, err
-		}
+// HTTPSource is a GET or POST source, the caller downloads it so it can be streamed to disk and resumed
+type HTTPSource struct {
+	Method  string
+	Url     string
+	Mirrors []string
+	Headers map[string]string
+	Body    []byte
+	// SHA256 are the accepted sums of the file, empty accepts any
+	SHA256 []string
+	// Digests are the sums of the other algorithms, the file must match each algorithm listed
+	Digests []Digest
+}
 
-		specs := info.(GETSpecs)
+// HasDigest reports if the source lists any sum to check the file against
+func (s *HTTPSource) HasDigest() bool {
+	return len(s.SHA256) > 0 || len(s.Digests) > 0
+}
 
-		if specs.Headers != nil {
-			for k, v := range *specs.Headers {
-				req.Header.Set(k, v)
-			}
-		}
+// Urls returns Url followed by the mirrors, the order they are tried in
+func (s *HTTPSource) Urls() []string {
+	return append([]string{s.Url}, s.Mirrors...)
+}
 
-		client := http.Client{Timeout: 5 * time.Minute}
+// NewRequest builds the request of the source to url, a new one for every attempt
+func (s *HTTPSource) NewRequest(url string) (*http.Request, error) {
+	var body io.Reader
+	if s.Body != nil {
+		body = bytes.NewReader(s.Body)
+	}
+	req, err := http.NewRequest(s.Method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
 
-		var resp *http.Response
-		for range tryAttempts {
-			resp, err = client.Do(req)
-			if err != nil {
-				return nil, err
-			}
-			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-				break
-			}
-			resp.Body.Close()
-		}
+// Accepts reports if a file with sum is a valid download of the source
+func (s *HTTPSource) Accepts(sum string) bool {
+	return len(s.SHA256) == 0 || slices.Contains(s.SHA256, strings.ToLower(sum))
+}
 
-		defer resp.Body.Close()
+// GitSource is a git source, the caller clones it with Options and then calls Checkout
+type GitSource struct {
+	Options    *git.CloneOptions
+	Commit     string
+	Submodules bool
+	Paths      []string
+}
 
-		data, err := io.ReadAll(resp.Body)
+// Checkout checks out the pinned commit, or the cloned branch or tag, and returns the commit hash. The
+// checked out commit must be the pinned one, an abbreviated commit must be unique
+func (s *GitSource) Checkout(repository *git.Repository) (string, error) {
+	var hash plumbing.Hash
+	if s.Commit != "" {
+		resolved, err := repository.ResolveRevision(plumbing.Revision(s.Commit))
 		if err != nil {
-			return nil, err
+			return "", fmt.Errorf("commit %s not found in %s: %w", s.Commit, s.Options.URL, err)
 		}
-
-		if !verifySHA256(*specs.SHA256, data) {
-			return nil, ErrSha256Sum
+		hash = *resolved
+	} else {
+		head, err := repository.Head()
+		if err != nil {
+			return "", err
 		}
+		hash = head.Hash()
+	}
 
-		return data, nil
-	case "POST":
-		specs := info.(POSTSpecs)
-		var body *bytes.Reader
+	worktree, err := repository.Worktree()
+	if err != nil {
+		return "", err
+	}
+	if err := worktree.Checkout(&git.CheckoutOptions{Hash: hash, Force: true, SparseCheckoutDirectories: s.Paths}); err != nil {
+		return "", err
+	}
 
-		if specs.Body != nil {
-			body = bytes.NewReader([]byte(*specs.Body))
-		} else {
-			body = nil
-		}
-		req, err := http.NewRequest("POST", url, body)
+	head, err := repository.Head()
+	if err != nil {
+		return "", err
+	}
+	if s.Commit != "" && !strings.HasPrefix(head.Hash().String(), s.Commit) {
+		return "", fmt.Errorf("%s checked out %s, expected commit %s", s.Options.URL, head.Hash(), s.Commit)
+	}
+
+	if s.Submodules {
+		submodules, err := worktree.Submodules()
 		if err != nil {
-			return nil, err
+			return "", err
 		}
-
-		if specs.Headers != nil {
-			for k, v := range *specs.Headers {
-				req.Header.Set(k, v)
-			}
+		if err := submodules.Update(&git.SubmoduleUpdateOptions{Init: true, RecurseSubmodules: git.DefaultSubmoduleRecursionDepth}); err != nil {
+			return "", fmt.Errorf("submodules of %s: %w", s.Options.URL, err)
 		}
+	}
+	return head.Hash().String(), nil
+}
 
-		client := http.Client{Timeout: 5 * time.Minute}
-
-		var resp *http.Response
-		for range tryAttempts {
-			resp, err = client.Do(req)
-			if err != nil {
-				return nil, err
-			}
-			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-				break
-			}
-			resp.Body.Close()
-		}
+// GetSource returns *HTTPSource if method is "GET" or "POST" and *GitSource if it is "git", mirrors are only
+// kept by *HTTPSource
+func GetSource(url, method string, info any, mirrors ...string) (any, error) {
 
-		defer resp.Body.Close()
+	switch method {
+	case "GET":
+		specs := info.(GETSpecs)
 
-		data, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
+		source := &HTTPSource{Method: "GET", Url: url, Mirrors: mirrors}
+		if specs.Headers != nil {
+			source.Headers = *specs.Headers
 		}
-
-		if !verifySHA256(*specs.SHA256, data) {
-			return nil, ErrSha256Sum
+		if specs.SHA256 != nil {
+			source.SHA256 = *specs.SHA256
 		}
+		source.Digests = specs.Digests
+		return source, nil
+	case "POST":
+		specs := info.(POSTSpecs)
 
-		return data, nil
+		source := &HTTPSource{Method: "POST", Url: url, Mirrors: mirrors}
+		if specs.Body != nil {
+			source.Body = []byte(*specs.Body)
+		}
+		if specs.Headers != nil {
+			source.Headers = *specs.Headers
+		}
+		if specs.SHA256 != nil {
+			source.SHA256 = *specs.SHA256
+		}
+		source.Digests = specs.Digests
+		return source, nil
 
 	case "git":
 		specs := info.(GitSpecs)
 
-		if specs.Tag == nil {
-			return &git.CloneOptions{
-				URL:           url,
-				SingleBranch:  true,
-				ReferenceName: plumbing.NewBranchReferenceName(specs.Branch),
-				Depth:         1,
-			}, nil
-		} else {
-			return &git.CloneOptions{
-				URL:           url,
-				SingleBranch:  true,
-				ReferenceName: plumbing.NewTagReferenceName(*specs.Tag),
-				Depth:         1,
-			}, nil
+		// the checkout is done by GitSource.Checkout, so it can go to the pinned commit and only the given paths
+		source := &GitSource{
+			Options:    &git.CloneOptions{URL: url, NoCheckout: true},
+			Commit:     strings.ToLower(specs.Commit),
+			Submodules: specs.Submodules,
+			Paths:      specs.Paths,
+		}
+		switch {
+		case specs.Tag != nil:
+			source.Options.ReferenceName = plumbing.NewTagReferenceName(*specs.Tag)
+		case specs.Branch != "":
+			source.Options.ReferenceName = plumbing.NewBranchReferenceName(specs.Branch)
 		}
+		if source.Options.ReferenceName != "" {
+			source.Options.SingleBranch = true
+		}
+		// a pinned commit can be anywhere in the history
+		if source.Commit == "" {
+			source.Options.Depth = 1
+		}
+		return source, nil
 	}
 
 	return nil, fmt.Errorf("invalid method")
 }
 
-func verifySHA256(checksum []string, src []byte) bool {
-	check := sha256.Sum256(src)
-	if len(checksum) == 0 {
-		return true
+// Close closes the Lua state, it can be called again after ExecuteInstall or a failed ExecuteBuild closed it
+func (pkg *PacketLua) Close() {
+	if pkg.LuaState != nil && !pkg.LuaState.IsClosed() {
+		pkg.LuaState.Close()
 	}
-	return slices.Contains(checksum, hex.EncodeToString(check[:]))
 }
 
-func (pkg *PacketLua) ExecuteBuild(cfg *Config) {
+// ExecuteBuild runs build(), a Lua error is returned as *ScriptError. ExecuteInstall is never run after an
+// error, so the Lua state is closed then
+func (pkg *PacketLua) ExecuteBuild(cfg *Config) (err error) {
 	L := pkg.LuaState
+	defer func() {
+		if err != nil {
+			L.Close()
+		}
+	}()
 
 	L.SetGlobal("error", L.NewFunction(lua_utils.LError))
 
@@ -356,6 +530,11 @@ func (pkg *PacketLua) ExecuteBuild(cfg *Config) {
 	osObject.RawSetString("symlink", L.NewFunction(lua_utils.LSymlink))
 	osObject.RawSetString("chmod", L.NewFunction(lua_utils.LChmod))
 
+	if cfg.Output != nil {
+		L.SetGlobal("print", L.NewFunction(lua_utils.LPrint(cfg.Output)))
+		osObject.RawSetString("execute", L.NewFunction(lua_utils.LExecute(cfg.Output)))
+	}
+
 	L.SetGlobal("BIN_DIR", lua.LString(cfg.BinDir))
 	L.SetGlobal("CURRENT_ARCH", lua.LString(runtime.GOARCH))
 	L.SetGlobal("CURRENT_ARCH_NORMALIZED", lua.LString(normalizeArch(runtime.GOARCH)))
@@ -372,15 +551,24 @@ func (pkg *PacketLua) ExecuteBuild(cfg *Config) {
 	os.Chdir(cfg.RootDir)
 
 	os.Setenv("PATH", os.Getenv("PATH")+":"+cfg.BinDir)
+	defer setEnv(cfg.Env)()
+
+	if pkg.Build == nil {
+		return nil
+	}
 
 	L.Push(pkg.Build)
-	L.Call(0, 0)
+	if err := L.PCall(0, 0, nil); err != nil {
+		return newScriptError("build", PackageID(pkg.Name+"@"+pkg.Version), err)
+	}
 
 	pkg.InstallInstructions = append(pkg.InstallInstructions, newInstructions...)
 	pkg.Flags = append(pkg.Flags, newFlags...)
+	return nil
 }
 
-func (pkg *PacketLua) ExecuteInstall(cfg *Config) {
+// ExecuteInstall runs install() and closes the Lua state, a Lua error is returned as *ScriptError
+func (pkg *PacketLua) ExecuteInstall(cfg *Config) error {
 	L := pkg.LuaState
 	defer L.Close()
 
@@ -396,6 +584,11 @@ func (pkg *PacketLua) ExecuteInstall(cfg *Config) {
 	osObject.RawSetString("symlink", L.NewFunction(lua_utils.LSymlink))
 	osObject.RawSetString("chmod", L.NewFunction(lua_utils.LChmod))
 
+	if cfg.Output != nil {
+		L.SetGlobal("print", L.NewFunction(lua_utils.LPrint(cfg.Output)))
+		osObject.RawSetString("execute", L.NewFunction(lua_utils.LExecute(cfg.Output)))
+	}
+
 	L.SetGlobal("BIN_DIR", lua.LString(cfg.BinDir))
 	L.SetGlobal("CURRENT_ARCH", lua.LString(runtime.GOARCH))
 	L.SetGlobal("CURRENT_ARCH_NORMALIZED", lua.LString(normalizeArch(runtime.GOARCH)))
@@ -412,11 +605,14 @@ func (pkg *PacketLua) ExecuteInstall(cfg *Config) {
 	os.Chdir(cfg.RootDir)
 
 	os.Setenv("PATH", os.Getenv("PATH")+":"+cfg.BinDir)
+	defer setEnv(cfg.Env)()
 
 	L.Push(pkg.Install)
-	L.Call(0, 0)
+	if err := L.PCall(0, 0, nil); err != nil {
+		return newScriptError("install", PackageID(pkg.Name+"@"+pkg.Version), err)
+	}
 
 	pkg.InstallInstructions = append(pkg.InstallInstructions, newInstructions...)
 	pkg.Flags = append(pkg.Flags, newFlags...)
-
+	return nil
 }
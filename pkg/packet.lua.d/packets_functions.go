@@ -62,7 +62,11 @@ func (all *allInstallInstructions) LInstall(L *lua.LState) int {
 
 			newinstruction.Destination = filepath.Join(dest, destinationFixed)
 			newinstruction.IsDir = d.IsDir()
-			newinstruction.FileMode = d.Type()
+			if info, err := d.Info(); err == nil {
+				newinstruction.FileMode = info.Mode()
+			} else {
+				newinstruction.FileMode = d.Type()
+			}
 
 			*all = append(*all, newinstruction)
 			return nil
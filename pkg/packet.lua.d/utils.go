@@ -2,6 +2,8 @@ package packet
 
 import (
 	"math/rand"
+	"os"
+	"runtime"
 	"strings"
 )
 
@@ -15,6 +17,37 @@ func randStringBytes(n int) string {
 	return string(b)
 }
 
+// setEnv applies KEY=VALUE entries to the process environment and returns a function restoring the old values
+func setEnv(env []string) func() {
+	type previous struct {
+		value  string
+		exists bool
+	}
+	old := make(map[string]previous)
+
+	for _, entry := range env {
+		key, value, found := strings.Cut(entry, "=")
+		if !found {
+			continue
+		}
+		if _, saved := old[key]; !saved {
+			v, exists := os.LookupEnv(key)
+			old[key] = previous{value: v, exists: exists}
+		}
+		os.Setenv(key, value)
+	}
+
+	return func() {
+		for key, p := range old {
+			if p.exists {
+				os.Setenv(key, p.value)
+			} else {
+				os.Unsetenv(key)
+			}
+		}
+	}
+}
+
 type PackageID string
 
 func (id PackageID) Name() string {
@@ -31,6 +64,34 @@ func NewId(id string) PackageID {
 	return ID
 }
 
+// RuntimeDependencies returns the global runtime dependencies merged with the ones of the current plataform
+func (pkg PacketLua) RuntimeDependencies() map[string]VersionConstraint {
+	deps := make(map[string]VersionConstraint)
+	for name, constraint := range pkg.GlobalDependencies.RuntimeDependencies {
+		deps[name] = constraint
+	}
+	if plataform, exists := pkg.Plataforms[OperationalSystem(runtime.GOOS)]; exists {
+		for name, constraint := range plataform.Dependencies.RuntimeDependencies {
+			deps[name] = constraint
+		}
+	}
+	return deps
+}
+
+// BuildDependencies returns the global build dependencies merged with the ones of the current plataform
+func (pkg PacketLua) BuildDependencies() map[string]VersionConstraint {
+	deps := make(map[string]VersionConstraint)
+	for name, constraint := range pkg.GlobalDependencies.BuildDependencies {
+		deps[name] = constraint
+	}
+	if plataform, exists := pkg.Plataforms[OperationalSystem(runtime.GOOS)]; exists {
+		for name, constraint := range plataform.Dependencies.BuildDependencies {
+			deps[name] = constraint
+		}
+	}
+	return deps
+}
+
 func (pkg PacketLua) IsValid() bool {
 
 	var a, b int
@@ -39,7 +100,7 @@ func (pkg PacketLua) IsValid() bool {
 		for _, src := range v.Sources {
 			a++
 			if src.Method == "git" {
-				if src.Specs.(GitSpecs).Branch == "" && src.Specs.(GitSpecs).Tag == nil {
+				if specs := src.Specs.(GitSpecs); specs.Branch == "" && specs.Tag == nil && specs.Commit == "" {
 					return false
 				}
 			}